@@ -2,15 +2,25 @@ package client
 
 import (
 	"context"
-	"errors"
 
 	gdb "github.com/blong14/gache/internal/db"
 	gproxy "github.com/blong14/gache/internal/proxy"
 )
 
+// Errors returned by a Client
+var (
+	ErrTableNotFound = gdb.ErrTableNotFound
+	ErrKeyNotFound   = gdb.ErrKeyNotFound
+	ErrInvalidQuery  = gdb.ErrInvalidQuery
+	ErrWriteFailed   = gdb.ErrWriteFailed
+	ErrBackpressure  = gproxy.ErrBackpressure
+)
+
 type Client interface {
 	Close(ctx context.Context) error
 	Get(ctx context.Context, t, k []byte) ([]byte, error)
+	// GetMany returns the value of each key in order; missing keys are nil
+	GetMany(ctx context.Context, t []byte, keys ...[]byte) ([][]byte, error)
 	Set(ctx context.Context, t, k, v []byte) error
 }
 
@@ -31,19 +41,46 @@ func NewProxyClient() Client {
 func (c *proxyClient) Get(ctx context.Context, table, key []byte) ([]byte, error) {
 	query, _ := gdb.NewGetValueQuery(ctx, table, key)
 	c.proxy.Send(ctx, query)
-	resp := query.GetResponse()
-	if !resp.Success {
-		return nil, errors.New("missing value")
+	resp, err := query.GetResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
 	}
 	return resp.Value, nil
 }
 
+func (c *proxyClient) GetMany(ctx context.Context, table []byte, keys ...[]byte) ([][]byte, error) {
+	query, _ := gdb.NewBatchGetValueQuery(ctx, table, keys)
+	c.proxy.Send(ctx, query)
+	resp, err := query.GetResponse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+	found := make(map[string][]byte, len(resp.RangeValues))
+	for _, kv := range resp.RangeValues {
+		found[string(kv[0])] = kv[1]
+	}
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = found[string(k)]
+	}
+	return values, nil
+}
+
 func (c *proxyClient) Set(ctx context.Context, table, key, value []byte) error {
 	query, _ := gdb.NewSetValueQuery(ctx, table, key, value)
 	c.proxy.Send(ctx, query)
-	resp := query.GetResponse()
-	if !resp.Success {
-		return errors.New("key not set")
+	resp, err := query.GetResponse(ctx)
+	if err != nil {
+		return err
+	}
+	if resp.Err != nil {
+		return resp.Err
 	}
 	return nil
 }
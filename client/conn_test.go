@@ -3,6 +3,7 @@ package client_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"testing"
 
 	gclient "github.com/blong14/gache/client"
@@ -23,8 +24,20 @@ func TestClient(t *testing.T) {
 		t.Error("value not found")
 	}
 	_, err = conn.Get(ctx, table, []byte("__not_found__"))
-	if err == nil {
-		t.Error("should not have found the key")
+	if !errors.Is(err, gclient.ErrKeyNotFound) {
+		t.Errorf("w %s g %v", gclient.ErrKeyNotFound, err)
+	}
+	_, err = conn.Get(ctx, []byte("__missing_table__"), key)
+	if !errors.Is(err, gclient.ErrTableNotFound) {
+		t.Errorf("w %s g %v", gclient.ErrTableNotFound, err)
+	}
+	values, err := conn.GetMany(ctx, table, key, []byte("__not_found__"), key)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(values) != 3 || !bytes.Equal(values[0], value) ||
+		values[1] != nil || !bytes.Equal(values[2], value) {
+		t.Errorf("unexpected values %q", values)
 	}
 	err = conn.Close(ctx)
 	if err != nil {
@@ -27,7 +27,7 @@ func main() {
 	gproxy.StartProxy(ctx, proxy)
 
 	rpcSRV := ghandlers.Server(":8080")
-	go grpc.Start(rpcSRV, ghandlers.RPCHandlers())
+	go grpc.Start(rpcSRV, ghandlers.RPCHandlers(proxy))
 
 	httpSRV := ghandlers.Server(":8081")
 	go ghttp.Start(httpSRV, ghandlers.HTTPHandlers(proxy))
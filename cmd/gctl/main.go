@@ -13,7 +13,7 @@ import (
 	"time"
 
 	genv "github.com/blong14/gache/internal/env"
-	gache "github.com/blong14/gache/sql"
+	_ "github.com/blong14/gache/sql"
 )
 
 func mustGetDB() *sql.DB {
@@ -59,20 +59,46 @@ func accept(ctx context.Context, db *sql.DB) {
 		b := strings.Builder{}
 		b.Reset()
 		start := time.Now()
-		var result *gache.QueryResponse
-		if err := db.QueryRowContext(ctx, scanner.Text()).Scan(&result); err != nil {
+		count, err := printRows(ctx, db, scanner.Text(), &b)
+		if err != nil {
 			log.Println(err)
 			fmt.Print("\n% ")
 			continue
 		}
-		b.WriteString("%\tkey\t\tvalue\n")
-		if result.Success {
-			for i, r := range result.RangeValues {
-				b.WriteString(fmt.Sprintf("%d.\t%s\t\t%s\n", i, r[0], r[1]))
-			}
-		}
 		b.WriteString(
-			fmt.Sprintf("\n[%s] %d rows\n%% ", time.Since(start), result.Stats.Count))
+			fmt.Sprintf("\n[%s] %d rows\n%% ", time.Since(start), count))
 		fmt.Print(b.String())
 	}
 }
+
+// printRows runs query and writes each row it returns to b
+func printRows(ctx context.Context, db *sql.DB, query string, b *strings.Builder) (int, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = rows.Close() }()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	b.WriteString("%\t" + strings.Join(columns, "\t\t") + "\n")
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return count, err
+		}
+		b.WriteString(fmt.Sprintf("%d.", count))
+		for _, v := range values {
+			b.WriteString(fmt.Sprintf("\t%s\t", v))
+		}
+		b.WriteString("\n")
+		count++
+	}
+	return count, rows.Err()
+}
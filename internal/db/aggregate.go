@@ -0,0 +1,187 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// AggregateFunc is the function an Aggregation computes
+type AggregateFunc int
+
+const (
+	AggCount AggregateFunc = iota
+	AggSum
+	AggMin
+	AggMax
+	AggAvg
+)
+
+func (f AggregateFunc) String() string {
+	switch f {
+	case AggCount:
+		return "count"
+	case AggSum:
+		return "sum"
+	case AggMin:
+		return "min"
+	case AggMax:
+		return "max"
+	case AggAvg:
+		return "avg"
+	default:
+		return "unknown"
+	}
+}
+
+// Aggregation is an aggregate function of the rows a query reads.
+// Count counts rows, or the rows where Arg is not NULL when Arg is
+// set. Sum, min, max and avg read Arg as a number and skip rows where
+// it is NULL or not a number; they are NULL when no row is left.
+type Aggregation struct {
+	Func AggregateFunc
+	Arg  *Projection
+}
+
+func (a Aggregation) String() string {
+	if a.Arg == nil {
+		return a.Func.String() + "(*)"
+	}
+	return fmt.Sprintf("%s(%s)", a.Func, a.Arg)
+}
+
+// GroupBy groups rows by the first Parts parts of their key split on
+// Separator, so prefix(key, ':', 1) groups user:1 and user:2 as user
+type GroupBy struct {
+	Separator []byte
+	Parts     int
+}
+
+func (g *GroupBy) String() string {
+	return fmt.Sprintf("group by prefix(key, '%s', %d)", g.Separator, g.Parts)
+}
+
+// Group returns the group of key; keys with fewer parts are their own group
+func (g *GroupBy) Group(key []byte) []byte {
+	end := -len(g.Separator)
+	for i := 0; i < g.Parts; i++ {
+		start := end + len(g.Separator)
+		next := bytes.Index(key[start:], g.Separator)
+		if next < 0 {
+			return key
+		}
+		end = start + next
+	}
+	return key[:end]
+}
+
+// Aggregator folds rows into aggregations as they are read. It keeps
+// one state for each group rather than the rows themselves.
+type Aggregator struct {
+	aggs    []Aggregation
+	groupBy *GroupBy
+	groups  map[string][]aggState
+}
+
+// aggState is the running value of one aggregation
+type aggState struct {
+	count    uint64
+	sum      float64
+	min, max float64
+}
+
+func NewAggregator(aggs []Aggregation, groupBy *GroupBy) *Aggregator {
+	return &Aggregator{
+		aggs:    aggs,
+		groupBy: groupBy,
+		groups:  make(map[string][]aggState),
+	}
+}
+
+// Add folds a row into the aggregations of its group
+func (a *Aggregator) Add(key, value []byte) {
+	var group string
+	if a.groupBy != nil {
+		group = string(a.groupBy.Group(key))
+	}
+	states, ok := a.groups[group]
+	if !ok {
+		states = make([]aggState, len(a.aggs))
+		a.groups[group] = states
+	}
+	for i, agg := range a.aggs {
+		if agg.Arg == nil {
+			states[i].count++
+			continue
+		}
+		arg := agg.Arg.Apply(key, value)
+		if arg == nil {
+			continue
+		}
+		if agg.Func == AggCount {
+			states[i].count++
+			continue
+		}
+		n, err := strconv.ParseFloat(string(arg), 64)
+		if err != nil {
+			continue
+		}
+		s := &states[i]
+		if s.count == 0 || n < s.min {
+			s.min = n
+		}
+		if s.count == 0 || n > s.max {
+			s.max = n
+		}
+		s.count++
+		s.sum += n
+	}
+}
+
+// Rows returns a row for each group in order: the group, when rows are
+// grouped, followed by the value of each aggregation. A NULL value is
+// nil. Without a GroupBy there is a single row even when no rows were added.
+func (a *Aggregator) Rows() [][][]byte {
+	if a.groupBy == nil && len(a.groups) == 0 {
+		a.groups[""] = make([]aggState, len(a.aggs))
+	}
+	groups := make([]string, 0, len(a.groups))
+	for group := range a.groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	rows := make([][][]byte, 0, len(groups))
+	for _, group := range groups {
+		var row [][]byte
+		if a.groupBy != nil {
+			row = append(row, []byte(group))
+		}
+		for i, agg := range a.aggs {
+			row = append(row, a.groups[group][i].value(agg.Func))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (s aggState) value(f AggregateFunc) []byte {
+	if f == AggCount {
+		return []byte(strconv.FormatUint(s.count, 10))
+	}
+	if s.count == 0 {
+		return nil
+	}
+	var n float64
+	switch f {
+	case AggSum:
+		n = s.sum
+	case AggMin:
+		n = s.min
+	case AggMax:
+		n = s.max
+	default:
+		n = s.sum / float64(s.count)
+	}
+	return []byte(strconv.FormatFloat(n, 'f', -1, 64))
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks where a paged range scan stopped. Key is the last key
+// returned; a scan resumes strictly after it, so rows written since
+// show up on the pages that reach them. Seq is the table sequence the
+// page was read at and is only informational.
+type Cursor struct {
+	Key []byte
+	Seq uint64
+}
+
+var cursorEncoding = base64.RawURLEncoding
+
+// Encode returns the opaque token handed to clients
+func (c *Cursor) Encode() []byte {
+	raw := make([]byte, 8+len(c.Key))
+	binary.BigEndian.PutUint64(raw, c.Seq)
+	copy(raw[8:], c.Key)
+	out := make([]byte, cursorEncoding.EncodedLen(len(raw)))
+	cursorEncoding.Encode(out, raw)
+	return out
+}
+
+func DecodeCursor(token []byte) (*Cursor, error) {
+	raw := make([]byte, cursorEncoding.DecodedLen(len(token)))
+	n, err := cursorEncoding.Decode(raw, token)
+	if err != nil || n < 8 {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{
+		Seq: binary.BigEndian.Uint64(raw[:8]),
+		Key: raw[8:n],
+	}, nil
+}
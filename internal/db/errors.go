@@ -0,0 +1,13 @@
+package db
+
+import (
+	"errors"
+)
+
+// Errors carried by QueryResponse.Err
+var (
+	ErrTableNotFound = errors.New("table not found")
+	ErrKeyNotFound   = errors.New("key not found")
+	ErrInvalidQuery  = errors.New("invalid query")
+	ErrWriteFailed   = errors.New("write failed")
+)
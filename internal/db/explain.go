@@ -0,0 +1,178 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	gstable "github.com/blong14/gache/internal/db/sstable"
+)
+
+// ReadStats counts the storage work of the reads of one query
+type ReadStats struct {
+	// RowsScanned counts the rows read, including those a filter rejected
+	RowsScanned uint
+	// MemtableHits counts the values read from the memtable
+	MemtableHits uint
+	// SSTables counts the lookups and scans that consulted an sstable
+	SSTables uint
+	// BloomSkips and BlocksRead count the work done in sstables
+	gstable.Stats
+	// CacheHits counts the keys found in the table rather than read
+	// through its Loader
+	CacheHits uint
+}
+
+func (s *ReadStats) memtableHit() {
+	if s != nil {
+		s.MemtableHits++
+	}
+}
+
+func (s *ReadStats) scanned() {
+	if s != nil {
+		s.RowsScanned++
+	}
+}
+
+// sstable counts a read that consults the sstable and returns the
+// stats it counts its work in
+func (s *ReadStats) sstable() *gstable.Stats {
+	if s == nil {
+		return nil
+	}
+	s.SSTables++
+	return &s.Stats
+}
+
+// memtable counts the values read from a memtable iterator
+func (s *ReadStats) memtable(it Iterator) Iterator {
+	if s == nil {
+		return it
+	}
+	return &countingIterator{Iterator: it, count: &s.MemtableHits}
+}
+
+// countingIterator counts the values read from an Iterator
+type countingIterator struct {
+	Iterator
+	count *uint
+}
+
+func (i *countingIterator) Value() []byte {
+	*i.count++
+	return i.Iterator.Value()
+}
+
+// Stage is how long one stage of an analyzed query took
+type Stage struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Explain describes how a query reads its table as name and value
+// rows: its access path, the bounds of the keys it reads and the work
+// pushed down to the worker
+func Explain(q *Query) [][][]byte {
+	var rows [][][]byte
+	line := func(name string, value interface{}) {
+		rows = append(rows, [][]byte{[]byte(name), []byte(fmt.Sprint(value))})
+	}
+	line("table", string(q.Header.TableName))
+	kr := q.KeyRange
+	switch q.Header.Inst {
+	case GetValue:
+		line("access", "point lookup")
+		line("key", string(q.Key))
+	case BatchGetValue:
+		line("access", "point lookups")
+		keys := make([]string, len(q.Values))
+		for i, kv := range q.Values {
+			keys[i] = string(kv.Key)
+		}
+		line("keys", strings.Join(keys, ", "))
+	case GetRange, Aggregate:
+		line("access", "range scan")
+		explainRange(line, kr)
+	case JoinRange:
+		line("access", "merge join")
+		line("join", q.Join)
+		explainRange(line, kr)
+	case InsertRange:
+		line("access", "range copy")
+		line("source", string(q.Header.Source))
+		explainRange(line, kr)
+	case Range:
+		line("access", "full scan")
+		kr = KeyRange{}
+	case DeleteRange:
+		line("access", "range delete")
+		explainRange(line, kr)
+	default:
+		line("access", q.Header.Inst)
+	}
+	if kr.Filter != nil {
+		line("filter", kr.Filter)
+	}
+	for _, p := range q.Project {
+		line("project", p)
+	}
+	for _, agg := range q.Aggregates {
+		line("aggregate", agg)
+	}
+	if q.GroupBy != nil {
+		line("group", q.GroupBy)
+	}
+	return rows
+}
+
+func explainRange(line func(string, interface{}), kr KeyRange) {
+	lower, upper := "[", "]"
+	if kr.StartExclusive {
+		lower = "("
+	}
+	if kr.EndExclusive {
+		upper = ")"
+	}
+	start, end := "-inf", "+inf"
+	if kr.Start != nil {
+		start = string(kr.Start)
+	}
+	if kr.End != nil {
+		end = string(kr.End)
+	}
+	line("bounds", lower+start+", "+end+upper)
+	if kr.Prefix != nil {
+		line("prefix", string(kr.Prefix))
+	}
+	if kr.Reverse {
+		line("order", "key desc")
+	}
+	if kr.Limit > 0 {
+		line("limit", kr.Limit)
+	}
+	if kr.Cursor != nil {
+		line("after", string(kr.Cursor))
+	}
+}
+
+// Analyze describes what running a query did as name and value rows
+func (s QueryStats) Analyze() [][][]byte {
+	var rows [][][]byte
+	line := func(name string, value interface{}) {
+		rows = append(rows, [][]byte{[]byte(name), []byte(fmt.Sprint(value))})
+	}
+	line("rows", s.Count)
+	if r := s.Reads; r != nil {
+		line("rows_scanned", r.RowsScanned)
+		line("memtable_hits", r.MemtableHits)
+		line("sstables", r.SSTables)
+		line("bloom_skips", r.BloomSkips)
+		line("blocks_read", r.BlocksRead)
+		line("cache_hits", r.CacheHits)
+	}
+	for _, stage := range s.Stages {
+		line("stage."+stage.Name, stage.Duration)
+	}
+	return rows
+}
@@ -0,0 +1,470 @@
+package db
+
+import (
+	"bytes"
+)
+
+// Iterator walks key value pairs in key order. A new Iterator is
+// unpositioned; call Seek, SeekToFirst or SeekToLast before reading.
+// Key and Value are only valid until the next call that moves the iterator.
+type Iterator interface {
+	Seek(k []byte) bool
+	SeekToFirst() bool
+	SeekToLast() bool
+	Next() bool
+	Prev() bool
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Err() error
+	Close() error
+}
+
+// mergeIterator merges several sorted iterators into a single view. When
+// more than one child holds the same key the child listed first wins, so
+// newer sources (the memtable) must come before older ones (sstables).
+type mergeIterator struct {
+	children []Iterator
+	curr     int
+	forward  bool
+}
+
+func newMergeIterator(children ...Iterator) *mergeIterator {
+	return &mergeIterator{children: children, curr: -1, forward: true}
+}
+
+func (m *mergeIterator) Valid() bool {
+	return m.curr >= 0
+}
+
+func (m *mergeIterator) Key() []byte {
+	if m.curr < 0 {
+		return nil
+	}
+	return m.children[m.curr].Key()
+}
+
+func (m *mergeIterator) Value() []byte {
+	if m.curr < 0 {
+		return nil
+	}
+	return m.children[m.curr].Value()
+}
+
+func (m *mergeIterator) Err() error {
+	for _, child := range m.children {
+		if err := child.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergeIterator) Close() error {
+	var err error
+	for _, child := range m.children {
+		if cerr := child.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	m.curr = -1
+	return err
+}
+
+func (m *mergeIterator) Seek(k []byte) bool {
+	for _, child := range m.children {
+		child.Seek(k)
+	}
+	m.forward = true
+	return m.findSmallest()
+}
+
+func (m *mergeIterator) SeekToFirst() bool {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+	m.forward = true
+	return m.findSmallest()
+}
+
+func (m *mergeIterator) SeekToLast() bool {
+	for _, child := range m.children {
+		child.SeekToLast()
+	}
+	m.forward = false
+	return m.findLargest()
+}
+
+func (m *mergeIterator) Next() bool {
+	if m.curr < 0 {
+		return false
+	}
+	key := m.Key()
+	for _, child := range m.children {
+		if !m.forward {
+			// children sit before key when moving backwards
+			child.Seek(key)
+		}
+		if child.Valid() && bytes.Equal(child.Key(), key) {
+			child.Next()
+		}
+	}
+	m.forward = true
+	return m.findSmallest()
+}
+
+func (m *mergeIterator) Prev() bool {
+	if m.curr < 0 {
+		return false
+	}
+	key := m.Key()
+	for _, child := range m.children {
+		if m.forward {
+			// children sit at or after key when moving forwards
+			if child.Seek(key) {
+				child.Prev()
+			} else {
+				child.SeekToLast()
+			}
+		}
+		if child.Valid() && bytes.Equal(child.Key(), key) {
+			child.Prev()
+		}
+	}
+	m.forward = false
+	return m.findLargest()
+}
+
+func (m *mergeIterator) findSmallest() bool {
+	m.curr = -1
+	for i, child := range m.children {
+		if !child.Valid() {
+			continue
+		}
+		if m.curr < 0 || bytes.Compare(child.Key(), m.children[m.curr].Key()) < 0 {
+			m.curr = i
+		}
+	}
+	return m.Valid()
+}
+
+func (m *mergeIterator) findLargest() bool {
+	m.curr = -1
+	for i, child := range m.children {
+		if !child.Valid() {
+			continue
+		}
+		if m.curr < 0 || bytes.Compare(child.Key(), m.children[m.curr].Key()) > 0 {
+			m.curr = i
+		}
+	}
+	return m.Valid()
+}
+
+// valueIterator rewrites the values produced by an Iterator
+type valueIterator struct {
+	Iterator
+	fnc func(k, v []byte) []byte
+}
+
+func (i *valueIterator) Value() []byte {
+	return i.fnc(i.Key(), i.Iterator.Value())
+}
+
+// NewSkipIterator returns an Iterator hiding the keys of it that skip
+// reports true for
+func NewSkipIterator(it Iterator, skip func(k []byte) bool) Iterator {
+	return &skipIterator{Iterator: it, skip: skip}
+}
+
+// skipIterator hides the keys of an Iterator that skip reports true for
+type skipIterator struct {
+	Iterator
+	skip func(k []byte) bool
+}
+
+func (i *skipIterator) Seek(k []byte) bool {
+	i.Iterator.Seek(k)
+	return i.forward()
+}
+
+func (i *skipIterator) SeekToFirst() bool {
+	i.Iterator.SeekToFirst()
+	return i.forward()
+}
+
+func (i *skipIterator) SeekToLast() bool {
+	i.Iterator.SeekToLast()
+	return i.backward()
+}
+
+func (i *skipIterator) Next() bool {
+	i.Iterator.Next()
+	return i.forward()
+}
+
+func (i *skipIterator) Prev() bool {
+	i.Iterator.Prev()
+	return i.backward()
+}
+
+func (i *skipIterator) forward() bool {
+	for i.Iterator.Valid() && i.skip(i.Key()) {
+		i.Iterator.Next()
+	}
+	return i.Iterator.Valid()
+}
+
+func (i *skipIterator) backward() bool {
+	for i.Iterator.Valid() && i.skip(i.Key()) {
+		i.Iterator.Prev()
+	}
+	return i.Iterator.Valid()
+}
+
+// RangeIterator restricts an Iterator to the bounds, filter and limit of a
+// KeyRange. Next and Prev move in scan order, so a Reverse range walks from
+// its largest key down. It is positioned on the first matching row when returned.
+type RangeIterator struct {
+	Iterator
+	// Seq is the table sequence the scan started at; see StartAt
+	Seq uint64
+	// Project computes the columns returned by Row
+	Project []Projection
+	// Stats counts the rows scanned when it is set
+	Stats *ReadStats
+	kr    KeyRange
+	lower bound
+	upper bound
+	count int
+	last  []byte
+	err   error
+}
+
+type bound struct {
+	key       []byte
+	exclusive bool
+}
+
+func NewRangeIterator(it Iterator, kr KeyRange) *RangeIterator {
+	return NewRangeIteratorWithStats(it, kr, nil)
+}
+
+// NewRangeIteratorWithStats returns a RangeIterator counting the rows
+// it scans in stats, which may be nil
+func NewRangeIteratorWithStats(it Iterator, kr KeyRange, stats *ReadStats) *RangeIterator {
+	r := &RangeIterator{
+		Iterator: it,
+		Stats:    stats,
+		kr:       kr,
+		lower:    bound{key: kr.Start, exclusive: kr.StartExclusive},
+		upper:    bound{key: kr.End, exclusive: kr.EndExclusive},
+	}
+	if kr.Prefix != nil {
+		if r.lower.key == nil || bytes.Compare(kr.Prefix, r.lower.key) > 0 {
+			r.lower = bound{key: kr.Prefix}
+		}
+		if end := prefixEnd(kr.Prefix); end != nil &&
+			(r.upper.key == nil || bytes.Compare(end, r.upper.key) <= 0) {
+			r.upper = bound{key: end, exclusive: true}
+		}
+	}
+	if kr.Cursor != nil {
+		cursor, err := DecodeCursor(kr.Cursor)
+		if err != nil {
+			r.err = err
+			return r
+		}
+		// resume strictly past the last key of the previous page
+		after := bound{key: cursor.Key, exclusive: true}
+		switch {
+		case kr.Reverse && !r.belowUpper(cursor.Key):
+		case kr.Reverse:
+			r.upper = after
+		case r.aboveLower(cursor.Key):
+			r.lower = after
+		}
+	}
+	r.SeekToFirst()
+	return r
+}
+
+// StartAt records the table sequence the scan started at, which the
+// cursors it returns carry
+func (r *RangeIterator) StartAt(seq uint64) {
+	r.Seq = seq
+}
+
+// Cursor returns a token that resumes the scan after the last row
+// stepped past, or nil when the range has been exhausted
+func (r *RangeIterator) Cursor() []byte {
+	if r.last == nil || r.err != nil || !r.inRange() {
+		return nil
+	}
+	cursor := Cursor{Key: r.last, Seq: r.Seq}
+	return cursor.Encode()
+}
+
+// Row returns the columns of the current row
+func (r *RangeIterator) Row() [][]byte {
+	if j, ok := r.Iterator.(*joinIterator); ok {
+		joined, matched := j.Joined()
+		return ProjectJoin(r.Project, r.Key(), r.Value(), joined, matched)
+	}
+	return Project(r.Project, r.Key(), r.Value())
+}
+
+func (r *RangeIterator) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Iterator.Err()
+}
+
+// prefixEnd returns the smallest key greater than every key starting
+// with prefix or nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func (r *RangeIterator) aboveLower(key []byte) bool {
+	if r.lower.key == nil {
+		return true
+	}
+	c := bytes.Compare(key, r.lower.key)
+	return c > 0 || (c == 0 && !r.lower.exclusive)
+}
+
+func (r *RangeIterator) belowUpper(key []byte) bool {
+	if r.upper.key == nil {
+		return true
+	}
+	c := bytes.Compare(key, r.upper.key)
+	return c < 0 || (c == 0 && !r.upper.exclusive)
+}
+
+func (r *RangeIterator) Valid() bool {
+	if r.kr.Limit > 0 && r.count >= r.kr.Limit {
+		return false
+	}
+	return r.inRange()
+}
+
+func (r *RangeIterator) inRange() bool {
+	if r.err != nil || !r.Iterator.Valid() {
+		return false
+	}
+	key := r.Key()
+	return r.aboveLower(key) && r.belowUpper(key)
+}
+
+// Seek moves to the first row at or after k in scan order
+func (r *RangeIterator) Seek(k []byte) bool {
+	if r.kr.Reverse {
+		return r.seekBackward(k)
+	}
+	return r.seekForward(k)
+}
+
+func (r *RangeIterator) SeekToFirst() bool {
+	r.count = 0
+	r.last = nil
+	if r.kr.Reverse {
+		return r.seekBackward(r.upper.key)
+	}
+	return r.seekForward(r.lower.key)
+}
+
+func (r *RangeIterator) SeekToLast() bool {
+	r.count = 0
+	r.last = nil
+	if r.kr.Reverse {
+		return r.seekForward(r.lower.key)
+	}
+	return r.seekBackward(r.upper.key)
+}
+
+func (r *RangeIterator) Next() bool {
+	return r.step(r.kr.Reverse)
+}
+
+func (r *RangeIterator) Prev() bool {
+	return r.step(!r.kr.Reverse)
+}
+
+func (r *RangeIterator) step(backward bool) bool {
+	if !r.Valid() {
+		return false
+	}
+	r.count++
+	r.last = append(r.last[:0], r.Key()...)
+	if backward {
+		r.Iterator.Prev()
+	} else {
+		r.Iterator.Next()
+	}
+	r.filter(backward)
+	return r.Valid()
+}
+
+// filter moves past the rows in range whose value the filter does not match
+func (r *RangeIterator) filter(backward bool) {
+	if r.kr.Filter == nil {
+		if r.inRange() {
+			r.Stats.scanned()
+		}
+		return
+	}
+	for r.inRange() {
+		r.Stats.scanned()
+		if r.kr.Filter.Match(r.Value()) {
+			return
+		}
+		if backward {
+			r.Iterator.Prev()
+		} else {
+			r.Iterator.Next()
+		}
+	}
+}
+
+// seekForward positions the iterator on the smallest key >= k
+// that is inside the range
+func (r *RangeIterator) seekForward(k []byte) bool {
+	if k == nil || !r.aboveLower(k) {
+		k = r.lower.key
+	}
+	if k == nil {
+		r.Iterator.SeekToFirst()
+	} else if r.Iterator.Seek(k) && !r.aboveLower(r.Key()) {
+		r.Iterator.Next()
+	}
+	r.filter(false)
+	return r.Valid()
+}
+
+// seekBackward positions the iterator on the largest key <= k
+// that is inside the range
+func (r *RangeIterator) seekBackward(k []byte) bool {
+	if k == nil || !r.belowUpper(k) {
+		k = r.upper.key
+	}
+	switch {
+	case k == nil:
+		r.Iterator.SeekToLast()
+	case !r.Iterator.Seek(k):
+		r.Iterator.SeekToLast()
+	case !bytes.Equal(r.Key(), k) || !r.belowUpper(r.Key()):
+		r.Iterator.Prev()
+	}
+	r.filter(true)
+	return r.Valid()
+}
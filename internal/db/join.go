@@ -0,0 +1,143 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Join joins the rows a query reads with the rows of Table that have
+// the same key
+type Join struct {
+	Table []byte
+	// Outer keeps the rows with no match in Table; the columns
+	// read from Table are NULL for them
+	Outer bool
+	// Filter restricts the rows of Table that can match
+	Filter *Predicate
+}
+
+func (j *Join) String() string {
+	kind := "join"
+	if j.Outer {
+		kind = "left join"
+	}
+	out := fmt.Sprintf("%s %s", kind, j.Table)
+	if j.Filter != nil {
+		out = fmt.Sprintf("%s where %s", out, j.Filter)
+	}
+	return out
+}
+
+// joinIterator merge joins the rows of an Iterator with the rows of
+// a second table's Iterator that have the same key. It is positioned
+// on the rows of the first that match or, for outer joins, on every
+// row of the first.
+type joinIterator struct {
+	Iterator
+	right Iterator
+	join  *Join
+	// merging is set while right was last moved forward to a key at or
+	// before the current row, so the next row only steps it forward
+	merging bool
+	matched bool
+}
+
+// NewJoinIterator returns an Iterator over the rows of left joined
+// with the rows of right; RangeIterator.Row projects the joined columns
+func NewJoinIterator(left, right Iterator, join *Join) Iterator {
+	return &joinIterator{Iterator: left, right: right, join: join}
+}
+
+// Joined returns the value of the row of the joined table that
+// matches the current row; ok is false when there is none
+func (j *joinIterator) Joined() ([]byte, bool) {
+	if !j.matched {
+		return nil, false
+	}
+	return j.right.Value(), true
+}
+
+func (j *joinIterator) Seek(k []byte) bool {
+	j.Iterator.Seek(k)
+	j.merging = false
+	return j.forward()
+}
+
+func (j *joinIterator) SeekToFirst() bool {
+	j.Iterator.SeekToFirst()
+	j.merging = false
+	return j.forward()
+}
+
+func (j *joinIterator) SeekToLast() bool {
+	j.Iterator.SeekToLast()
+	j.merging = false
+	return j.backward()
+}
+
+func (j *joinIterator) Next() bool {
+	j.Iterator.Next()
+	return j.forward()
+}
+
+func (j *joinIterator) Prev() bool {
+	j.Iterator.Prev()
+	j.merging = false
+	return j.backward()
+}
+
+func (j *joinIterator) Err() error {
+	if err := j.Iterator.Err(); err != nil {
+		return err
+	}
+	return j.right.Err()
+}
+
+func (j *joinIterator) Close() error {
+	err := j.Iterator.Close()
+	if rerr := j.right.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// forward moves to the next row at or after the current one that joins
+func (j *joinIterator) forward() bool {
+	for j.Iterator.Valid() {
+		if j.match(true) || j.join.Outer {
+			return true
+		}
+		j.Iterator.Next()
+	}
+	j.matched = false
+	return false
+}
+
+// backward moves to the previous row at or before the current one that joins
+func (j *joinIterator) backward() bool {
+	for j.Iterator.Valid() {
+		if j.match(false) || j.join.Outer {
+			return true
+		}
+		j.Iterator.Prev()
+	}
+	j.matched = false
+	return false
+}
+
+// match positions right on the key of the current row. Moving forward
+// it steps right along with the rows as a merge; otherwise it seeks.
+func (j *joinIterator) match(forward bool) bool {
+	key := j.Key()
+	if forward && j.merging {
+		for j.right.Valid() && bytes.Compare(j.right.Key(), key) < 0 {
+			j.right.Next()
+		}
+	} else {
+		j.right.Seek(key)
+		j.merging = forward
+	}
+	j.matched = j.right.Valid() && bytes.Equal(j.right.Key(), key) &&
+		j.join.Filter.Match(j.right.Value())
+	return j.matched
+}
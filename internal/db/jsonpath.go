@@ -0,0 +1,189 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONPath selects a member of a JSON document with a path such as
+// $.user.name, $.tags[0] or $["first name"]. Text extracts strings
+// without their quotes, as ->> does in SQL; otherwise the member is
+// extracted as JSON.
+type JSONPath struct {
+	Path  string
+	Steps []PathStep
+	Text  bool
+}
+
+// PathStep is an object member or, when IsIndex is set, an array element
+type PathStep struct {
+	Member  string
+	Index   int
+	IsIndex bool
+}
+
+// ParseJSONPath parses a path starting at the document root $
+func ParseJSONPath(path string, text bool) (*JSONPath, error) {
+	p := &JSONPath{Path: path, Text: text}
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("%w: json path %s must start with $", ErrInvalidQuery, path)
+	}
+	rest := path[1:]
+	for rest != "" {
+		var step PathStep
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			step.Member, rest = rest[1:end+1], rest[end+1:]
+			if step.Member == "" {
+				return nil, fmt.Errorf("%w: empty member in json path %s", ErrInvalidQuery, path)
+			}
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated [ in json path %s", ErrInvalidQuery, path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if member, err := strconv.Unquote(inner); err == nil && strings.HasPrefix(inner, `"`) {
+				step.Member = member
+				break
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("%w: invalid index %s in json path %s", ErrInvalidQuery, inner, path)
+			}
+			step.Index, step.IsIndex = index, true
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q in json path %s", ErrInvalidQuery, rest[0], path)
+		}
+		p.Steps = append(p.Steps, step)
+	}
+	return p, nil
+}
+
+// Extract returns the member of doc the path selects. ok is false,
+// which SQL reads as NULL, when doc is not JSON, the member does not
+// exist or a Text path selects a JSON null.
+func (p *JSONPath) Extract(doc []byte) ([]byte, bool) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	// numbers keep the digits they were written with
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return nil, false
+	}
+	for _, step := range p.Steps {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			member, ok := node[step.Member]
+			if !ok || step.IsIndex {
+				return nil, false
+			}
+			v = member
+		case []interface{}:
+			if !step.IsIndex || step.Index >= len(node) {
+				return nil, false
+			}
+			v = node[step.Index]
+		default:
+			return nil, false
+		}
+	}
+	switch s := v.(type) {
+	case nil:
+		if p.Text {
+			return nil, false
+		}
+	case string:
+		if p.Text {
+			return []byte(s), true
+		}
+	}
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, false
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), true
+}
+
+func (p *JSONPath) String() string {
+	if p.Text {
+		return "->>'" + p.Path + "'"
+	}
+	return "->'" + p.Path + "'"
+}
+
+// Projection is a column computed from a row: its key or its value,
+// or the member of either that Path selects
+type Projection struct {
+	// Column is key or value
+	Column string
+	Path   *JSONPath
+	// Joined reads the column from the row of a joined table
+	Joined bool
+}
+
+func (p Projection) String() string {
+	column := p.Column
+	if p.Joined {
+		column = "joined." + column
+	}
+	if p.Path == nil {
+		return column
+	}
+	return column + p.Path.String()
+}
+
+// Apply returns the column of a row, or nil for NULL
+func (p Projection) Apply(key, value []byte) []byte {
+	column := value
+	if p.Column == "key" {
+		column = key
+	}
+	if p.Path == nil {
+		return column
+	}
+	out, ok := p.Path.Extract(column)
+	if !ok {
+		return nil
+	}
+	return out
+}
+
+// Project returns the columns of a row: its key and value when
+// projections is empty
+func Project(projections []Projection, key, value []byte) [][]byte {
+	if len(projections) == 0 {
+		return [][]byte{key, value}
+	}
+	row := make([][]byte, len(projections))
+	for i, p := range projections {
+		row[i] = p.Apply(key, value)
+	}
+	return row
+}
+
+// ProjectJoin returns the columns of a joined row: joined is the value
+// of the matching row of the joined table, and its columns are NULL
+// when matched is false
+func ProjectJoin(projections []Projection, key, value, joined []byte, matched bool) [][]byte {
+	row := make([][]byte, len(projections))
+	for i, p := range projections {
+		switch {
+		case !p.Joined:
+			row[i] = p.Apply(key, value)
+		case matched:
+			row[i] = p.Apply(key, joined)
+		}
+	}
+	return row
+}
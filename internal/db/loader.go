@@ -0,0 +1,41 @@
+package db
+
+import (
+	"context"
+)
+
+// Loader reads a key missing from a table from the slower system
+// the table caches. It returns ErrKeyNotFound when the system does not
+// hold the key.
+type Loader interface {
+	Load(ctx context.Context, table, key []byte) ([]byte, error)
+}
+
+// LoaderFunc adapts a function to the Loader interface
+type LoaderFunc func(ctx context.Context, table, key []byte) ([]byte, error)
+
+func (f LoaderFunc) Load(ctx context.Context, table, key []byte) ([]byte, error) {
+	return f(ctx, table, key)
+}
+
+// Writer writes values set on a table to the slower system the table caches
+type Writer interface {
+	Write(ctx context.Context, table, key, value []byte) error
+}
+
+// WriterFunc adapts a function to the Writer interface
+type WriterFunc func(ctx context.Context, table, key, value []byte) error
+
+func (f WriterFunc) Write(ctx context.Context, table, key, value []byte) error {
+	return f(ctx, table, key, value)
+}
+
+type WriteMode int
+
+const (
+	// WriteThrough writes to the Writer before the table and fails
+	// the write if the Writer does
+	WriteThrough WriteMode = iota
+	// WriteBehind writes to the table and queues the write for the Writer
+	WriteBehind
+)
@@ -0,0 +1,15 @@
+package memtable
+
+// Nodes returns the number of nodes linked on the base level of the
+// list, deleted ones and markers included
+func (sk *SkipList) Nodes() int {
+	h := sk.top()
+	if h == nil {
+		return 0
+	}
+	n := 0
+	for b := h.Node().Next(); b != nil; b = b.Next() {
+		n++
+	}
+	return n
+}
@@ -1,6 +1,7 @@
 package memtable
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"strings"
@@ -13,12 +14,9 @@ import (
 //go:linkname RandUint32 runtime.fastrand
 func RandUint32() uint32
 
-func hash(key []byte) uint64 {
-	var h uint64
-	for _, b := range key {
-		h = uint64(b) + (h << 6) + (h << 16) - h
-	}
-	return h
+// cpr compares keys in byte-wise lexicographic order
+func cpr(a, b []byte) int {
+	return bytes.Compare(a, b)
 }
 
 type SkipList struct {
@@ -37,7 +35,7 @@ func (sk *SkipList) top() *index {
 	return (*index)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&sk.head))))
 }
 
-func (sk *SkipList) findPredecessor(key uint64) *node {
+func (sk *SkipList) findPredecessor(key []byte) *node {
 	q := sk.top()
 	for q != nil {
 		r := q.Right()
@@ -45,13 +43,14 @@ func (sk *SkipList) findPredecessor(key uint64) *node {
 		for r != nil {
 			p := r.Node()
 			switch {
-			case p == nil || p.hash == 0 || p.val == nil:
+			case p == nil || p.key == nil || p.deleted():
 				atomic.CompareAndSwapPointer(
 					(*unsafe.Pointer)(unsafe.Pointer(&q.right)),
 					unsafe.Pointer(r),
 					unsafe.Pointer(r.Right()),
 				)
-			case key > p.hash:
+				r = q.Right()
+			case cpr(key, p.key) > 0:
 				q = r
 				r = q.Right()
 			default:
@@ -67,30 +66,85 @@ func (sk *SkipList) findPredecessor(key uint64) *node {
 	return nil
 }
 
-func (sk *SkipList) findNode(key uint64) *node {
-	r := sk.findPredecessor(key)
-	for r != nil {
-		n := r.Next()
-		for n != nil {
+// findNode returns the node holding key, unlinking the deleted nodes
+// it passes, or nil when key is not in the list
+func (sk *SkipList) findNode(key []byte) *node {
+outer:
+	for {
+		b := sk.findPredecessor(key)
+		if b == nil {
+			return nil
+		}
+		for n := b.Next(); ; {
+			if n == nil {
+				return nil
+			}
+			f := n.Next()
 			switch {
-			case key > n.hash:
-				r = n
-				n = r.Next()
-			case key == n.hash:
+			case n != b.Next():
+				// b moved on under us
+				continue outer
+			case n.marker || b.deleted():
+				// b is being unlinked
+				continue outer
+			case n.deleted():
+				n.helpDelete(b, f)
+				continue outer
+			}
+			switch c := cpr(key, n.key); {
+			case c == 0:
 				return n
-			default:
+			case c < 0:
 				return nil
 			}
+			b, n = n, f
 		}
 	}
-	return nil
+}
+
+// put sets key on the base level of the list, searching from b, a node
+// before it. It returns the node it linked for a new key and false
+// when the list changed under it and the search must be retried.
+func put(b *node, key, value []byte) (*node, bool) {
+	for n := b.Next(); ; {
+		if n != nil {
+			f := n.Next()
+			switch {
+			case n != b.Next():
+				return nil, false
+			case n.marker || b.deleted():
+				return nil, false
+			case n.deleted():
+				// a deleted node is unlinked rather than revived
+				n.helpDelete(b, f)
+				return nil, false
+			}
+			c := cpr(key, n.key)
+			if c > 0 {
+				b, n = n, f
+				continue
+			}
+			if c == 0 {
+				v := n.loadValue()
+				if v == nil || !n.casValue(v, &value) {
+					return nil, false
+				}
+				return nil, true
+			}
+		}
+		z := newNode(key, value, n)
+		if !b.casNext(n, z) {
+			return nil, false
+		}
+		return z, true
+	}
 }
 
 func (sk *SkipList) addIndices(q *index, skips int, x *index) bool {
 	if x != nil && q != nil {
 		z := x.Node()
-		key := z.hash
-		if key == 0 {
+		key := z.key
+		if key == nil {
 			return false
 		}
 		var retrying bool
@@ -101,18 +155,18 @@ func (sk *SkipList) addIndices(q *index, skips int, x *index) bool {
 			if r != nil {
 				p := r.Node()
 				switch {
-				case p == nil || p.hash == 0 || p.val == nil:
+				case p == nil || p.key == nil || p.deleted():
 					atomic.CompareAndSwapPointer(
 						(*unsafe.Pointer)(unsafe.Pointer(&q.right)),
 						unsafe.Pointer(r),
 						unsafe.Pointer(r.Right()),
 					)
 					c = 0
-				case key > p.hash:
+				case cpr(key, p.key) > 0:
 					q = r
 					r = q.Right()
 					c = 1
-				case key == p.hash:
+				case cpr(key, p.key) == 0:
 					c = 0
 				default:
 				}
@@ -149,8 +203,7 @@ func (sk *SkipList) addIndices(q *index, skips int, x *index) bool {
 }
 
 func (sk *SkipList) Get(key []byte) ([]byte, bool) {
-	hashedValue := hash(key)
-	if hashedValue == 0 {
+	if key == nil {
 		return nil, false
 	}
 	q := sk.top()
@@ -160,17 +213,18 @@ func (sk *SkipList) Get(key []byte) ([]byte, bool) {
 		for r != nil {
 			p := r.Node()
 			switch {
-			case p == nil || p.hash == 0 || p.val == nil:
+			case p == nil || p.key == nil || p.deleted():
 				atomic.CompareAndSwapPointer(
 					(*unsafe.Pointer)(unsafe.Pointer(&q.right)),
 					unsafe.Pointer(r),
 					unsafe.Pointer(r.Right()),
 				)
-			case hashedValue > p.hash:
+				r = q.Right()
+			case cpr(key, p.key) > 0:
 				q = r
 				r = q.Right()
-			case hashedValue == p.hash:
-				return p.val, true
+			case cpr(key, p.key) == 0:
+				return p.Value(), true
 			default:
 				break loop
 			}
@@ -183,12 +237,12 @@ func (sk *SkipList) Get(key []byte) ([]byte, bool) {
 			if b != nil {
 				n := b.Next()
 				for n != nil {
-					if n.val == nil || n.hash == 0 || hashedValue > n.hash {
+					if n.deleted() || n.key == nil || cpr(key, n.key) > 0 {
 						b = n
 						n = b.Next()
 					} else {
-						if hashedValue == n.hash {
-							return n.val, true
+						if cpr(key, n.key) == 0 {
+							return n.Value(), true
 						}
 						break
 					}
@@ -205,12 +259,12 @@ func (sk *SkipList) Set(key, value []byte) error {
 		return errors.New("missing key")
 	}
 	var b *node
-	hashedKey := hash(key)
 	for {
 		levels := 0
 		h := sk.top()
 		if h == nil {
-			base := newNode(0, nil, nil, nil)
+			// the base header has a value so it never reads as deleted
+			base := newNode(nil, []byte{}, nil)
 			nh := newIndex(base, nil, nil)
 			if atomic.CompareAndSwapPointer(
 				(*unsafe.Pointer)(unsafe.Pointer(&sk.head)),
@@ -230,13 +284,14 @@ func (sk *SkipList) Set(key, value []byte) error {
 				for r != nil {
 					p := r.Node()
 					switch {
-					case p == nil || p.hash == 0 || p.val == nil:
+					case p == nil || p.key == nil || p.deleted():
 						atomic.CompareAndSwapPointer(
 							(*unsafe.Pointer)(unsafe.Pointer(&q.right)),
 							unsafe.Pointer(r),
 							unsafe.Pointer(r.Right()),
 						)
-					case hashedKey > p.hash:
+						r = q.Right()
+					case cpr(key, p.key) > 0:
 						q = r
 						r = q.Right()
 					default:
@@ -256,83 +311,67 @@ func (sk *SkipList) Set(key, value []byte) error {
 			}
 		}
 		if b != nil {
-			var z *node
-			var p *node
-			for {
-				c := -1
-				n := b.Next()
-				switch {
-				case n == nil:
-					c = -1
-				case n.hash == 0:
-					break
-				case n.val == nil:
-					// unlinkNode(b, n)
-					c = 1
-				case hashedKey > n.hash:
-					b = n
-					c = 1
-				case hashedKey == n.hash:
-					c = 0
-				default:
-				}
-				if c == 0 {
-					// already in list
-					return nil
-				}
-				if c < 0 {
-					if p == nil {
-						p = newNode(hashedKey, key, value, nil)
-					}
-					p.next = n
-					if atomic.CompareAndSwapPointer(
-						(*unsafe.Pointer)(unsafe.Pointer(&b.next)),
-						unsafe.Pointer(n),
-						unsafe.Pointer(p),
-					) {
-						z = p
+			z, ok := put(b, key, value)
+			if !ok {
+				continue
+			}
+			if z == nil {
+				// the value of a key already in the list was replaced
+				return nil
+			}
+			atomic.AddUint64(&sk.count, 1)
+			lr := uint64(RandUint32())
+			if (lr & 0x3) == 0 {
+				hr := uint64(RandUint32())
+				rnd := hr<<32 | lr&0xffffffff
+				skips := levels
+				var x *index
+				for {
+					skips -= 1
+					x = newIndex(z, x, nil)
+					if rnd <= 0 || skips < 0 {
 						break
+					} else {
+						rnd >>= 1
 					}
 				}
-			}
-			if z != nil {
-				lr := uint64(RandUint32())
-				if (lr & 0x3) == 0 {
-					hr := uint64(RandUint32())
-					rnd := hr<<32 | lr&0xffffffff
-					skips := levels
-					var x *index
-					for {
-						skips -= 1
-						x = newIndex(z, x, nil)
-						if rnd <= 0 || skips < 0 {
-							break
-						} else {
-							rnd >>= 1
-						}
-					}
-					if sk.addIndices(h, skips, x) && skips < 0 && sk.top() == h {
-						hx := newIndex(z, x, nil)
-						nh := newIndex(h.Node(), h, hx)
-						atomic.CompareAndSwapPointer(
-							(*unsafe.Pointer)(unsafe.Pointer(&sk.head)),
-							unsafe.Pointer(h),
-							unsafe.Pointer(nh),
-						)
-					}
-					if z.val == nil {
-						sk.findPredecessor(hashedKey)
-					}
+				if sk.addIndices(h, skips, x) && skips < 0 && sk.top() == h {
+					hx := newIndex(z, x, nil)
+					nh := newIndex(h.Node(), h, hx)
+					atomic.CompareAndSwapPointer(
+						(*unsafe.Pointer)(unsafe.Pointer(&sk.head)),
+						unsafe.Pointer(h),
+						unsafe.Pointer(nh),
+					)
+				}
+				if z.deleted() {
+					sk.findPredecessor(key)
 				}
-				atomic.AddUint64(&sk.count, 1)
-				return nil
 			}
+			return nil
 		}
 	}
 }
 
-func (sk *SkipList) Remove(_ uint64) ([]byte, bool) {
-	return nil, true
+// Remove removes the node holding key and returns its value. The node
+// is marked deleted and then unlinked, so its memory can be reclaimed.
+func (sk *SkipList) Remove(key []byte) ([]byte, bool) {
+	for {
+		n := sk.findNode(key)
+		if n == nil {
+			return nil, false
+		}
+		v := n.loadValue()
+		if v == nil || !n.casValue(v, nil) {
+			// removed or replaced under us
+			continue
+		}
+		atomic.AddUint64(&sk.count, ^uint64(0))
+		// unlink the node and the indices pointing at it
+		sk.findNode(key)
+		sk.findPredecessor(key)
+		return *v, true
+	}
 }
 
 func (sk *SkipList) Range(f func(k, v []byte) bool) {
@@ -344,8 +383,8 @@ func (sk *SkipList) Range(f func(k, v []byte) bool) {
 	if b != nil {
 		n := b.Next()
 		for n != nil {
-			if n.val != nil {
-				ok := f(n.key, n.val)
+			if !n.deleted() {
+				ok := f(n.key, n.Value())
 				if !ok {
 					break
 				}
@@ -356,67 +395,143 @@ func (sk *SkipList) Range(f func(k, v []byte) bool) {
 	}
 }
 
-type iter struct {
-	sk           *SkipList
-	lastReturned *node
-	nxt          *node
-	start        *uint64
-	end          *uint64
+// Iterator walks a SkipList in key order. It is safe to use while the
+// list is being written to and observes writes that land ahead of it.
+type Iterator struct {
+	sk   *SkipList
+	curr *node
 }
 
-func newIter(sk *SkipList, start, end []byte) *iter {
-	var s *uint64
-	if start != nil {
-		h := hash(start)
-		s = &h
+func (sk *SkipList) Iterator() *Iterator {
+	return &Iterator{sk: sk}
+}
+
+func (i *Iterator) Valid() bool {
+	return i.curr != nil
+}
+
+func (i *Iterator) Key() []byte {
+	if i.curr == nil {
+		return nil
 	}
-	var e *uint64
-	if end != nil {
-		h := hash(end)
-		e = &h
+	return i.curr.key
+}
+
+func (i *Iterator) Value() []byte {
+	return i.curr.Value()
+}
+
+func (i *Iterator) Err() error {
+	return nil
+}
+
+func (i *Iterator) Close() error {
+	i.curr = nil
+	return nil
+}
+
+// Seek moves the iterator to the first key greater than or equal to k
+func (i *Iterator) Seek(k []byte) bool {
+	b := i.sk.findPredecessor(k)
+	if b == nil {
+		i.curr = nil
+		return false
 	}
-	i := &iter{sk: sk, start: s, end: e}
+	n := b.Next()
+	for n != nil && (n.deleted() || cpr(n.key, k) < 0) {
+		n = n.Next()
+	}
+	i.curr = n
+	return i.Valid()
+}
+
+func (i *Iterator) SeekToFirst() bool {
 	h := i.sk.top()
-	if h != nil {
-		n := h.Node()
-		i.advance(n)
+	if h == nil {
+		i.curr = nil
+		return false
 	}
-	return i
+	i.curr = nextLive(h.Node())
+	return i.Valid()
 }
 
-func (i *iter) advance(b *node) {
-	var n *node
-	i.lastReturned = b
-	if i.lastReturned != nil {
-		for n = b.Next(); n != nil && n.val == nil; {
-			b = n
-			n = b.Next()
-		}
+func (i *Iterator) SeekToLast() bool {
+	i.curr = i.sk.findLast()
+	return i.Valid()
+}
+
+func (i *Iterator) Next() bool {
+	i.curr = nextLive(i.curr)
+	return i.Valid()
+}
+
+// Prev moves the iterator to the largest key less than the current key
+func (i *Iterator) Prev() bool {
+	if i.curr == nil {
+		return false
 	}
-	if i.start != nil && n != nil && *i.start > n.hash {
-		n = i.sk.findNode(*i.start)
+	i.curr = i.sk.findLower(i.curr.key)
+	return i.Valid()
+}
+
+func nextLive(b *node) *node {
+	n := b.Next()
+	for n != nil && n.deleted() {
+		n = n.Next()
 	}
-	i.nxt = n
+	return n
 }
 
-func (i *iter) hasNext() bool {
-	if i.end == nil {
-		return i.nxt != nil
+func (sk *SkipList) findLower(key []byte) *node {
+	b := sk.findPredecessor(key)
+	if b == nil {
+		return nil
+	}
+	var last *node
+	if b.key != nil && !b.deleted() {
+		last = b
 	}
-	return i.nxt != nil && i.nxt.hash <= *i.end
+	for n := b.Next(); n != nil && cpr(n.key, key) < 0; n = n.Next() {
+		if !n.deleted() {
+			last = n
+		}
+	}
+	return last
 }
 
-func (i *iter) next() *node {
-	n := i.nxt
-	i.advance(n)
-	return n
+func (sk *SkipList) findLast() *node {
+	q := sk.top()
+	for q != nil {
+		for r := q.Right(); r != nil; r = q.Right() {
+			q = r
+		}
+		if d := q.Down(); d != nil {
+			q = d
+			continue
+		}
+		var last *node
+		for n := q.Node(); n != nil; n = n.Next() {
+			if n.key != nil && !n.deleted() {
+				last = n
+			}
+		}
+		return last
+	}
+	return nil
 }
 
 func (sk *SkipList) Scan(start, end []byte, f func(k, v []byte) bool) {
-	itr := newIter(sk, start, end)
-	for itr.hasNext() {
-		n := itr.next()
-		if ok := f(n.key, n.val); !ok {
+	itr := sk.Iterator()
+	if start != nil {
+		itr.Seek(start)
+	} else {
+		itr.SeekToFirst()
+	}
+	for ; itr.Valid(); itr.Next() {
+		if end != nil && cpr(itr.Key(), end) > 0 {
+			return
+		}
+		if ok := f(itr.Key(), itr.Value()); !ok {
 			return
 		}
 	}
@@ -431,7 +546,7 @@ func (sk *SkipList) Print() {
 		r := curr.Right()
 		for r != nil {
 			n := r.Node()
-			out.WriteString(fmt.Sprintf("[%d - %s->]\t", n.hash, n.key))
+			out.WriteString(fmt.Sprintf("[%s->]\t", n.key))
 			curr = r
 			r = curr.Right()
 		}
@@ -445,8 +560,8 @@ func (sk *SkipList) Print() {
 			for curr != nil {
 				n := curr.Node()
 				for n != nil {
-					if n.hash == curr.Node().hash {
-						out.WriteString(fmt.Sprintf("[%d-%s->] ", n.hash, n.key))
+					if bytes.Equal(n.key, curr.Node().key) {
+						out.WriteString(fmt.Sprintf("[%s->] ", n.key))
 					} else {
 						out.WriteString(fmt.Sprintf("%s-> ", n.key))
 					}
@@ -463,6 +578,20 @@ func (sk *SkipList) Print() {
 	fmt.Println(out.String())
 }
 
+// Levels returns the number of index nodes on each level of the
+// list from the top level down; the base level holds every node
+func (sk *SkipList) Levels() []int {
+	levels := make([]int, 0)
+	for q := sk.top(); q != nil; q = q.Down() {
+		n := 0
+		for r := q.Right(); r != nil; r = r.Right() {
+			n++
+		}
+		levels = append(levels, n)
+	}
+	return levels
+}
+
 func (sk *SkipList) Count() uint64 {
 	return atomic.LoadUint64(&sk.count)
 }
@@ -150,6 +150,42 @@ func TestScan(t *testing.T) {
 	})
 }
 
+func TestIterator(t *testing.T) {
+	expected := [][]byte{[]byte("aaaa"), []byte("bb"), []byte("bbbb"), []byte("c"), []byte("dddd")}
+	testMap(t, "iterator", test{
+		setup: func(t *testing.T, m *gskl.SkipList) {
+			for i := len(expected) - 1; i >= 0; i-- {
+				if err := m.Set(expected[i], expected[i]); err != nil {
+					t.Fail()
+				}
+			}
+		},
+		run: func(t *testing.T, m *gskl.SkipList) {
+			actual := make([][]byte, 0)
+			itr := m.Iterator()
+			for ok := itr.SeekToFirst(); ok; ok = itr.Next() {
+				actual = append(actual, itr.Key())
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("w %v g %v", expected, actual)
+			}
+			actual = make([][]byte, 0)
+			for ok := itr.SeekToLast(); ok; ok = itr.Prev() {
+				actual = append([][]byte{itr.Key()}, actual...)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("w %v g %v", expected, actual)
+			}
+			if !itr.Seek([]byte("bbb")) || !reflect.DeepEqual(itr.Key(), expected[2]) {
+				t.Errorf("w %s g %s", expected[2], itr.Key())
+			}
+			if itr.Seek([]byte("e")) {
+				t.Errorf("unexpected key %s", itr.Key())
+			}
+		},
+	})
+}
+
 type bench struct {
 	setup    func(*testing.B, *gskl.SkipList)
 	perG     func(b *testing.B, pb *testing.PB, i int, m *gskl.SkipList)
@@ -334,3 +370,80 @@ func BenchmarkSkiplist_Range(b *testing.B) {
 		},
 	})
 }
+
+func TestRemove(t *testing.T) {
+	keys := 1000
+	testMap(t, "remove unlinks nodes", test{
+		run: func(t *testing.T, m *gskl.SkipList) {
+			var wg sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					// neighbouring keys are set and removed concurrently
+					for i := w; i < keys; i += 4 {
+						k := []byte(fmt.Sprintf("key-%04d", i))
+						for round := 0; round < 3; round++ {
+							if err := m.Set(k, []byte(strconv.Itoa(round))); err != nil {
+								t.Error(err)
+							}
+							if _, ok := m.Remove(k); !ok {
+								t.Errorf("expected %s to be removed", k)
+							}
+						}
+						if i%2 == 0 {
+							if err := m.Set(k, []byte("kept")); err != nil {
+								t.Error(err)
+							}
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+			if count, nodes := m.Count(), m.Nodes(); count != uint64(keys/2) || nodes != keys/2 {
+				t.Errorf("w %d keys and nodes g %d keys %d nodes", keys/2, count, nodes)
+			}
+			for i := 0; i < keys; i++ {
+				value, ok := m.Get([]byte(fmt.Sprintf("key-%04d", i)))
+				if ok != (i%2 == 0) || (ok && string(value) != "kept") {
+					t.Errorf("key-%04d: w %t g %s %t", i, i%2 == 0, value, ok)
+				}
+			}
+			for i := 0; i < keys; i += 2 {
+				m.Remove([]byte(fmt.Sprintf("key-%04d", i)))
+			}
+			if nodes := m.Nodes(); nodes != 0 {
+				t.Errorf("expected every removed node to be unlinked g %d", nodes)
+			}
+			for level, n := range m.Levels() {
+				if n != 0 {
+					t.Errorf("expected the indices of removed nodes to be unlinked g %d on level %d", n, level)
+				}
+			}
+		},
+	})
+}
+
+func TestMemTable_Bytes(t *testing.T) {
+	m := gskl.New()
+	for i := 0; i < 10; i++ {
+		if err := m.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written := m.Bytes()
+
+	// when
+	m.Delete([]byte("key-0"))
+	m.Remove([]byte("key-1"))
+	m.RemoveRange([]byte("key-2"), []byte("key-5"))
+	m.Remove([]byte("missing"))
+
+	// then
+	if written != 100 || m.Bytes() != 40 {
+		t.Errorf("w 100 bytes written and 40 left g %d and %d", written, m.Bytes())
+	}
+	if m.Count() != 4 {
+		t.Errorf("w 4 g %d", m.Count())
+	}
+}
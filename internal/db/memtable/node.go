@@ -6,23 +6,66 @@ import (
 )
 
 type node struct {
-	hash uint64
 	next *node
 	key  []byte
-	val  []byte
+	val  *[]byte
+	// marker nodes follow a deleted node while it is unlinked, so no
+	// node can be inserted after it in the meantime; see helpDelete
+	marker bool
 }
 
-func newNode(h uint64, k, v []byte, next *node) *node {
-	return &node{
-		hash: h,
+func newNode(k, v []byte, next *node) *node {
+	n := &node{
 		next: next,
 		key:  k,
-		val:  v,
 	}
+	if v != nil {
+		n.val = &v
+	}
+	return n
+}
+
+// newMarker returns a marker to append to a deleted node whose next is f
+func newMarker(f *node) *node {
+	return &node{next: f, marker: true}
 }
 
 func freeNode(n *node) {}
 
+func (n *node) casNext(old, next *node) bool {
+	return atomic.CompareAndSwapPointer(
+		(*unsafe.Pointer)(unsafe.Pointer(&n.next)),
+		unsafe.Pointer(old),
+		unsafe.Pointer(next),
+	)
+}
+
+func (n *node) loadValue() *[]byte {
+	return (*[]byte)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&n.val))))
+}
+
+func (n *node) casValue(old, v *[]byte) bool {
+	return atomic.CompareAndSwapPointer(
+		(*unsafe.Pointer)(unsafe.Pointer(&n.val)),
+		unsafe.Pointer(old),
+		unsafe.Pointer(v),
+	)
+}
+
+// helpDelete unlinks n, a deleted node between b and f. A marker is
+// appended to n first, then b is pointed past both; either step may
+// already have been taken by another goroutine.
+func (n *node) helpDelete(b, f *node) {
+	if f != n.Next() || n != b.Next() {
+		return
+	}
+	if f == nil || !f.marker {
+		n.casNext(f, newMarker(f))
+	} else {
+		b.casNext(n, f.Next())
+	}
+}
+
 func (n *node) Next() *node {
 	if n == nil {
 		return nil
@@ -30,6 +73,24 @@ func (n *node) Next() *node {
 	return (*node)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&n.next))))
 }
 
+func (n *node) Value() []byte {
+	if n == nil {
+		return nil
+	}
+	v := n.loadValue()
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// deleted reports whether the node's value was removed, or the node
+// is a marker; the value is swapped while readers walk the list, so
+// it is loaded atomically
+func (n *node) deleted() bool {
+	return n.loadValue() == nil
+}
+
 type index struct {
 	node  *node
 	down  *index
@@ -1,7 +1,9 @@
 package memtable
 
 import (
+	"bytes"
 	"errors"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
@@ -10,14 +12,38 @@ import (
 
 var ErrAllowedBytesExceeded = errors.New("memtable allowed bytes exceeded")
 
+// defaultAllowedBytes is how many key and value bytes the read buffer
+// holds before Set asks for a flush
+const defaultAllowedBytes = 4096 * 4096
+
 type MemTable struct {
 	readBuffer *SkipList
 	bytes      uint64
+	allowed    uint64
+	// mtx guards tombstones; Set holds it shared so a range delete
+	// cannot remove a key written after its tombstone was recorded
+	mtx        sync.RWMutex
+	tombstones []tombstone
+	// deleted holds the keys deleted one at a time since the last flush
+	deleted map[string]struct{}
+}
+
+// tombstone deletes every key between start and end inclusive from
+// the tables older than the memtable; a nil bound is unbounded
+type tombstone struct {
+	start []byte
+	end   []byte
+}
+
+func (t tombstone) covers(k []byte) bool {
+	return (t.start == nil || bytes.Compare(k, t.start) >= 0) &&
+		(t.end == nil || bytes.Compare(k, t.end) <= 0)
 }
 
 func New() *MemTable {
 	return &MemTable{
 		readBuffer: NewSkipList(),
+		allowed:    defaultAllowedBytes,
 	}
 }
 
@@ -36,26 +62,172 @@ func (m *MemTable) Count() uint64 {
 }
 
 func (m *MemTable) Set(k, v []byte) error {
+	m.mtx.RLock()
 	err := m.buffer().Set(k, v)
+	m.mtx.RUnlock()
 	if err != nil {
 		return err
 	}
 	byts := atomic.AddUint64(&m.bytes, uint64(len(k)+len(v)))
-	if byts >= 4096*4096 {
+	if byts >= atomic.LoadUint64(&m.allowed) {
 		return ErrAllowedBytesExceeded
 	}
 	return nil
 }
 
+// Bytes returns the number of key and value bytes written to the read
+// buffer, less those of the keys removed from it
+func (m *MemTable) Bytes() uint64 {
+	return atomic.LoadUint64(&m.bytes)
+}
+
+// remove removes k from the read buffer and stops counting its bytes
+func (m *MemTable) remove(reader *SkipList, k []byte) {
+	v, ok := reader.Remove(k)
+	if !ok {
+		return
+	}
+	n := uint64(len(k) + len(v))
+	for {
+		byts := atomic.LoadUint64(&m.bytes)
+		if byts < n {
+			// the key was counted before a flush reset the count
+			n = byts
+		}
+		if atomic.CompareAndSwapUint64(&m.bytes, byts, byts-n) {
+			return
+		}
+	}
+}
+
+// AllowedBytes returns how many bytes the read buffer holds before a flush
+func (m *MemTable) AllowedBytes() uint64 {
+	return atomic.LoadUint64(&m.allowed)
+}
+
+// SetAllowedBytes changes how many bytes the read buffer holds before
+// a flush; zero restores the default
+func (m *MemTable) SetAllowedBytes(n uint64) {
+	if n == 0 {
+		n = defaultAllowedBytes
+	}
+	atomic.StoreUint64(&m.allowed, n)
+}
+
+// Levels returns the number of index nodes on each level of the read buffer
+func (m *MemTable) Levels() []int {
+	return m.buffer().Levels()
+}
+
+// Tombstones returns the number of range tombstones waiting to be flushed
+func (m *MemTable) Tombstones() int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return len(m.tombstones)
+}
+
+// RemoveRange removes every key between start and end inclusive
+// from the read buffer; keys set while it runs are kept
+func (m *MemTable) RemoveRange(start, end []byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.removeRange(start, end)
+}
+
+func (m *MemTable) removeRange(start, end []byte) {
+	reader := m.buffer()
+	itr := reader.Iterator()
+	if start != nil {
+		itr.Seek(start)
+	} else {
+		itr.SeekToFirst()
+	}
+	for ; itr.Valid(); itr.Next() {
+		k := itr.Key()
+		if end != nil && bytes.Compare(k, end) > 0 {
+			return
+		}
+		m.remove(reader, k)
+	}
+}
+
+// DeleteRange records a range tombstone hiding every key between start
+// and end inclusive in older tables and removes the keys it covers from
+// the read buffer. Sets wait for both steps, so a key written during a
+// range delete is written after it. The tombstone is applied to the
+// sstable on Flush.
+func (m *MemTable) DeleteRange(start, end []byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.tombstones = append(m.tombstones, tombstone{start: start, end: end})
+	m.removeRange(start, end)
+}
+
+// Remove removes k from the read buffer
+func (m *MemTable) Remove(k []byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.remove(m.buffer(), k)
+}
+
+// Delete records a tombstone hiding k in older tables and removes it
+// from the read buffer. The tombstone is applied to the sstable on Flush.
+func (m *MemTable) Delete(k []byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.deleted == nil {
+		m.deleted = make(map[string]struct{})
+	}
+	m.deleted[string(k)] = struct{}{}
+	m.remove(m.buffer(), k)
+}
+
+// Deleted returns true if a pending tombstone covers k
+func (m *MemTable) Deleted(k []byte) bool {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	if _, ok := m.deleted[string(k)]; ok {
+		return true
+	}
+	for _, t := range m.tombstones {
+		if t.covers(k) {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *MemTable) Scan(k, v []byte, f func(k, v []byte) bool) {
 	m.buffer().Scan(k, v, f)
 }
 
+// Iterator returns an iterator over the current read buffer
+func (m *MemTable) Iterator() *Iterator {
+	return m.buffer().Iterator()
+}
+
 func (m *MemTable) Range(f func(k, v []byte) bool) {
 	m.buffer().Range(f)
 }
 
 func (m *MemTable) Flush(sstable *gstable.SSTable) error {
+	// compact the sstable before the tombstones stop hiding its keys
+	m.mtx.Lock()
+	for _, t := range m.tombstones {
+		if err := sstable.DeleteRange(t.start, t.end); err != nil {
+			m.mtx.Unlock()
+			return err
+		}
+	}
+	for k := range m.deleted {
+		if err := sstable.DeleteRange([]byte(k), []byte(k)); err != nil {
+			m.mtx.Unlock()
+			return err
+		}
+	}
+	m.tombstones = nil
+	m.deleted = nil
+	m.mtx.Unlock()
 	reader := m.buffer()
 	nReader := NewSkipList()
 	for {
@@ -0,0 +1,259 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrMergeOperatorNotSet = errors.New("merge operator not set")
+	ErrInvalidOperand      = errors.New("invalid merge operand")
+)
+
+// MergeOperator folds a list of operands into an existing value. existing
+// is nil when the key has no value yet. Operands are passed in the order
+// they were recorded.
+type MergeOperator interface {
+	Name() string
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// Int64Add treats values and operands as base 10 integers and sums them
+type Int64Add struct{}
+
+func (Int64Add) Name() string { return "int64add" }
+
+func (Int64Add) FullMerge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	sum, err := parseInt64(existing)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range operands {
+		i, err := parseInt64(op)
+		if err != nil {
+			return nil, err
+		}
+		sum += i
+	}
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+// Append concatenates each operand onto the existing value
+type Append struct{}
+
+func (Append) Name() string { return "append" }
+
+func (Append) FullMerge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(existing)
+	for _, op := range operands {
+		buf.Write(op)
+	}
+	return buf.Bytes(), nil
+}
+
+// Max keeps the largest base 10 integer seen
+type Max struct{}
+
+func (Max) Name() string { return "max" }
+
+func (Max) FullMerge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	max, err := parseInt64(existing)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range operands {
+		v, err := parseInt64(op)
+		if err != nil {
+			return nil, err
+		}
+		if (existing == nil && i == 0) || v > max {
+			max = v
+		}
+	}
+	return []byte(strconv.FormatInt(max, 10)), nil
+}
+
+func parseInt64(v []byte) (int64, error) {
+	if len(v) == 0 {
+		return 0, nil
+	}
+	i, err := strconv.ParseInt(string(bytes.TrimSpace(v)), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidOperand
+	}
+	return i, nil
+}
+
+var mergeOperators = map[string]MergeOperator{
+	Int64Add{}.Name(): Int64Add{},
+	Append{}.Name():   Append{},
+	Max{}.Name():      Max{},
+}
+
+// LookupMergeOperator returns the built-in merge operator registered under name
+func LookupMergeOperator(name string) (MergeOperator, bool) {
+	op, ok := mergeOperators[name]
+	return op, ok
+}
+
+// mergeLog records merge operands that have not been folded into
+// the table yet. Operands are folded lazily on read and before flushing.
+type mergeLog struct {
+	mtx      sync.RWMutex
+	op       MergeOperator
+	operands map[string][][]byte
+	// pending is the number of keys in operands, read without the
+	// lock so reads skip it while nothing is pending
+	pending int32
+}
+
+func newMergeLog(op MergeOperator) *mergeLog {
+	return &mergeLog{
+		op:       op,
+		operands: make(map[string][][]byte),
+	}
+}
+
+// maxPendingOperands bounds how many operands a single key collects
+// before they are folded back into the table
+const maxPendingOperands = 64
+
+// add records operand for k and returns the value k has with it
+// applied. Operands are folded and handed to set once a key collects
+// maxPendingOperands of them, or at once when k has no value yet so
+// that iterators see it. An operand the operator rejects is not
+// recorded.
+func (m *mergeLog) add(
+	k, operand []byte,
+	lookup func(k []byte) ([]byte, bool),
+	set func(k, v []byte) error,
+) ([]byte, error) {
+	if m.op == nil {
+		return nil, ErrMergeOperatorNotSet
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	key := string(k)
+	operands := append(m.operands[key], operand)
+	value, found := lookup(k)
+	folded, err := m.op.FullMerge(k, value, operands)
+	if err != nil {
+		return nil, err
+	}
+	if found && len(operands) < maxPendingOperands {
+		m.operands[key] = operands
+		m.count()
+		return folded, nil
+	}
+	delete(m.operands, key)
+	m.count()
+	return folded, set(k, folded)
+}
+
+// count updates pending; the caller holds the lock
+func (m *mergeLog) count() {
+	atomic.StoreInt32(&m.pending, int32(len(m.operands)))
+}
+
+// idle reports whether no key has pending operands, in which case a
+// read needs neither the lock nor a fold
+func (m *mergeLog) idle() bool {
+	return m.op == nil || atomic.LoadInt32(&m.pending) == 0
+}
+
+// discard drops pending operands for k; called when k is overwritten
+func (m *mergeLog) discard(k []byte) {
+	if m.idle() {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.operands, string(k))
+	m.count()
+}
+
+// discardRange drops pending operands for keys between start and end
+// inclusive; called when the range is deleted
+func (m *mergeLog) discardRange(start, end []byte) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for key := range m.operands {
+		k := []byte(key)
+		if (start == nil || bytes.Compare(k, start) >= 0) &&
+			(end == nil || bytes.Compare(k, end) <= 0) {
+			delete(m.operands, key)
+		}
+	}
+	m.count()
+}
+
+// size returns the number of keys with pending operands
+func (m *mergeLog) size() int {
+	return int(atomic.LoadInt32(&m.pending))
+}
+
+// get folds any pending operands for k into the value returned by
+// lookup. While operands are pending the read lock is held across the
+// lookup so a concurrent add cannot fold them into the table in between.
+func (m *mergeLog) get(k []byte, lookup func(k []byte) ([]byte, bool)) ([]byte, bool) {
+	if m.idle() {
+		return lookup(k)
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	value, ok := lookup(k)
+	operands, pending := m.operands[string(k)]
+	if !pending {
+		return value, ok
+	}
+	folded, err := m.op.FullMerge(k, value, operands)
+	if err != nil {
+		return value, ok
+	}
+	return folded, true
+}
+
+// value folds any pending operands for k into v, a value that was
+// already read from the table. A key with pending operands is read
+// again through lookup under the lock, since v may predate a fold.
+func (m *mergeLog) value(k, v []byte, lookup func(k []byte) ([]byte, bool)) []byte {
+	if m.idle() {
+		return v
+	}
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	operands, pending := m.operands[string(k)]
+	if !pending {
+		return v
+	}
+	value, _ := lookup(k)
+	folded, err := m.op.FullMerge(k, value, operands)
+	if err != nil {
+		return value
+	}
+	return folded
+}
+
+// fold folds every pending operand and hands the result to set
+func (m *mergeLog) fold(lookup func(k []byte) ([]byte, bool), set func(k, v []byte) error) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for key, operands := range m.operands {
+		k := []byte(key)
+		value, _ := lookup(k)
+		folded, err := m.op.FullMerge(k, value, operands)
+		if err != nil {
+			return err
+		}
+		if err = set(k, folded); err != nil {
+			return err
+		}
+		delete(m.operands, key)
+		m.count()
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package db
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minMaxBytes keeps a table from flushing on nearly every write
+const minMaxBytes = 64 * 1024
+
+// DefaultTableOpts returns the options of a table created without any:
+// an in-memory table without a WAL that adds int64 merge operands
+func DefaultTableOpts(name []byte) *TableOpts {
+	return &TableOpts{
+		TableName:     name,
+		DataDir:       []byte("testdata"),
+		InMemory:      true,
+		WalMode:       false,
+		MergeOperator: Int64Add{},
+	}
+}
+
+// SetOption parses value and sets the option called name. Options are
+// named as they are in SQL: in_memory, wal, sync, data_dir, ttl,
+// max_bytes and merge_operator.
+func (o *TableOpts) SetOption(name, value string) error {
+	var err error
+	switch name {
+	case "in_memory":
+		o.InMemory, err = strconv.ParseBool(value)
+	case "wal":
+		o.WalMode, err = strconv.ParseBool(value)
+	case "sync":
+		o.SyncWAL, err = parseSync(value)
+	case "data_dir":
+		o.DataDir = []byte(value)
+	case "ttl":
+		o.TTL, err = time.ParseDuration(value)
+	case "max_bytes":
+		o.MaxBytes, err = parseBytes(value)
+	case "merge_operator":
+		op, ok := LookupMergeOperator(value)
+		if !ok {
+			return fmt.Errorf("%w: unknown merge operator %s", ErrInvalidQuery, value)
+		}
+		o.MergeOperator = op
+	default:
+		return fmt.Errorf("%w: unknown table option %s", ErrInvalidQuery, name)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidQuery, name, err)
+	}
+	return nil
+}
+
+// Validate reports options that cannot be used together
+func (o *TableOpts) Validate() error {
+	switch {
+	case len(o.TableName) == 0:
+		return fmt.Errorf("%w: missing table name", ErrInvalidQuery)
+	case o.InMemory && o.WalMode:
+		return fmt.Errorf("%w: wal requires in_memory = false", ErrInvalidQuery)
+	case o.SyncWAL && !o.WalMode:
+		return fmt.Errorf("%w: sync = always requires wal = true", ErrInvalidQuery)
+	case !o.InMemory && len(o.DataDir) == 0:
+		return fmt.Errorf("%w: data_dir is required when in_memory = false", ErrInvalidQuery)
+	case o.TTL < 0:
+		return fmt.Errorf("%w: ttl must not be negative", ErrInvalidQuery)
+	case o.MaxBytes != 0 && o.MaxBytes < minMaxBytes:
+		return fmt.Errorf("%w: max_bytes must be at least %d", ErrInvalidQuery, minMaxBytes)
+	}
+	return nil
+}
+
+// onlineOptions are the options Alter can change while the table is open
+var onlineOptions = map[string]bool{
+	"ttl":       true,
+	"max_bytes": true,
+}
+
+// Alter returns a copy of o with changes applied. Only ttl and max_bytes
+// can change once a table is created.
+func (o *TableOpts) Alter(changes []KeyValue) (*TableOpts, error) {
+	altered := *o
+	for _, kv := range changes {
+		name := string(kv.Key)
+		if !onlineOptions[name] {
+			return nil, fmt.Errorf("%w: %s cannot be altered", ErrInvalidQuery, name)
+		}
+		if err := altered.SetOption(name, string(kv.Value)); err != nil {
+			return nil, err
+		}
+	}
+	if err := altered.Validate(); err != nil {
+		return nil, err
+	}
+	return &altered, nil
+}
+
+// parseSync parses when the WAL is synced: always or never
+func parseSync(value string) (bool, error) {
+	switch value {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	default:
+		return false, fmt.Errorf("expected always or never, got %s", value)
+	}
+}
+
+func syncName(always bool) string {
+	if always {
+		return "always"
+	}
+	return "never"
+}
+
+// parseBytes parses sizes such as 4096, 64KB or 256MB
+func parseBytes(value string) (uint64, error) {
+	units := []struct {
+		suffix string
+		size   uint64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	value = strings.ToUpper(strings.TrimSpace(value))
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			n, err := strconv.ParseUint(strings.TrimSuffix(value, unit.suffix), 10, 64)
+			return n * unit.size, err
+		}
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// storedOpts is how a file backed table's options are written to its data dir
+type storedOpts struct {
+	WalMode       bool   `json:"wal"`
+	SyncWAL       bool   `json:"sync,omitempty"`
+	TTL           string `json:"ttl"`
+	MaxBytes      uint64 `json:"max_bytes"`
+	MergeOperator string `json:"merge_operator,omitempty"`
+}
+
+func optsPath(dir, name string) string {
+	return path.Join(dir, fmt.Sprintf("%s-opts.json", name))
+}
+
+func saveTableOpts(o *TableOpts) error {
+	b, err := json.Marshal(newStoredOpts(o))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(optsPath(string(o.DataDir), string(o.TableName)), b, 0644)
+}
+
+// LoadTableOpts reads the options persisted for a file backed table
+// in dir. It returns an error wrapping os.ErrNotExist when the table
+// has not been created there.
+func LoadTableOpts(dir, name []byte) (*TableOpts, error) {
+	b, err := os.ReadFile(optsPath(string(dir), string(name)))
+	if err != nil {
+		return nil, err
+	}
+	var stored storedOpts
+	if err = json.Unmarshal(b, &stored); err != nil {
+		return nil, err
+	}
+	opts := &TableOpts{
+		TableName: name,
+		DataDir:   dir,
+	}
+	if err = stored.apply(opts); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func newStoredOpts(o *TableOpts) storedOpts {
+	stored := storedOpts{
+		WalMode:  o.WalMode,
+		SyncWAL:  o.SyncWAL,
+		TTL:      o.TTL.String(),
+		MaxBytes: o.MaxBytes,
+	}
+	if o.MergeOperator != nil {
+		stored.MergeOperator = o.MergeOperator.Name()
+	}
+	return stored
+}
+
+// apply sets the stored options on o
+func (s storedOpts) apply(o *TableOpts) error {
+	var err error
+	o.WalMode = s.WalMode
+	o.SyncWAL = s.SyncWAL
+	o.MaxBytes = s.MaxBytes
+	if o.TTL, err = time.ParseDuration(s.TTL); err != nil {
+		return err
+	}
+	o.MergeOperator = nil
+	if s.MergeOperator != "" {
+		op, ok := LookupMergeOperator(s.MergeOperator)
+		if !ok {
+			return errors.New("unknown merge operator " + s.MergeOperator)
+		}
+		o.MergeOperator = op
+	}
+	return nil
+}
+
+// wireOpts is how options are encoded when a query is sent to a
+// remote server. A Loader or Writer cannot be sent.
+type wireOpts struct {
+	TableName []byte
+	DataDir   []byte
+	InMemory  bool
+	Stored    storedOpts
+}
+
+func (o *TableOpts) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(wireOpts{
+		TableName: o.TableName,
+		DataDir:   o.DataDir,
+		InMemory:  o.InMemory,
+		Stored:    newStoredOpts(o),
+	})
+	return buf.Bytes(), err
+}
+
+func (o *TableOpts) GobDecode(b []byte) error {
+	var wire wireOpts
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&wire); err != nil {
+		return err
+	}
+	*o = TableOpts{
+		TableName: wire.TableName,
+		DataDir:   wire.DataDir,
+		InMemory:  wire.InMemory,
+	}
+	return wire.Stored.apply(o)
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PredicateOp is the test a Predicate applies
+type PredicateOp int
+
+const (
+	Equal PredicateOp = iota
+	NotEqual
+	Less
+	LessOrEqual
+	Greater
+	GreaterOrEqual
+	Like
+	And
+	Or
+	Not
+)
+
+func (op PredicateOp) String() string {
+	switch op {
+	case Equal:
+		return "="
+	case NotEqual:
+		return "<>"
+	case Less:
+		return "<"
+	case LessOrEqual:
+		return "<="
+	case Greater:
+		return ">"
+	case GreaterOrEqual:
+		return ">="
+	case Like:
+		return "like"
+	case And:
+		return "and"
+	case Or:
+		return "or"
+	case Not:
+		return "not"
+	default:
+		return "unknown"
+	}
+}
+
+// Predicate is a condition on the value of a row. Comparisons test the
+// value, or the member of it Path selects, against Operand; And, Or
+// and Not combine the predicates in Args. Ordering comparisons are
+// numeric when Operand is a number, and a value that is not a number
+// never matches them. Like matches Operand as a pattern where % is any
+// run of bytes and _ is one byte. A nil Predicate matches every value.
+//
+// A Path that selects nothing is NULL and comparisons with it are
+// unknown. As in SQL, not unknown is unknown and only rows for which
+// the predicate is true match.
+type Predicate struct {
+	Op      PredicateOp
+	Operand []byte
+	Path    *JSONPath
+	Args    []*Predicate
+}
+
+// truth is the value of a predicate in SQL's three valued logic
+type truth int
+
+const (
+	isFalse truth = iota
+	isTrue
+	isUnknown
+)
+
+func truthOf(b bool) truth {
+	if b {
+		return isTrue
+	}
+	return isFalse
+}
+
+// NewComparison returns a predicate comparing values with operand
+func NewComparison(op PredicateOp, operand []byte) *Predicate {
+	return &Predicate{Op: op, Operand: operand}
+}
+
+// NewLogical returns a predicate combining args with And, Or or Not
+func NewLogical(op PredicateOp, args ...*Predicate) *Predicate {
+	return &Predicate{Op: op, Args: args}
+}
+
+func (p *Predicate) Match(value []byte) bool {
+	return p == nil || p.eval(value) == isTrue
+}
+
+func (p *Predicate) eval(value []byte) truth {
+	switch p.Op {
+	case And:
+		out := isTrue
+		for _, arg := range p.Args {
+			switch arg.eval(value) {
+			case isFalse:
+				return isFalse
+			case isUnknown:
+				out = isUnknown
+			}
+		}
+		return out
+	case Or:
+		out := isFalse
+		for _, arg := range p.Args {
+			switch arg.eval(value) {
+			case isTrue:
+				return isTrue
+			case isUnknown:
+				out = isUnknown
+			}
+		}
+		return out
+	case Not:
+		switch t := p.Args[0].eval(value); t {
+		case isUnknown:
+			return t
+		default:
+			return truthOf(t == isFalse)
+		}
+	}
+	if p.Path != nil {
+		member, ok := p.Path.Extract(value)
+		if !ok {
+			return isUnknown
+		}
+		value = member
+	}
+	switch p.Op {
+	case Equal:
+		return truthOf(bytes.Equal(value, p.Operand))
+	case NotEqual:
+		return truthOf(!bytes.Equal(value, p.Operand))
+	case Less, LessOrEqual, Greater, GreaterOrEqual:
+		c, ok := compareValue(value, p.Operand)
+		if !ok {
+			return isFalse
+		}
+		switch p.Op {
+		case Less:
+			return truthOf(c < 0)
+		case LessOrEqual:
+			return truthOf(c <= 0)
+		case Greater:
+			return truthOf(c > 0)
+		default:
+			return truthOf(c >= 0)
+		}
+	case Like:
+		return truthOf(matchLike(value, p.Operand))
+	default:
+		return isFalse
+	}
+}
+
+func (p *Predicate) String() string {
+	switch p.Op {
+	case And, Or:
+		args := make([]string, len(p.Args))
+		for i, arg := range p.Args {
+			args[i] = arg.String()
+		}
+		return "(" + strings.Join(args, " "+p.Op.String()+" ") + ")"
+	case Not:
+		return "not " + p.Args[0].String()
+	default:
+		column := "value"
+		if p.Path != nil {
+			column += p.Path.String()
+		}
+		return fmt.Sprintf("%s %s '%s'", column, p.Op, p.Operand)
+	}
+}
+
+// compareValue compares value with operand, as numbers when operand
+// is one. ok is false when operand is a number and value is not.
+func compareValue(value, operand []byte) (int, bool) {
+	want, err := strconv.ParseFloat(string(operand), 64)
+	if err != nil {
+		return bytes.Compare(value, operand), true
+	}
+	got, err := strconv.ParseFloat(string(value), 64)
+	switch {
+	case err != nil:
+		return 0, false
+	case got < want:
+		return -1, true
+	case got > want:
+		return 1, true
+	default:
+		return 0, true
+	}
+}
+
+// matchLike reports whether value matches a like pattern
+func matchLike(value, pattern []byte) bool {
+	// star and next mark the last % seen so a failed match can
+	// retry with the % consuming one more byte
+	star, next := -1, 0
+	v, p := 0, 0
+	for v < len(value) {
+		switch {
+		case p < len(pattern) && pattern[p] == '%':
+			star, next = p, v
+			p++
+		case p < len(pattern) && (pattern[p] == '_' || pattern[p] == value[v]):
+			v++
+			p++
+		case star >= 0:
+			next++
+			v, p = next, star+1
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '%' {
+		p++
+	}
+	return p == len(pattern)
+}
@@ -3,10 +3,14 @@ package db
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 )
 
 type QueryInstruction int
 
+// QueryInstruction values are sent over RPC, so new instructions are
+// appended to keep the values of the existing ones
 const (
 	AddTable QueryInstruction = iota
 	BatchSetValue
@@ -17,28 +21,58 @@ const (
 	Print
 	Range
 	SetValue
+	Merge
+	BatchGetValue
+	DeleteRange
+	DropTable
+	ListTables
+	TruncateTable
+	AlterTable
+	Aggregate
+	InsertRange
+	JoinRange
 )
 
 func (i QueryInstruction) String() string {
 	switch i {
 	case AddTable:
 		return "AddTable"
+	case Aggregate:
+		return "Aggregate"
+	case AlterTable:
+		return "AlterTable"
+	case BatchGetValue:
+		return "BatchGetValue"
 	case BatchSetValue:
 		return "BatchSetValue"
 	case Count:
 		return "Count"
+	case DeleteRange:
+		return "DeleteRange"
+	case DropTable:
+		return "DropTable"
 	case GetValue:
 		return "GetValue"
 	case GetRange:
 		return "GetRange"
+	case InsertRange:
+		return "InsertRange"
+	case JoinRange:
+		return "JoinRange"
+	case ListTables:
+		return "ListTables"
 	case Load:
 		return "Load"
+	case Merge:
+		return "Merge"
 	case Print:
 		return "Print"
 	case Range:
 		return "Range"
 	case SetValue:
 		return "SetValue"
+	case TruncateTable:
+		return "TruncateTable"
 	default:
 		return "unknown"
 	}
@@ -50,60 +84,211 @@ type QueryHeader struct {
 	Opts      *TableOpts
 	FileName  []byte
 	Inst      QueryInstruction
+	// Analyze counts the storage work of a read in Stats.Reads
+	Analyze bool
+	// Source is the table an InsertRange query copies rows from
+	Source []byte
 }
 
 type QueryStats struct {
 	Count uint
+	// Reads counts the storage work of an analyzed query. Rows read
+	// after the response is sent count as the caller drains them.
+	Reads *ReadStats
+	// Stages times the stages of an analyzed query
+	Stages []Stage
 }
 
 type QueryResponse struct {
 	Key         []byte
 	Value       []byte
 	RangeValues [][][]byte
-	Stats       QueryStats
-	Success     bool
+	// Rows streams the rows matched by a GetRange query; the
+	// caller owns it and must Close it
+	Rows *RangeIterator
+	// Cursor resumes a paged range after the rows of a response that
+	// were read before it was sent
+	Cursor  []byte
+	Stats   QueryStats
+	Success bool
+	// Err reports why the query failed when it did not simply miss
+	Err error
 }
 
 type KeyRange struct {
 	Start []byte
 	End   []byte
-	Limit int
+	// Prefix restricts the range to keys beginning with Prefix
+	Prefix []byte
+	Limit  int
+	// Reverse scans from End down to Start
+	Reverse        bool
+	StartExclusive bool
+	EndExclusive   bool
+	// Cursor is a token from a previous page; the scan resumes after it
+	Cursor []byte
+	// Filter skips rows whose value it does not match; Limit counts
+	// only the rows that match
+	Filter *Predicate
 }
 
 func (kr *KeyRange) String() string {
-	return fmt.Sprintf("%s %s", kr.Start, kr.End)
+	out := fmt.Sprintf("%s %s", kr.Start, kr.End)
+	if kr.Prefix != nil {
+		out = fmt.Sprintf("%s prefix %s", out, kr.Prefix)
+	}
+	if kr.StartExclusive || kr.EndExclusive {
+		out = fmt.Sprintf("%s exclusive %t %t", out, kr.StartExclusive, kr.EndExclusive)
+	}
+	if kr.Reverse {
+		out = fmt.Sprintf("%s desc", out)
+	}
+	if kr.Limit > 0 {
+		out = fmt.Sprintf("%s limit %d", out, kr.Limit)
+	}
+	if kr.Cursor != nil {
+		out = fmt.Sprintf("%s after %s", out, kr.Cursor)
+	}
+	if kr.Filter != nil {
+		out = fmt.Sprintf("%s where %s", out, kr.Filter)
+	}
+	return out
 }
 
+// DefaultTimeout is the deadline given to queries whose context has none
+const DefaultTimeout = 30 * time.Second
+
 type Query struct {
 	ctx      context.Context
 	done     chan QueryResponse
+	deadline time.Time
+	// unwanted is set once GetResponse gave up on the query, so a
+	// late response is discarded; copies made by WithContext share it
+	unwanted *int32
 	Header   QueryHeader
 	KeyRange KeyRange
 	Key      []byte
 	Value    []byte
 	Values   []KeyValue
+	// Project computes the columns of the rows read; rows are their
+	// key and value when it is empty
+	Project []Projection
+	// Aggregates are computed over the rows an Aggregate query reads,
+	// for each group of GroupBy when it is set
+	Aggregates []Aggregation
+	GroupBy    *GroupBy
+	// Join is the table a JoinRange query joins its rows with
+	Join *Join
 }
 
 func NewQuery(ctx context.Context, outbox chan QueryResponse) *Query {
 	if outbox == nil {
 		outbox = make(chan QueryResponse, 1)
 	}
-	return &Query{ctx: ctx, done: outbox}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DefaultTimeout)
+	}
+	return &Query{ctx: ctx, done: outbox, deadline: deadline, unwanted: new(int32)}
+}
+
+// WithContext returns a shallow copy of m bound to ctx
+func (m *Query) WithContext(ctx context.Context) *Query {
+	q := NewQuery(ctx, m.done)
+	q.unwanted = m.unwanted
+	q.Header = m.Header
+	q.KeyRange = m.KeyRange
+	q.Key = m.Key
+	q.Value = m.Value
+	q.Values = m.Values
+	q.Project = m.Project
+	q.Aggregates = m.Aggregates
+	q.GroupBy = m.GroupBy
+	q.Join = m.Join
+	return q
+}
+
+// Deadline returns the time by which the query must be answered
+func (m *Query) Deadline() time.Time {
+	return m.deadline
+}
+
+// Err returns a non nil error once the query was cancelled or
+// its deadline has passed
+func (m *Query) Err() error {
+	if err := m.Context().Err(); err != nil {
+		return err
+	}
+	if !m.deadline.IsZero() && time.Now().After(m.deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
 }
 
 func (m *Query) String() string {
-	return fmt.Sprintf(
+	out := fmt.Sprintf(
 		"%s %s %s %s %s %s",
 		m.Header.FileName, m.Header.TableName,
 		m.Header.Inst, m.Key, m.Value, m.KeyRange.String(),
 	)
+	for _, kv := range m.Values {
+		out = fmt.Sprintf("%s %s=%s", out, kv.Key, kv.Value)
+	}
+	for _, p := range m.Project {
+		out = fmt.Sprintf("%s %s", out, p)
+	}
+	for _, agg := range m.Aggregates {
+		out = fmt.Sprintf("%s %s", out, agg)
+	}
+	if m.GroupBy != nil {
+		out = fmt.Sprintf("%s %s", out, m.GroupBy)
+	}
+	if m.Header.Source != nil {
+		out = fmt.Sprintf("%s from %s", out, m.Header.Source)
+	}
+	if m.Join != nil {
+		out = fmt.Sprintf("%s %s", out, m.Join)
+	}
+	return out
 }
 
+// Done answers the query. A response nobody waits for any more is
+// discarded and its rows closed, so they do not hold the table.
 func (m *Query) Done(r QueryResponse) {
+	if m.ctx.Err() != nil || atomic.LoadInt32(m.unwanted) == 1 {
+		discard(r)
+		return
+	}
 	select {
 	case <-m.ctx.Done():
+		discard(r)
 	case m.done <- r:
 		close(m.done)
+		if atomic.LoadInt32(m.unwanted) == 1 {
+			// GetResponse gave up while the response was sent
+			m.drain()
+		}
+	}
+}
+
+// drain discards a response left unread in the query's channel
+func (m *Query) drain() {
+	select {
+	case r, ok := <-m.done:
+		if ok {
+			discard(r)
+		}
+	default:
+	}
+}
+
+// discard closes the rows of a response that will not be read
+func discard(r QueryResponse) {
+	if r.Rows != nil {
+		_ = r.Rows.Close()
 	}
 }
 
@@ -114,9 +299,31 @@ func (m *Query) Context() context.Context {
 	return m.ctx
 }
 
-func (m *Query) GetResponse() *QueryResponse {
-	resp := <-m.done
-	return &resp
+// GetResponse waits for the query to be answered. It returns the
+// context's error if ctx or the query's own context is done first and
+// context.DeadlineExceeded once the query's deadline passes. A
+// response sent after it gave up is discarded.
+func (m *Query) GetResponse(ctx context.Context) (*QueryResponse, error) {
+	var expired <-chan time.Time
+	if !m.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(m.deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	select {
+	case resp := <-m.done:
+		return &resp, nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-m.Context().Done():
+		err = m.Context().Err()
+	case <-expired:
+		err = context.DeadlineExceeded
+	}
+	atomic.StoreInt32(m.unwanted, 1)
+	m.drain()
+	return nil, err
 }
 
 func NewGetValueQuery(ctx context.Context, db []byte, key []byte) (*Query, chan QueryResponse) {
@@ -130,6 +337,53 @@ func NewGetValueQuery(ctx context.Context, db []byte, key []byte) (*Query, chan
 	return query, done
 }
 
+func NewGetRangeQuery(ctx context.Context, db []byte, kr KeyRange) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      GetRange,
+	}
+	query.KeyRange = kr
+	return query, done
+}
+
+// NewInsertRangeQuery returns a query that copies the rows of src in
+// kr into db
+func NewInsertRangeQuery(ctx context.Context, db, src []byte, kr KeyRange) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Source:    src,
+		Inst:      InsertRange,
+	}
+	query.KeyRange = kr
+	return query, done
+}
+
+// NewRangeQuery returns a query that streams every row of db
+func NewRangeQuery(ctx context.Context, db []byte) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      Range,
+	}
+	return query, done
+}
+
+// NewPrintQuery returns a query that describes the structure of db
+func NewPrintQuery(ctx context.Context, db []byte) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      Print,
+	}
+	return query, done
+}
+
 func NewLoadFromFileQuery(ctx context.Context, db []byte, filename []byte) (*Query, chan QueryResponse) {
 	done := make(chan QueryResponse, 1)
 	query := NewQuery(ctx, done)
@@ -153,6 +407,43 @@ func NewSetValueQuery(ctx context.Context, db, key, value []byte) (*Query, chan
 	return query, done
 }
 
+func NewMergeQuery(ctx context.Context, db, key, operand []byte) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      Merge,
+	}
+	query.Key = key
+	query.Value = operand
+	return query, done
+}
+
+func NewDeleteRangeQuery(ctx context.Context, db, start, end []byte) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      DeleteRange,
+	}
+	query.KeyRange = KeyRange{Start: start, End: end}
+	return query, done
+}
+
+func NewBatchGetValueQuery(ctx context.Context, db []byte, keys [][]byte) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      BatchGetValue,
+	}
+	query.Values = make([]KeyValue, len(keys))
+	for i, k := range keys {
+		query.Values[i].Key = k
+	}
+	return query, done
+}
+
 func NewBatchSetValueQuery(ctx context.Context, db []byte, values []KeyValue) (*Query, chan QueryResponse) {
 	done := make(chan QueryResponse, 1)
 	query := NewQuery(ctx, done)
@@ -174,3 +465,49 @@ func NewAddTableQuery(ctx context.Context, db []byte) (*Query, chan QueryRespons
 	}
 	return query, done
 }
+
+// NewAlterTableQuery returns a query that changes the options of db
+// while it is open; changes pair option names with their new values
+func NewAlterTableQuery(ctx context.Context, db []byte, changes []KeyValue) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      AlterTable,
+	}
+	query.Values = changes
+	return query, done
+}
+
+// NewDropTableQuery returns a query that removes db and deletes its files
+func NewDropTableQuery(ctx context.Context, db []byte) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      DropTable,
+	}
+	return query, done
+}
+
+// NewTruncateTableQuery returns a query that deletes every key in db
+// and keeps the table with its options
+func NewTruncateTableQuery(ctx context.Context, db []byte) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		TableName: db,
+		Inst:      TruncateTable,
+	}
+	return query, done
+}
+
+// NewListTablesQuery returns a query that lists every table
+func NewListTablesQuery(ctx context.Context) (*Query, chan QueryResponse) {
+	done := make(chan QueryResponse, 1)
+	query := NewQuery(ctx, done)
+	query.Header = QueryHeader{
+		Inst: ListTables,
+	}
+	return query, done
+}
@@ -8,22 +8,25 @@ import (
 	"sync"
 
 	garena "github.com/blong14/gache/internal/arena"
+	gbloom "github.com/blong14/gache/internal/db/sstable/bloom"
 	gfile "github.com/blong14/gache/internal/io/file"
 	gmap "github.com/blong14/gache/internal/map/tablemap"
 )
 
 type SSTable struct {
 	mtx   sync.Mutex
+	name  string
 	buf   *bufio.Writer
+	bloom *gbloom.Filter
 	xindx *gmap.TableMap[[]byte, *indexValue]
 	data  gfile.Map
 	ptr   int
 }
 
-func New(f *os.File) *SSTable {
+func New(f *os.File) (*SSTable, error) {
 	s, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	len_ := s.Size() + gfile.DataEndIndex
 	mmap, err := gfile.NewMap(
@@ -34,21 +37,24 @@ func New(f *os.File) *SSTable {
 		gfile.Length(int(len_)),
 	)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	_, err = mmap.Seek(gfile.DataStartIndex, 0)
-	if err != nil {
-		panic(err)
+	if _, err = mmap.Seek(gfile.DataStartIndex, 0); err != nil {
+		_ = mmap.Close()
+		return nil, err
 	}
-	_, err = f.Seek(gfile.DataStartIndex, 0)
-	if err != nil {
-		panic(err)
+	if _, err = f.Seek(gfile.DataStartIndex, 0); err != nil {
+		_ = mmap.Close()
+		return nil, err
 	}
 	return &SSTable{
+		name:  f.Name(),
+		bloom: gbloom.New(1<<20, 0.01),
 		xindx: gmap.New[[]byte, *indexValue](bytes.Compare),
 		data:  mmap,
 		buf:   bufio.NewWriter(f),
-	}
+		ptr:   gfile.DataStartIndex,
+	}, nil
 }
 
 type indexValue struct {
@@ -56,23 +62,160 @@ type indexValue struct {
 	offset int64
 }
 
+// Stats counts the work reads do in an sstable
+type Stats struct {
+	// BloomSkips counts lookups the bloom filter ruled out
+	BloomSkips uint
+	// BlocksRead counts blocks read from the data file
+	BlocksRead uint
+}
+
+func (s *Stats) bloomSkip() {
+	if s != nil {
+		s.BloomSkips++
+	}
+}
+
+func (s *Stats) blockRead() {
+	if s != nil {
+		s.BlocksRead++
+	}
+}
+
 func (ss *SSTable) Get(k []byte) ([]byte, bool) {
+	return ss.GetWithStats(k, nil)
+}
+
+// GetWithStats is Get counting its work in stats, which may be nil
+func (ss *SSTable) GetWithStats(k []byte, stats *Stats) ([]byte, bool) {
+	if !ss.bloom.MayContain(k) {
+		stats.bloomSkip()
+		return nil, false
+	}
 	raw, ok := ss.xindx.Get(k)
 	if !ok {
 		return nil, false
 	}
+	value, err := ss.read(raw, stats)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// GetMany looks up keys, which must be sorted, with a single pass
+// over the index. Keys the bloom filter rules out never touch the index.
+func (ss *SSTable) GetMany(keys [][]byte) map[string][]byte {
+	return ss.GetManyWithStats(keys, nil)
+}
+
+// GetManyWithStats is GetMany counting its work in stats, which may be nil
+func (ss *SSTable) GetManyWithStats(keys [][]byte, stats *Stats) map[string][]byte {
+	out := make(map[string][]byte)
+	itr := ss.Iterator()
+	for _, k := range keys {
+		if !ss.bloom.MayContain(k) {
+			stats.bloomSkip()
+			continue
+		}
+		if !itr.Valid() || bytes.Compare(itr.Key(), k) < 0 {
+			if !itr.Seek(k) {
+				break
+			}
+		}
+		if bytes.Equal(itr.Key(), k) {
+			if value, err := ss.read(itr.value, stats); err == nil {
+				out[string(k)] = value
+			}
+		}
+	}
+	return out
+}
+
+func (ss *SSTable) read(raw *indexValue, stats *Stats) ([]byte, error) {
+	stats.blockRead()
 	kv := byteArena.Allocate(int(raw.length))
 	_, err := ss.data.Peek(kv, raw.offset, raw.length)
 	if err != nil {
-		return nil, false
+		return nil, err
 	}
 	line, err := gfile.DecodeLine(string(kv))
 	if err != nil {
-		return nil, false
+		return nil, err
 	}
-	klen := line[1]
-	value := line[klen:]
-	return value, true
+	klen := int(line[0])
+	return line[klen+1:], nil
+}
+
+// Iterator walks the sstable index in key order
+type Iterator struct {
+	ss    *SSTable
+	key   []byte
+	value *indexValue
+	valid bool
+	err   error
+	stats *Stats
+}
+
+func (ss *SSTable) Iterator() *Iterator {
+	return &Iterator{ss: ss}
+}
+
+// IteratorWithStats returns an Iterator counting the blocks it reads in stats
+func (ss *SSTable) IteratorWithStats(stats *Stats) *Iterator {
+	return &Iterator{ss: ss, stats: stats}
+}
+
+func (i *Iterator) set(k []byte, v *indexValue, ok bool) bool {
+	i.key, i.value, i.valid = k, v, ok
+	return ok
+}
+
+func (i *Iterator) Valid() bool { return i.valid }
+func (i *Iterator) Key() []byte { return i.key }
+func (i *Iterator) Err() error  { return i.err }
+
+func (i *Iterator) Value() []byte {
+	if !i.valid {
+		return nil
+	}
+	value, err := i.ss.read(i.value, i.stats)
+	if err != nil {
+		i.err = err
+		return nil
+	}
+	return value
+}
+
+func (i *Iterator) Close() error {
+	i.set(nil, nil, false)
+	return i.err
+}
+
+func (i *Iterator) Seek(k []byte) bool {
+	return i.set(i.ss.xindx.Ceiling(k))
+}
+
+func (i *Iterator) SeekToFirst() bool {
+	return i.set(i.ss.xindx.First())
+}
+
+func (i *Iterator) SeekToLast() bool {
+	return i.set(i.ss.xindx.Last())
+}
+
+func (i *Iterator) Next() bool {
+	if !i.valid {
+		return false
+	}
+	return i.set(i.ss.xindx.Higher(i.key))
+}
+
+func (i *Iterator) Prev() bool {
+	if !i.valid {
+		return false
+	}
+	return i.set(i.ss.xindx.Lower(i.key))
 }
 
 var byteArena = make(garena.ByteArena, 0)
@@ -95,9 +238,63 @@ func (ss *SSTable) Set(k, v []byte) error {
 	ss.ptr += _len
 	ss.mtx.Unlock()
 	ss.xindx.Set(k, &indexValue{offset: int64(offset), length: int64(_len)})
+	ss.bloom.Add(k)
 	return nil
 }
 
+// DeleteRange writes a range tombstone for the keys between start and
+// end inclusive and compacts them out of the index; a nil bound is
+// unbounded. The tombstone is recorded with a zero key length. The
+// data file is not read back when a table is reopened; tables that
+// must survive a restart are rebuilt from their WAL.
+func (ss *SSTable) DeleteRange(start, end []byte) error {
+	slen := len(start)
+	encoded := byteArena.Allocate(slen + len(end) + 2)
+	encoded[0] = 0
+	encoded[1] = byte(slen)
+	copy(encoded[2:slen+2], start)
+	copy(encoded[slen+2:], end)
+	row, err := gfile.EncodeBlock(encoded)
+	if err != nil {
+		return err
+	}
+	ss.mtx.Lock()
+	_len, _ := ss.buf.Write(row)
+	_ = ss.buf.Flush()
+	ss.ptr += _len
+	ss.mtx.Unlock()
+	var ok bool
+	if start == nil {
+		if start, _, ok = ss.xindx.First(); !ok {
+			return nil
+		}
+	}
+	if end == nil {
+		if end, _, ok = ss.xindx.Last(); !ok {
+			return nil
+		}
+	}
+	ss.xindx.RemoveRange(start, end)
+	return nil
+}
+
+// Name returns the name of the sstable's data file
+func (ss *SSTable) Name() string {
+	return ss.name
+}
+
+// Size returns the number of bytes written to the data file
+func (ss *SSTable) Size() int {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	return ss.ptr
+}
+
+// IndexSize returns the number of keys in the index
+func (ss *SSTable) IndexSize() int {
+	return ss.xindx.Size()
+}
+
 func (ss *SSTable) Free() {
 	if err := ss.data.Close(); err != nil {
 		log.Println(err)
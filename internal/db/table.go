@@ -1,96 +1,279 @@
 package db
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	gmtable "github.com/blong14/gache/internal/db/memtable"
 	gstable "github.com/blong14/gache/internal/db/sstable"
 	gwal "github.com/blong14/gache/internal/db/wal"
+	gerrors "github.com/blong14/gache/internal/errors"
 	gfile "github.com/blong14/gache/internal/io/file"
 )
 
 type Table interface {
 	Get(k []byte) ([]byte, bool)
+	// GetMany returns the pairs found for keys in request order
+	GetMany(keys [][]byte) []KeyValue
 	Set(k, v []byte) error
+	// Merge applies operand to k with the table's MergeOperator and
+	// returns the value k has with it applied
+	Merge(k, operand []byte) ([]byte, error)
+	// Delete deletes k
+	Delete(k []byte) error
+	// DeleteRange deletes every key between start and end inclusive
+	DeleteRange(start, end []byte) error
+	Iterator() Iterator
+	// Sequence returns the number of writes applied to the table
+	Sequence() uint64
 	Scan(s, e []byte) ([][][]byte, bool)
 	ScanWithLimit(s, e []byte, l int) ([][][]byte, bool)
 	Range(func(k, v []byte) bool)
-	Print()
+	// Print writes a diagnostic view of the table's structure to w
+	// as one tab separated name and value per line
+	Print(w io.Writer) error
 	Connect() error
 	Count() uint64
 	Close()
+	// Drop deletes the table's files. The table stays readable until
+	// Close, which then frees it without flushing.
+	Drop() error
+	// Alter applies the options that can change while the table is open
+	Alter(opts *TableOpts) error
+	// Trace returns a view of the table whose Get, GetMany and
+	// Iterator count the work they do in stats
+	Trace(stats *ReadStats) Table
 }
 
 type TableOpts struct {
 	TableName []byte
 	DataDir   []byte
 	InMemory  bool
-	WalMode   bool
+	// WalMode logs every write, so a file table reopened with it
+	// replays its sets, merges and deletes
+	WalMode bool
+	// SyncWAL syncs the WAL to disk after every record instead of
+	// leaving flushed records to the OS
+	SyncWAL       bool
+	MergeOperator MergeOperator
+	// Loader reads keys missing from the table; nil disables read-through
+	Loader Loader
+	// Writer receives writes to the table; nil disables write-through
+	Writer    Writer
+	WriteMode WriteMode
+	// TTL is how long a key lives after it was written or loaded;
+	// zero keeps keys forever
+	TTL time.Duration
+	// MaxBytes is how many key and value bytes the memtable holds
+	// before it is flushed; zero uses the default
+	MaxBytes uint64
 }
 
 type fileDatabase struct {
 	dir      string
 	name     string
+	opts     tableOptions
 	memtable *gmtable.MemTable
 	sstable  *gstable.SSTable
 	handle   *os.File
 	wal      *gwal.WAL
+	merges   *mergeLog
 	useWal   bool
 	onSet    chan struct{}
+	once     sync.Once
+	// err is the error Connect failed with
+	err error
+	seq uint64
+	// dropped is set once Drop has deleted the table's files
+	dropped uint32
 }
 
-func New(opts *TableOpts) Table {
+// New opens the table opts describes. A file backed table fails to
+// open when its files cannot be created or read.
+func New(opts *TableOpts) (Table, error) {
+	memtable := gmtable.New()
+	memtable.SetAllowedBytes(opts.MaxBytes)
 	if opts.InMemory {
-		return &inMemoryDatabase{
+		db := &inMemoryDatabase{
 			name:     string(opts.TableName),
-			memtable: gmtable.New(),
+			memtable: memtable,
+			merges:   newMergeLog(opts.MergeOperator),
 		}
+		db.opts.store(opts)
+		return db, nil
 	}
 	db := &fileDatabase{
 		dir:      string(opts.DataDir),
 		name:     string(opts.TableName),
-		memtable: gmtable.New(),
+		memtable: memtable,
+		merges:   newMergeLog(opts.MergeOperator),
 		useWal:   opts.WalMode,
 		onSet:    make(chan struct{}),
 	}
-	if err := db.Connect(); err != nil {
-		panic(err)
+	db.opts.store(opts)
+	// the options are kept next to the table's files so the
+	// table can be reopened with them
+	err := db.Connect()
+	if err == nil {
+		err = saveTableOpts(opts)
 	}
-	return db
+	if err != nil {
+		db.release()
+		return nil, err
+	}
+	return db, nil
+}
+
+// tableOptions holds the options of an open table, which Alter
+// replaces while queries read them
+type tableOptions struct {
+	v atomic.Value
 }
 
-var once sync.Once
+func (o *tableOptions) load() *TableOpts {
+	return o.v.Load().(*TableOpts)
+}
+
+func (o *tableOptions) store(opts *TableOpts) {
+	o.v.Store(opts)
+}
 
 func (db *fileDatabase) Connect() error {
-	once.Do(func() {
-		f, err := gfile.NewDatFile(db.dir, db.name)
-		if err != nil {
-			panic(err)
-		}
-		db.handle = f
-		db.sstable = gstable.New(db.handle)
-		file := fmt.Sprintf("%s-wal.dat", db.name)
-		p := path.Join(db.dir, file)
-		f, err = os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0644)
-		if err != nil {
-			panic(err)
-		}
-		db.wal = gwal.New(f)
+	db.once.Do(func() {
+		db.err = db.connect()
+	})
+	return db.err
+}
+
+func (db *fileDatabase) connect() error {
+	f, err := gfile.NewDatFile(db.dir, db.name)
+	if err != nil {
+		return err
+	}
+	db.handle = f
+	if db.sstable, err = gstable.New(db.handle); err != nil {
+		return err
+	}
+	file := fmt.Sprintf("%s-wal.dat", db.name)
+	p := path.Join(db.dir, file)
+	f, err = os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if db.wal, err = gwal.New(f, db.options().SyncWAL); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if !db.useWal {
+		return nil
+	}
+	return db.replay()
+}
+
+// release frees what a failed Connect opened without touching the files
+func (db *fileDatabase) release() {
+	if db.sstable != nil {
+		db.sstable.Free()
+	}
+	if db.handle != nil {
+		_ = db.handle.Close()
+	}
+	if db.wal != nil {
+		_ = db.wal.Close()
+	}
+}
+
+// options returns the table's current options
+func (db *fileDatabase) options() *TableOpts {
+	return db.opts.load()
+}
+
+// replay applies the writes logged to the WAL, which holds every write
+// made to the table since it was created
+func (db *fileDatabase) replay() error {
+	return db.wal.Replay(func(r gwal.Record) error {
+		atomic.AddUint64(&db.seq, 1)
+		switch r.Op {
+		case gwal.OpSet:
+			db.merges.discard(r.Key)
+			return db.set(r.Key, r.Value)
+		case gwal.OpMerge:
+			// operands the merge operator rejected were logged too
+			_, _ = db.merges.add(r.Key, r.Value, db.get, db.set)
+		case gwal.OpDeleteRange:
+			db.merges.discardRange(r.Key, r.Value)
+			db.memtable.DeleteRange(r.Key, r.Value)
+		case gwal.OpDelete:
+			db.merges.discard(r.Key)
+			db.memtable.Delete(r.Key)
+		}
+		return nil
 	})
-	return nil
 }
 
 func (db *fileDatabase) Get(k []byte) ([]byte, bool) {
+	return db.merges.get(k, db.get)
+}
+
+func (db *fileDatabase) GetMany(keys [][]byte) []KeyValue {
+	return db.getMany(keys, nil)
+}
+
+// getMany reads keys counting the work in stats, which may be nil
+func (db *fileDatabase) getMany(keys [][]byte, stats *ReadStats) []KeyValue {
+	sorted := sortedKeys(keys)
+	var fromDisk map[string][]byte
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fromDisk = db.sstable.GetManyWithStats(sorted, stats.sstable())
+	}()
+	fromMemory := make(map[string][]byte)
+	for _, k := range sorted {
+		if value, ok := db.memtable.Get(k); ok {
+			stats.memtableHit()
+			fromMemory[string(k)] = value
+		}
+	}
+	wg.Wait()
+	return collect(db.merges, keys, func(k []byte) ([]byte, bool) {
+		if value, ok := fromMemory[string(k)]; ok {
+			return value, true
+		}
+		if db.memtable.Deleted(k) {
+			return nil, false
+		}
+		value, ok := fromDisk[string(k)]
+		return value, ok
+	})
+}
+
+func (db *fileDatabase) get(k []byte) ([]byte, bool) {
+	return db.read(k, nil)
+}
+
+// read looks k up in the memtable and then the sstable, counting the
+// work in stats, which may be nil
+func (db *fileDatabase) read(k []byte, stats *ReadStats) ([]byte, bool) {
 	value, ok := db.memtable.Get(k)
 	if ok {
+		stats.memtableHit()
 		return value, true
 	}
-	return db.sstable.Get(k)
+	if db.memtable.Deleted(k) {
+		return nil, false
+	}
+	return db.sstable.GetWithStats(k, stats.sstable())
 }
 
 func (db *fileDatabase) Count() uint64 {
@@ -103,11 +286,17 @@ func (db *fileDatabase) Set(k, v []byte) error {
 			return err
 		}
 	}
+	atomic.AddUint64(&db.seq, 1)
+	db.merges.discard(k)
+	return db.set(k, v)
+}
+
+func (db *fileDatabase) set(k, v []byte) error {
 	if err := db.memtable.Set(k, v); err != nil {
 		if errors.Is(err, gmtable.ErrAllowedBytesExceeded) {
 			go func() {
-				if db.sstable != nil {
-					_ = db.memtable.Flush(db.sstable)
+				if err := db.flush(); err != nil {
+					log.Println(err)
 				}
 			}()
 		} else {
@@ -117,83 +306,375 @@ func (db *fileDatabase) Set(k, v []byte) error {
 	return nil
 }
 
+func (db *fileDatabase) Merge(k, operand []byte) ([]byte, error) {
+	if db.useWal {
+		if err := db.wal.Merge(k, operand); err != nil {
+			return nil, err
+		}
+	}
+	atomic.AddUint64(&db.seq, 1)
+	return db.merges.add(k, operand, db.get, db.set)
+}
+
+func (db *fileDatabase) Delete(k []byte) error {
+	if db.useWal {
+		if err := db.wal.Delete(k); err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&db.seq, 1)
+	db.merges.discard(k)
+	db.memtable.Delete(k)
+	return nil
+}
+
+func (db *fileDatabase) DeleteRange(start, end []byte) error {
+	if db.useWal {
+		if err := db.wal.DeleteRange(start, end); err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&db.seq, 1)
+	db.merges.discardRange(start, end)
+	db.memtable.DeleteRange(start, end)
+	return nil
+}
+
+// flush folds pending merge operands into the memtable before
+// writing the memtable out to the sstable
+func (db *fileDatabase) flush() error {
+	if db.sstable == nil {
+		return nil
+	}
+	err := db.merges.fold(db.get, func(k, v []byte) error {
+		if err := db.memtable.Set(k, v); err != nil &&
+			!errors.Is(err, gmtable.ErrAllowedBytesExceeded) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return db.memtable.Flush(db.sstable)
+}
+
 func (db *fileDatabase) Close() {
 	if db.sstable != nil {
-		err := db.memtable.Flush(db.sstable)
-		if err != nil {
-			log.Println(err)
+		if atomic.LoadUint32(&db.dropped) == 0 {
+			if err := db.flush(); err != nil {
+				log.Println(err)
+			}
 		}
 		db.sstable.Free()
 	}
+	if db.wal != nil {
+		if err := db.wal.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (db *fileDatabase) Drop() error {
+	atomic.StoreUint32(&db.dropped, 1)
+	var errs *gerrors.Error
+	if db.sstable != nil {
+		errs = gerrors.Append(errs, os.Remove(db.sstable.Name()))
+	}
+	if db.wal != nil {
+		errs = gerrors.Append(errs, os.Remove(db.wal.Name()))
+	}
+	if err := os.Remove(optsPath(db.dir, db.name)); !errors.Is(err, os.ErrNotExist) {
+		errs = gerrors.Append(errs, err)
+	}
+	return errs.ErrorOrNil()
+}
+
+func (db *fileDatabase) Alter(opts *TableOpts) error {
+	if err := saveTableOpts(opts); err != nil {
+		return err
+	}
+	db.memtable.SetAllowedBytes(opts.MaxBytes)
+	db.opts.store(opts)
+	return nil
 }
 
-func (db *fileDatabase) Print() {}
+func (db *fileDatabase) Print(w io.Writer) error {
+	p := &printer{w: w}
+	p.table(db.name, db.Sequence(), db.merges)
+	p.options(db.options())
+	p.memtable(db.memtable)
+	p.line("sstable.file", db.sstable.Name())
+	p.line("sstable.bytes", db.sstable.Size())
+	p.line("sstable.index", db.sstable.IndexSize())
+	return p.err
+}
+
+func (db *fileDatabase) Sequence() uint64 {
+	return atomic.LoadUint64(&db.seq)
+}
+
+func (db *fileDatabase) Iterator() Iterator {
+	return db.iterator(nil)
+}
+
+// iterator merges the memtable over the sstable, counting the values
+// read from each in stats, which may be nil
+func (db *fileDatabase) iterator(stats *ReadStats) Iterator {
+	return &valueIterator{
+		Iterator: newMergeIterator(
+			stats.memtable(db.memtable.Iterator()),
+			&skipIterator{
+				Iterator: db.sstable.IteratorWithStats(stats.sstable()),
+				skip:     db.memtable.Deleted,
+			},
+		),
+		fnc: func(k, v []byte) []byte {
+			return db.merges.value(k, v, db.get)
+		},
+	}
+}
+
+func (db *fileDatabase) Trace(stats *ReadStats) Table {
+	return &tracedFileDatabase{fileDatabase: db, stats: stats}
+}
+
+// tracedFileDatabase is the view of a fileDatabase returned by Trace
+type tracedFileDatabase struct {
+	*fileDatabase
+	stats *ReadStats
+}
+
+func (db *tracedFileDatabase) Get(k []byte) ([]byte, bool) {
+	return db.merges.get(k, func(k []byte) ([]byte, bool) {
+		return db.read(k, db.stats)
+	})
+}
+
+func (db *tracedFileDatabase) GetMany(keys [][]byte) []KeyValue {
+	return db.getMany(keys, db.stats)
+}
+
+func (db *tracedFileDatabase) Iterator() Iterator {
+	return db.iterator(db.stats)
+}
 
 func (db *fileDatabase) Range(fnc func(k, v []byte) bool) {
-	db.memtable.Range(fnc)
+	rangeIter(db.Iterator(), fnc)
 }
 
 func (db *fileDatabase) Scan(s, e []byte) ([][][]byte, bool) {
-	out := make([][][]byte, 0)
-	db.memtable.Scan(s, e, func(k, v []byte) bool {
-		out = append(out, [][]byte{k, v})
-		return true
-	})
-	return out, true
+	return scan(db.Iterator(), KeyRange{Start: s, End: e})
 }
 
 func (db *fileDatabase) ScanWithLimit(s, e []byte, limit int) ([][][]byte, bool) {
-	out := make([][][]byte, 0)
-	db.memtable.Scan(s, e, func(k, v []byte) bool {
-		out = append(out, [][]byte{k, v})
-		if limit > 0 && len(out) >= limit {
-			return false
-		}
-		return true
-	})
-	return out, true
+	return scan(db.Iterator(), KeyRange{Start: s, End: e, Limit: limit})
 }
 
 type inMemoryDatabase struct {
 	name     string
+	opts     tableOptions
 	memtable *gmtable.MemTable
+	merges   *mergeLog
+	seq      uint64
 }
 
 func (db *inMemoryDatabase) Get(k []byte) ([]byte, bool) {
-	value, ok := db.memtable.Get(k)
-	return value, ok
+	return db.merges.get(k, db.memtable.Get)
+}
+
+func (db *inMemoryDatabase) GetMany(keys [][]byte) []KeyValue {
+	return collect(db.merges, keys, db.memtable.Get)
 }
 
 func (db *inMemoryDatabase) Set(k, v []byte) error {
+	atomic.AddUint64(&db.seq, 1)
+	db.merges.discard(k)
 	return db.memtable.Set(k, v)
 }
 
+func (db *inMemoryDatabase) Merge(k, operand []byte) ([]byte, error) {
+	atomic.AddUint64(&db.seq, 1)
+	return db.merges.add(k, operand, db.memtable.Get, db.memtable.Set)
+}
+
+func (db *inMemoryDatabase) Delete(k []byte) error {
+	atomic.AddUint64(&db.seq, 1)
+	db.merges.discard(k)
+	db.memtable.Remove(k)
+	return nil
+}
+
+func (db *inMemoryDatabase) DeleteRange(start, end []byte) error {
+	atomic.AddUint64(&db.seq, 1)
+	db.merges.discardRange(start, end)
+	db.memtable.RemoveRange(start, end)
+	return nil
+}
+
+func (db *inMemoryDatabase) Sequence() uint64 {
+	return atomic.LoadUint64(&db.seq)
+}
+
+func (db *inMemoryDatabase) Iterator() Iterator {
+	return &valueIterator{
+		Iterator: db.memtable.Iterator(),
+		fnc: func(k, v []byte) []byte {
+			return db.merges.value(k, v, db.memtable.Get)
+		},
+	}
+}
+
+func (db *inMemoryDatabase) Trace(stats *ReadStats) Table {
+	return &tracedMemoryDatabase{inMemoryDatabase: db, stats: stats}
+}
+
+// tracedMemoryDatabase is the view of an inMemoryDatabase returned by Trace
+type tracedMemoryDatabase struct {
+	*inMemoryDatabase
+	stats *ReadStats
+}
+
+func (db *tracedMemoryDatabase) get(k []byte) ([]byte, bool) {
+	value, ok := db.memtable.Get(k)
+	if ok {
+		db.stats.memtableHit()
+	}
+	return value, ok
+}
+
+func (db *tracedMemoryDatabase) Get(k []byte) ([]byte, bool) {
+	return db.merges.get(k, db.get)
+}
+
+func (db *tracedMemoryDatabase) GetMany(keys [][]byte) []KeyValue {
+	return collect(db.merges, keys, db.get)
+}
+
+func (db *tracedMemoryDatabase) Iterator() Iterator {
+	return &valueIterator{
+		Iterator: db.stats.memtable(db.memtable.Iterator()),
+		fnc: func(k, v []byte) []byte {
+			return db.merges.value(k, v, db.memtable.Get)
+		},
+	}
+}
+
 func (db *inMemoryDatabase) Scan(s, e []byte) ([][][]byte, bool) {
-	out := make([][][]byte, 0)
-	db.memtable.Scan(s, e, func(k, v []byte) bool {
-		out = append(out, [][]byte{k, v})
-		return true
-	})
-	return out, true
+	return scan(db.Iterator(), KeyRange{Start: s, End: e})
 }
 
 func (db *inMemoryDatabase) ScanWithLimit(s, e []byte, limit int) ([][][]byte, bool) {
-	out := make([][][]byte, 0)
-	db.memtable.Scan(s, e, func(k, v []byte) bool {
-		out = append(out, [][]byte{k, v})
-		if limit > 0 && len(out) >= limit {
-			return false
-		}
-		return true
-	})
-	return out, true
+	return scan(db.Iterator(), KeyRange{Start: s, End: e, Limit: limit})
 }
 
 func (db *inMemoryDatabase) Range(fnc func(k, v []byte) bool) {
-	db.memtable.Range(fnc)
+	rangeIter(db.Iterator(), fnc)
 }
 
-func (db *inMemoryDatabase) Count() uint64  { return db.memtable.Count() }
-func (db *inMemoryDatabase) Close()         {}
-func (db *inMemoryDatabase) Print()         {}
+func (db *inMemoryDatabase) Count() uint64 { return db.memtable.Count() }
+func (db *inMemoryDatabase) Close()        {}
+func (db *inMemoryDatabase) Print(w io.Writer) error {
+	p := &printer{w: w}
+	p.table(db.name, db.Sequence(), db.merges)
+	p.options(db.opts.load())
+	p.memtable(db.memtable)
+	return p.err
+}
 func (db *inMemoryDatabase) Connect() error { return nil }
+func (db *inMemoryDatabase) Drop() error    { return nil }
+func (db *inMemoryDatabase) Alter(opts *TableOpts) error {
+	db.memtable.SetAllowedBytes(opts.MaxBytes)
+	db.opts.store(opts)
+	return nil
+}
+
+func rangeIter(it Iterator, fnc func(k, v []byte) bool) {
+	defer func() { _ = it.Close() }()
+	for ok := it.SeekToFirst(); ok; ok = it.Next() {
+		if !fnc(it.Key(), it.Value()) {
+			return
+		}
+	}
+}
+
+func scan(it Iterator, kr KeyRange) ([][][]byte, bool) {
+	out := make([][][]byte, 0)
+	rows := NewRangeIterator(it, kr)
+	defer func() { _ = rows.Close() }()
+	for ; rows.Valid(); rows.Next() {
+		out = append(out, [][]byte{rows.Key(), rows.Value()})
+	}
+	return out, rows.Err() == nil
+}
+
+// sortedKeys returns a sorted copy of keys with duplicates removed
+func sortedKeys(keys [][]byte) [][]byte {
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	out := sorted[:0]
+	for _, k := range sorted {
+		if len(out) == 0 || !bytes.Equal(k, out[len(out)-1]) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+func collect(merges *mergeLog, keys [][]byte, lookup func(k []byte) ([]byte, bool)) []KeyValue {
+	out := make([]KeyValue, 0, len(keys))
+	for _, k := range keys {
+		if value, ok := merges.get(k, lookup); ok {
+			out = append(out, KeyValue{Key: k, Value: value})
+		}
+	}
+	return out
+}
+
+// printer writes the lines of Table.Print and keeps the first error
+type printer struct {
+	w   io.Writer
+	err error
+}
+
+func (p *printer) line(name string, value interface{}) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, "%s\t%v\n", name, value)
+	}
+}
+
+func (p *printer) table(name string, seq uint64, merges *mergeLog) {
+	p.line("table", name)
+	p.line("sequence", seq)
+	p.line("merges.pending", merges.size())
+}
+
+func (p *printer) options(o *TableOpts) {
+	p.line("options.in_memory", o.InMemory)
+	p.line("options.wal", o.WalMode)
+	if o.WalMode {
+		p.line("options.sync", syncName(o.SyncWAL))
+	}
+	if !o.InMemory {
+		p.line("options.data_dir", string(o.DataDir))
+	}
+	p.line("options.ttl", o.TTL)
+	if o.MergeOperator != nil {
+		p.line("options.merge_operator", o.MergeOperator.Name())
+	}
+}
+
+func (p *printer) memtable(m *gmtable.MemTable) {
+	p.line("memtable.keys", m.Count())
+	p.line("memtable.max_bytes", m.AllowedBytes())
+	p.line("memtable.bytes", m.Bytes())
+	p.line("memtable.tombstones", m.Tombstones())
+	levels := m.Levels()
+	for i, n := range levels {
+		// levels are numbered from the base of the list up
+		p.line(fmt.Sprintf("memtable.level.%d", len(levels)-1-i), n)
+	}
+}
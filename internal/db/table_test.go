@@ -1,10 +1,15 @@
 package db_test
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -47,7 +52,7 @@ func TestFileDB(t *testing.T) {
 	t.Cleanup(func() {
 		tearDown(t)
 	})
-	db := gdb.New(
+	db, err := gdb.New(
 		&gdb.TableOpts{
 			DataDir:   []byte("testdata"),
 			TableName: []byte("default"),
@@ -55,6 +60,9 @@ func TestFileDB(t *testing.T) {
 			WalMode:   true,
 		},
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	count := 64
 	keys := setUp(t, count)
 	// given
@@ -85,7 +93,7 @@ func TestFileDB(t *testing.T) {
 }
 
 func TestInMemoryDB(t *testing.T) {
-	db := gdb.New(
+	db, err := gdb.New(
 		&gdb.TableOpts{
 			DataDir:   []byte("testdata"),
 			TableName: []byte("default"),
@@ -93,6 +101,9 @@ func TestInMemoryDB(t *testing.T) {
 			WalMode:   false,
 		},
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	count := 64
 	keys := setUp(t, count)
 	// given
@@ -121,3 +132,523 @@ func TestInMemoryDB(t *testing.T) {
 	wg.Wait()
 	db.Close()
 }
+
+func TestInMemoryDB_Merge(t *testing.T) {
+	db, err := gdb.New(
+		&gdb.TableOpts{
+			TableName:     []byte("default"),
+			InMemory:      true,
+			MergeOperator: gdb.Int64Add{},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("counter")
+	count := 200
+	var wg sync.WaitGroup
+	results := make(chan string, count)
+	for i := 0; i < count; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			value, err := db.Merge(key, []byte("1"))
+			if err != nil {
+				t.Error(err)
+			}
+			results <- string(value)
+		}()
+		go func() {
+			defer wg.Done()
+			// reads race the folds that merges trigger
+			if value, ok := db.Get(key); ok {
+				if n, _ := strconv.Atoi(string(value)); n > count {
+					t.Errorf("w at most %d g %s", count, value)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	seen := make(map[string]bool)
+	for value := range results {
+		seen[value] = true
+	}
+	actual, ok := db.Get(key)
+	if !ok || string(actual) != "200" {
+		t.Errorf("w 200 g %s", actual)
+	}
+	if len(seen) != count {
+		t.Errorf("w each merge to return its own count g %d distinct", len(seen))
+	}
+	if err := db.Set(key, []byte("7")); err != nil {
+		t.Error(err)
+	}
+	if value, err := db.Merge(key, []byte("-2")); err != nil || string(value) != "5" {
+		t.Errorf("w 5 g %s %v", value, err)
+	}
+	if _, err := db.Merge(key, []byte("x")); !errors.Is(err, gdb.ErrInvalidOperand) {
+		t.Errorf("expected an invalid operand g %v", err)
+	}
+	if _, err := db.Merge([]byte("fresh"), []byte("3")); err != nil {
+		t.Error(err)
+	}
+	if rows, _ := db.Scan([]byte("fresh"), []byte("fresh")); len(rows) != 1 || string(rows[0][1]) != "3" {
+		t.Errorf("expected a scan to see a key only merged into g %v", rows)
+	}
+	actual, ok = db.Get(key)
+	if !ok || string(actual) != "5" {
+		t.Errorf("w 5 g %s", actual)
+	}
+	db.Close()
+}
+
+func TestMergeOperators(t *testing.T) {
+	tests := map[string]struct {
+		op       gdb.MergeOperator
+		existing []byte
+		operands [][]byte
+		expected string
+	}{
+		"int64add": {gdb.Int64Add{}, []byte("1"), [][]byte{[]byte("2"), []byte("3")}, "6"},
+		"append":   {gdb.Append{}, []byte("a"), [][]byte{[]byte("b"), []byte("c")}, "abc"},
+		"max":      {gdb.Max{}, nil, [][]byte{[]byte("-4"), []byte("-9")}, "-4"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual, err := test.op.FullMerge(nil, test.existing, test.operands)
+			if err != nil {
+				t.Error(err)
+			}
+			if string(actual) != test.expected {
+				t.Errorf("w %s g %s", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestInMemoryDB_Iterator(t *testing.T) {
+	db, err := gdb.New(
+		&gdb.TableOpts{
+			TableName: []byte("default"),
+			InMemory:  true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	for _, k := range []string{"d", "a", "c", "b", "e"} {
+		if err := db.Set([]byte(k), []byte(k)); err != nil {
+			t.Error(err)
+		}
+	}
+	rows := gdb.NewRangeIterator(
+		db.Iterator(), gdb.KeyRange{Start: []byte("b"), End: []byte("d")})
+	var actual []string
+	for ; rows.Valid(); rows.Next() {
+		actual = append(actual, string(rows.Key()))
+	}
+	if strings.Join(actual, "") != "bcd" {
+		t.Errorf("w bcd g %v", actual)
+	}
+	actual = actual[:0]
+	for ok := rows.SeekToLast(); ok; ok = rows.Prev() {
+		actual = append(actual, string(rows.Key()))
+	}
+	if strings.Join(actual, "") != "dcb" {
+		t.Errorf("w dcb g %v", actual)
+	}
+	if err := rows.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInMemoryDB_ScanRange(t *testing.T) {
+	db, err := gdb.New(
+		&gdb.TableOpts{
+			TableName: []byte("default"),
+			InMemory:  true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	for _, k := range []string{"a", "user:1", "user:2", "user:3", "users", "v"} {
+		if err := db.Set([]byte(k), []byte(k)); err != nil {
+			t.Error(err)
+		}
+	}
+	tests := map[string]struct {
+		kr       gdb.KeyRange
+		expected string
+	}{
+		"prefix": {
+			gdb.KeyRange{Prefix: []byte("user:")}, "user:1,user:2,user:3"},
+		"prefix reverse": {
+			gdb.KeyRange{Prefix: []byte("user:"), Reverse: true}, "user:3,user:2,user:1"},
+		"reverse limit": {
+			gdb.KeyRange{Reverse: true, Limit: 2}, "v,users"},
+		"exclusive bounds": {
+			gdb.KeyRange{
+				Start: []byte("user:1"), End: []byte("users"),
+				StartExclusive: true, EndExclusive: true,
+			}, "user:2,user:3"},
+		"exclusive bounds reverse": {
+			gdb.KeyRange{
+				Start: []byte("user:1"), End: []byte("users"),
+				StartExclusive: true, EndExclusive: true, Reverse: true,
+			}, "user:3,user:2"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rows := gdb.NewRangeIterator(db.Iterator(), test.kr)
+			var actual []string
+			for ; rows.Valid(); rows.Next() {
+				actual = append(actual, string(rows.Key()))
+			}
+			if strings.Join(actual, ",") != test.expected {
+				t.Errorf("w %s g %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestInMemoryDB_ScanFilter(t *testing.T) {
+	db, err := gdb.New(
+		&gdb.TableOpts{
+			TableName: []byte("default"),
+			InMemory:  true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	values := map[string]string{
+		"a": "5", "b": "food", "c": "12", "d": "seafood", "e": "40", "f": "x",
+	}
+	for k, v := range values {
+		if err := db.Set([]byte(k), []byte(v)); err != nil {
+			t.Error(err)
+		}
+	}
+	greater := gdb.NewComparison(gdb.Greater, []byte("10"))
+	like := gdb.NewComparison(gdb.Like, []byte("%foo_"))
+	tests := map[string]struct {
+		kr       gdb.KeyRange
+		expected string
+	}{
+		"numeric": {
+			gdb.KeyRange{Filter: greater}, "c,e"},
+		"like": {
+			gdb.KeyRange{Filter: like}, "b,d"},
+		"or limit": {
+			gdb.KeyRange{Filter: gdb.NewLogical(gdb.Or, greater, like), Limit: 3}, "b,c,d"},
+		"not reverse": {
+			gdb.KeyRange{
+				Filter:  gdb.NewLogical(gdb.Not, gdb.NewLogical(gdb.Or, greater, like)),
+				Reverse: true,
+			}, "f,a"},
+		"equal in bounds": {
+			gdb.KeyRange{
+				Start: []byte("b"), End: []byte("e"),
+				Filter: gdb.NewComparison(gdb.NotEqual, []byte("food")),
+			}, "c,d,e"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			rows := gdb.NewRangeIterator(db.Iterator(), test.kr)
+			var actual []string
+			for ; rows.Valid(); rows.Next() {
+				actual = append(actual, string(rows.Key()))
+			}
+			if strings.Join(actual, ",") != test.expected {
+				t.Errorf("w %s g %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestInMemoryDB_DeleteRange(t *testing.T) {
+	db, err := gdb.New(
+		&gdb.TableOpts{
+			TableName: []byte("default"),
+			InMemory:  true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		if err := db.Set([]byte(k), []byte(k)); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.DeleteRange([]byte("b"), []byte("d")); err != nil {
+		t.Error(err)
+	}
+	if _, ok := db.Get([]byte("c")); ok {
+		t.Error("c should have been deleted")
+	}
+	if db.Count() != 2 {
+		t.Errorf("w 2 g %d", db.Count())
+	}
+	if err := db.Set([]byte("c"), []byte("c")); err != nil {
+		t.Error(err)
+	}
+	rows, _ := db.Scan(nil, nil)
+	var actual []string
+	for _, row := range rows {
+		actual = append(actual, string(row[0]))
+	}
+	if strings.Join(actual, "") != "ace" {
+		t.Errorf("w ace g %v", actual)
+	}
+}
+
+func TestFileDB_DeleteRange(t *testing.T) {
+	opts := &gdb.TableOpts{
+		TableName:     []byte("default"),
+		DataDir:       []byte(t.TempDir()),
+		WalMode:       true,
+		MergeOperator: gdb.Int64Add{},
+	}
+	scan := func(db gdb.Table) string {
+		rows, _ := db.Scan(nil, nil)
+		var actual []string
+		for _, row := range rows {
+			actual = append(actual, fmt.Sprintf("%s=%s", row[0], row[1]))
+		}
+		return strings.Join(actual, ",")
+	}
+	db, err := gdb.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		if err := db.Set([]byte(k), []byte(k)); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.Set([]byte("n"), []byte("0")); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.Merge([]byte("n"), []byte("2")); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.DeleteRange([]byte("b"), []byte("d")); err != nil {
+		t.Error(err)
+	}
+	if err := db.Set([]byte("c"), []byte("c2")); err != nil {
+		t.Error(err)
+	}
+	before := scan(db)
+	db.Close()
+
+	// when
+	reopened, err := gdb.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = reopened.Drop()
+		reopened.Close()
+	})
+	after := scan(reopened)
+
+	// then
+	if before != "a=a,c=c2,e=e,n=4" {
+		t.Errorf("w a=a,c=c2,e=e,n=4 g %s", before)
+	}
+	if after != before {
+		t.Errorf("w the log to replay to %s g %s", before, after)
+	}
+	if _, ok := reopened.Get([]byte("b")); ok {
+		t.Error("b should stay deleted")
+	}
+}
+
+func TestFileDB_Delete(t *testing.T) {
+	opts := &gdb.TableOpts{
+		TableName: []byte("default"),
+		DataDir:   []byte(t.TempDir()),
+		WalMode:   true,
+	}
+	db, err := gdb.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Set([]byte(k), []byte(k)); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := db.Delete([]byte("b")); err != nil {
+		t.Error(err)
+	}
+	db.Close()
+
+	// when
+	reopened, err := gdb.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = reopened.Drop()
+		reopened.Close()
+	})
+	rows, _ := reopened.Scan(nil, nil)
+
+	// then
+	if len(rows) != 2 || string(rows[0][0]) != "a" || string(rows[1][0]) != "c" {
+		t.Errorf("w a,c g %s", rows)
+	}
+	if _, ok := reopened.Get([]byte("b")); ok {
+		t.Error("b should stay deleted")
+	}
+}
+
+func TestFileDB_MissingDataDir(t *testing.T) {
+	_, err := gdb.New(&gdb.TableOpts{
+		TableName: []byte("default"),
+		DataDir:   []byte(filepath.Join(t.TempDir(), "missing")),
+		WalMode:   true,
+	})
+	if err == nil {
+		t.Error("expected an error opening a table in a missing data dir")
+	}
+}
+
+func TestJSONPath_Extract(t *testing.T) {
+	doc := []byte(`{"user": {"name": "ada", "first name": "<a>"}, "age": 36, "tags": ["x", null]}`)
+	tests := []struct {
+		path     string
+		text     bool
+		expected string
+		ok       bool
+	}{
+		{"$.user.name", true, "ada", true},
+		{"$.user.name", false, `"ada"`, true},
+		{`$.user["first name"]`, true, "<a>", true},
+		{"$.age", true, "36", true},
+		{"$.user", false, `{"first name":"<a>","name":"ada"}`, true},
+		{"$.tags[0]", true, "x", true},
+		{"$.tags[1]", false, "null", true},
+		{"$.tags[1]", true, "", false},
+		{"$.tags[2]", true, "", false},
+		{"$.missing", true, "", false},
+		{"$.age.value", true, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			path, err := gdb.ParseJSONPath(test.path, test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, ok := path.Extract(doc)
+			if ok != test.ok || string(actual) != test.expected {
+				t.Errorf("w %s %t g %s %t", test.expected, test.ok, actual, ok)
+			}
+		})
+	}
+	path, _ := gdb.ParseJSONPath("$.age", true)
+	if _, ok := path.Extract([]byte("not json")); ok {
+		t.Error("expected a value that is not json to extract nothing")
+	}
+	for _, invalid := range []string{"age", "$.", "$[x]", "$[1"} {
+		if _, err := gdb.ParseJSONPath(invalid, false); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	groupBy := &gdb.GroupBy{Separator: []byte(":"), Parts: 1}
+	agg := gdb.NewAggregator([]gdb.Aggregation{
+		{Func: gdb.AggCount},
+		{Func: gdb.AggMin, Arg: &gdb.Projection{Column: "value"}},
+		{Func: gdb.AggAvg, Arg: &gdb.Projection{Column: "value"}},
+	}, groupBy)
+	for key, value := range map[string]string{
+		"b:1": "3", "b:2": "x", "a:1": "1", "a:2": "-2", "c": "c",
+	} {
+		agg.Add([]byte(key), []byte(value))
+	}
+
+	var actual []string
+	for _, row := range agg.Rows() {
+		actual = append(actual, fmt.Sprintf("%s=%s/%s/%s", row[0], row[1], row[2], row[3]))
+	}
+	empty := gdb.NewAggregator([]gdb.Aggregation{{Func: gdb.AggSum, Arg: &gdb.Projection{Column: "value"}}}, nil).Rows()
+
+	if strings.Join(actual, ",") != "a=2/-2/-0.5,b=2/3/3,c=1//" {
+		t.Errorf("w a=2/-2/-0.5,b=2/3/3,c=1// g %s", strings.Join(actual, ","))
+	}
+	if len(empty) != 1 || empty[0][0] != nil {
+		t.Errorf("expected a single NULL sum g %q", empty)
+	}
+	if g := groupBy.Group([]byte("a:b:c")); string(g) != "a" {
+		t.Errorf("w a g %s", g)
+	}
+}
+
+func TestInMemoryDB_Trace(t *testing.T) {
+	db, err := gdb.New(&gdb.TableOpts{TableName: []byte("default"), InMemory: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := db.Set([]byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := new(gdb.ReadStats)
+	traced := db.Trace(stats)
+
+	// when
+	_, hit := traced.Get([]byte("b"))
+	_, miss := traced.Get([]byte("z"))
+	kr := gdb.KeyRange{Start: []byte("b"), Filter: gdb.NewComparison(gdb.Equal, []byte("d"))}
+	rows := gdb.NewRangeIteratorWithStats(traced.Iterator(), kr, stats)
+	var actual []string
+	for ; rows.Valid(); rows.Next() {
+		actual = append(actual, string(rows.Key()))
+	}
+	_ = rows.Close()
+
+	// then
+	if !hit || miss {
+		t.Errorf("w hit and miss g %t %t", hit, miss)
+	}
+	if strings.Join(actual, "") != "d" {
+		t.Errorf("w d g %v", actual)
+	}
+	// b, c and d are scanned and the filter reads each of their values
+	if stats.RowsScanned != 3 || stats.MemtableHits != 4 || stats.SSTables != 0 {
+		t.Errorf("unexpected stats %+v", *stats)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	query, _ := gdb.NewGetRangeQuery(context.Background(), []byte("default"), gdb.KeyRange{
+		Start:        []byte("a"),
+		End:          []byte("m"),
+		EndExclusive: true,
+		Filter:       gdb.NewComparison(gdb.Greater, []byte("1")),
+	})
+
+	var actual []string
+	for _, row := range gdb.Explain(query) {
+		actual = append(actual, fmt.Sprintf("%s=%s", row[0], row[1]))
+	}
+
+	expected := "table=default,access=range scan,bounds=[a, m),filter=value > '1'"
+	if strings.Join(actual, ",") != expected {
+		t.Errorf("w %s g %s", expected, strings.Join(actual, ","))
+	}
+}
@@ -2,7 +2,7 @@ package wal
 
 import (
 	"bufio"
-	"bytes"
+	"io"
 	"os"
 	"sync"
 
@@ -11,45 +11,153 @@ import (
 )
 
 type WAL struct {
-	mtx sync.Mutex
-	buf *bufio.Writer
+	mtx  sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+	// sync syncs the file after every record
+	sync bool
 }
 
-func New(f *os.File) *WAL {
+// New returns a WAL appending to f. With sync set every record is
+// synced to disk before the write returns.
+func New(f *os.File, sync bool) (*WAL, error) {
 	s, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	size := s.Size()
-	if size == 0 {
-		buf := bytes.NewBuffer(nil)
-		buf.Write(gfile.DatFileHeader(f.Name()))
-		_, err = f.Write(buf.Bytes())
-		if err != nil {
-			panic(err)
-		}
+	if s.Size() == 0 {
+		_, err = f.Write(gfile.DatFileHeader(f.Name()))
+	} else {
+		// records logged before the table was reopened are kept
+		_, err = f.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		return nil, err
 	}
 	return &WAL{
-		buf: bufio.NewWriter(f),
+		file: f,
+		buf:  bufio.NewWriter(f),
+		sync: sync,
+	}, nil
+}
+
+// Name returns the name of the log file
+func (ss *WAL) Name() string {
+	return ss.file.Name()
+}
+
+// Close flushes any buffered records and closes the log file
+func (ss *WAL) Close() error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	if err := ss.buf.Flush(); err != nil {
+		return err
 	}
+	return ss.file.Close()
 }
 
 var byteArena = make(garena.ByteArena, 0)
 
+// Op is the write a record logs
+type Op byte
+
+const (
+	OpSet Op = iota
+	OpMerge
+	OpDeleteRange
+	OpDelete
+)
+
+// Record is a write read back from the log. A DeleteRange record
+// holds its start and end in Key and Value; nil bounds are unbounded.
+type Record struct {
+	Op    Op
+	Key   []byte
+	Value []byte
+}
+
 func (ss *WAL) Set(k, v []byte) error {
+	return ss.append(OpSet, k, v)
+}
+
+// Merge logs a merge operand for k
+func (ss *WAL) Merge(k, operand []byte) error {
+	return ss.append(OpMerge, k, operand)
+}
+
+// DeleteRange logs a range tombstone for the keys between start and end
+func (ss *WAL) DeleteRange(start, end []byte) error {
+	return ss.append(OpDeleteRange, start, end)
+}
+
+// Delete logs a tombstone for k
+func (ss *WAL) Delete(k []byte) error {
+	return ss.append(OpDelete, k, nil)
+}
+
+func (ss *WAL) append(op Op, k, v []byte) error {
 	klen := len(k)
 	vlen := len(v)
-	encoded := byteArena.Allocate(klen + vlen + 1)
-	encoded[0] = byte(klen)
-	copy(encoded[1:klen+1], k)
-	copy(encoded[klen+1:], v)
+	encoded := byteArena.Allocate(klen + vlen + 2)
+	encoded[0] = byte(op)
+	encoded[1] = byte(klen)
+	copy(encoded[2:klen+2], k)
+	copy(encoded[klen+2:], v)
 	row, err := gfile.EncodeBlock(encoded)
 	if err != nil {
 		return err
 	}
 	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
 	_, _ = ss.buf.Write(row)
-	_ = ss.buf.Flush()
-	ss.mtx.Unlock()
-	return nil
+	if err = ss.buf.Flush(); err != nil || !ss.sync {
+		return err
+	}
+	return ss.file.Sync()
+}
+
+// Replay calls fnc with every record in the order they were logged.
+// A record torn by a crash ends the log.
+func (ss *WAL) Replay(fnc func(r Record) error) error {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	if err := ss.buf.Flush(); err != nil {
+		return err
+	}
+	s, err := ss.file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(ss.file, 0, s.Size()))
+	// skip the header line
+	if _, err = r.ReadBytes('\n'); err != nil {
+		return nil
+	}
+	for {
+		// a record is a length byte, which may be any byte, followed
+		// by a line of base64
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil
+		}
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil
+		}
+		raw, err := gfile.DecodeLine(string(append([]byte{n}, line[:len(line)-1]...)))
+		if err != nil || len(raw) < 2 || int(raw[1]) > len(raw)-2 {
+			return nil
+		}
+		klen := int(raw[1])
+		record := Record{Op: Op(raw[0]), Key: raw[2 : klen+2], Value: raw[klen+2:]}
+		if len(record.Key) == 0 {
+			record.Key = nil
+		}
+		if len(record.Value) == 0 && record.Op == OpDeleteRange {
+			record.Value = nil
+		}
+		if err = fnc(record); err != nil {
+			return err
+		}
+	}
 }
@@ -179,7 +179,7 @@ var byteArena = make(Arena, 4096*4096*4)
 
 // EncodeBlock encodes data in raw uuencoded format
 func EncodeBlock(data []byte) ([]byte, error) {
-	out := byteArena.Get(base64.StdEncoding.EncodedLen(len(data)) + 2)
+	out := byteArena.Get(encoding.EncodedLen(len(data)) + 2)
 	out[0] = byte(len(data))
 	encoding.Encode(out[1:], data)
 	out[len(out)-1] = byte('\n')
@@ -2,7 +2,10 @@ package http
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"sort"
 
 	glog "github.com/blong14/gache/internal/logging"
 	stdhttp "net/http"
@@ -22,3 +25,79 @@ func MustWriteJSON(w stdhttp.ResponseWriter, r *stdhttp.Request, status int, res
 	}
 	glog.Track("method=%s status=%v", r.Method, status)
 }
+
+// StreamJSON writes a JSON object whose field holds an array of the values
+// produced by next, followed by the fields returned from tail. Rows are
+// flushed as they are written so the full result is never held in memory.
+// next returns false once there are no more values; tail may be nil.
+func StreamJSON(
+	w stdhttp.ResponseWriter,
+	r *stdhttp.Request,
+	status int,
+	field string,
+	next func() (interface{}, bool),
+	tail func() map[string]interface{},
+) error {
+	w.Header().Set("Content-Type", "application/json")
+	if status >= stdhttp.StatusBadRequest {
+		w.WriteHeader(status)
+	}
+	flusher, _ := w.(stdhttp.Flusher)
+	encoder := json.NewEncoder(w)
+	if err := writeJSONKey(w, "{", field); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		value, ok := next()
+		if !ok {
+			break
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(value); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if _, err := io.WriteString(w, "]"); err != nil {
+		return err
+	}
+	if tail != nil {
+		fields := tail()
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := writeJSONKey(w, ",", k); err != nil {
+				return err
+			}
+			if err := encoder.Encode(fields[k]); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := io.WriteString(w, "}"); err != nil {
+		return err
+	}
+	glog.Track("method=%s status=%v", r.Method, status)
+	return nil
+}
+
+func writeJSONKey(w io.Writer, sep, key string) error {
+	k, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s:", sep, k)
+	return err
+}
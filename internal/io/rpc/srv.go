@@ -1,9 +1,14 @@
 package rpc
 
 import (
+	"bufio"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/rpc"
+	"time"
 )
 
 type Handler any
@@ -27,3 +32,27 @@ func Client(addr string) (*rpc.Client, error) {
 	}
 	return client, nil
 }
+
+// connected is the status a server started by Start answers CONNECT with
+const connected = "200 Connected to Go RPC"
+
+// ClientTimeout connects to the rpc server at addr like Client but
+// gives up when the connection is not made within timeout
+func ClientTimeout(addr string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	_, _ = io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != connected {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
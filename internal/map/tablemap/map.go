@@ -134,8 +134,88 @@ func (c *TableMap[K, V]) Range(fnc func(k K, v V) bool) {
 	}
 }
 
-// Remove removes a key value pair from the map
-func (c *TableMap[K, V]) Remove(_ K) (V, bool) { return *new(V), false } // nolint
+// First returns the entry with the least key
+func (c *TableMap[K, V]) First() (K, V, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.entry(0)
+}
+
+// Last returns the entry with the greatest key
+func (c *TableMap[K, V]) Last() (K, V, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.entry(c.size() - 1)
+}
+
+// Ceiling returns the entry with the least key greater than or equal to key
+func (c *TableMap[K, V]) Ceiling(key K) (K, V, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.entry(c.search(key))
+}
+
+// Higher returns the entry with the least key strictly greater than key
+func (c *TableMap[K, V]) Higher(key K) (K, V, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	j := c.search(key)
+	if c.equalto(key, uint(j)) {
+		j++
+	}
+	return c.entry(j)
+}
+
+// Lower returns the entry with the greatest key strictly less than key
+func (c *TableMap[K, V]) Lower(key K) (K, V, bool) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.entry(c.search(key) - 1)
+}
+
+func (c *TableMap[K, V]) entry(i int) (K, V, bool) {
+	if i < 0 || i >= c.size() {
+		return *new(K), *new(V), false // nolint
+	}
+	e := c.impl[i]
+	return e.Key.(K), e.Value.(V), true
+}
+
+// Remove removes a key value pair from the map and returns the removed value
+func (c *TableMap[K, V]) Remove(key K) (V, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	j := c.search(key)
+	if !c.equalto(key, uint(j)) {
+		return *new(V), false // nolint
+	}
+	value := c.impl[j].Value.(V)
+	copy(c.impl[j:], c.impl[j+1:])
+	c.impl[c.size()-1] = nil
+	c.impl = c.impl[:c.size()-1]
+	return value, true
+}
+
+// RemoveRange removes every entry with a key between start and end
+// inclusive and returns the number of entries removed
+func (c *TableMap[K, V]) RemoveRange(start, end K) int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	i := c.search(start)
+	j := c.search(end)
+	if c.equalto(end, uint(j)) {
+		j++
+	}
+	if j <= i {
+		return 0
+	}
+	n := copy(c.impl[i:], c.impl[j:])
+	for k := i + n; k < c.size(); k++ {
+		c.impl[k] = nil
+	}
+	c.impl = c.impl[:i+n]
+	return j - i
+}
 
 func (c *TableMap[K, V]) insertLast(el *MapEntry) {
 	c.impl = append(c.impl, el)
@@ -84,11 +84,101 @@ func testRange(t *testing.T) {
 	}
 }
 
+func testNavigation(t *testing.T) {
+	t.Parallel()
+	// given
+	tree := gtable.New[string, string](strings.Compare)
+	for _, key := range []string{"b", "d", "f"} {
+		tree.Set(key, key)
+	}
+
+	// then
+	tests := []struct {
+		name     string
+		fnc      func(string) (string, string, bool)
+		key      string
+		expected string
+		ok       bool
+	}{
+		{"ceiling hit", tree.Ceiling, "d", "d", true},
+		{"ceiling miss", tree.Ceiling, "c", "d", true},
+		{"ceiling past end", tree.Ceiling, "g", "", false},
+		{"higher", tree.Higher, "d", "f", true},
+		{"higher past end", tree.Higher, "f", "", false},
+		{"lower", tree.Lower, "d", "b", true},
+		{"lower before start", tree.Lower, "b", "", false},
+	}
+	for _, test := range tests {
+		k, _, ok := test.fnc(test.key)
+		if ok != test.ok || k != test.expected {
+			t.Errorf("%s: w %s g %s", test.name, test.expected, k)
+		}
+	}
+	if k, _, _ := tree.First(); k != "b" {
+		t.Errorf("first: w b g %s", k)
+	}
+	if k, _, _ := tree.Last(); k != "f" {
+		t.Errorf("last: w f g %s", k)
+	}
+}
+
+func testRemoveRange(t *testing.T) {
+	t.Parallel()
+	// given
+	tree := gtable.New[string, string](strings.Compare)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		tree.Set(key, key)
+	}
+
+	// when
+	removed := tree.RemoveRange("b", "d")
+
+	// then
+	if removed != 3 || tree.Size() != 2 {
+		t.Errorf("w 3 removed g %d size %d", removed, tree.Size())
+	}
+	if _, ok := tree.Get("c"); ok {
+		t.Error("c should have been removed")
+	}
+	if k, _, _ := tree.Higher("a"); k != "e" {
+		t.Errorf("higher: w e g %s", k)
+	}
+	if removed = tree.RemoveRange("f", "g"); removed != 0 {
+		t.Errorf("w 0 removed g %d", removed)
+	}
+}
+
+func testRemove(t *testing.T) {
+	t.Parallel()
+	// given
+	tree := gtable.New[string, string](strings.Compare)
+	for _, key := range []string{"a", "b", "c"} {
+		tree.Set(key, key)
+	}
+
+	// when
+	value, ok := tree.Remove("b")
+
+	// then
+	if !ok || value != "b" || tree.Size() != 2 {
+		t.Errorf("w b removed g %s %v size %d", value, ok, tree.Size())
+	}
+	if k, _, _ := tree.Higher("a"); k != "c" {
+		t.Errorf("higher: w c g %s", k)
+	}
+	if _, ok = tree.Remove("b"); ok {
+		t.Error("b was already removed")
+	}
+}
+
 func TestTableMap(t *testing.T) {
 	t.Parallel()
 
 	t.Run("get and set", testGetAndSet)
 	t.Run("range", testRange)
+	t.Run("navigation", testNavigation)
+	t.Run("remove", testRemove)
+	t.Run("remove range", testRemoveRange)
 }
 
 type bench struct {
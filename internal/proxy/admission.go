@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"errors"
+
+	gdb "github.com/blong14/gache/internal/db"
+)
+
+var (
+	// ErrBackpressure is returned when the queue for a query's priority class is full
+	ErrBackpressure = errors.New("query queue is full")
+	// ErrStopped is returned for the queries still queued when the pool stops
+	ErrStopped = errors.New("worker pool stopped")
+)
+
+// Priority is the class a query is admitted and scheduled under
+type Priority int
+
+const (
+	Interactive Priority = iota
+	Write
+	Bulk
+	Admin
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case Interactive:
+		return "Interactive"
+	case Write:
+		return "Write"
+	case Bulk:
+		return "Bulk"
+	case Admin:
+		return "Admin"
+	default:
+		return "unknown"
+	}
+}
+
+// queueDepth bounds how many queries of each class may wait to run
+var queueDepth = [numPriorities]int64{
+	Interactive: 1024,
+	Write:       1024,
+	Bulk:        64,
+	Admin:       16,
+}
+
+func priorityOf(inst gdb.QueryInstruction) Priority {
+	switch inst {
+	case gdb.AddTable, gdb.AlterTable, gdb.DropTable, gdb.InsertRange, gdb.ListTables, gdb.Load,
+		gdb.Print, gdb.TruncateTable:
+		return Admin
+	case gdb.Aggregate, gdb.BatchSetValue, gdb.JoinRange, gdb.Range:
+		return Bulk
+	case gdb.SetValue, gdb.Merge, gdb.DeleteRange:
+		return Write
+	default:
+		return Interactive
+	}
+}
@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	gdb "github.com/blong14/gache/internal/db"
+	glog "github.com/blong14/gache/internal/logging"
+)
+
+// flightGroup collapses concurrent calls for the same key into one
+type flightGroup struct {
+	mtx   sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done  chan struct{}
+	value []byte
+	err   error
+	// stale is set when the key is written while the call runs, so
+	// its result is not stored over the newer value
+	stale bool
+}
+
+// do calls fnc once for the concurrent calls with the same key and
+// stores its result unless the key was written meanwhile. fnc runs in
+// its own goroutine, so a caller whose ctx ends stops waiting for it
+// without failing the other callers.
+func (g *flightGroup) do(
+	ctx context.Context, key string, fnc func() ([]byte, error), store func([]byte) error,
+) ([]byte, error) {
+	g.mtx.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		call = &flight{done: make(chan struct{})}
+		g.calls[key] = call
+		go g.run(key, call, fnc, store)
+	}
+	g.mtx.Unlock()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.done:
+		return call.value, call.err
+	}
+}
+
+func (g *flightGroup) run(key string, call *flight, fnc func() ([]byte, error), store func([]byte) error) {
+	call.value, call.err = fnc()
+	g.mtx.Lock()
+	if call.err == nil && !call.stale {
+		call.err = store(call.value)
+	}
+	delete(g.calls, key)
+	g.mtx.Unlock()
+	close(call.done)
+}
+
+// forget keeps the call in flight for key from storing its result;
+// a nil key forgets every call in flight
+func (g *flightGroup) forget(key []byte) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	for k, call := range g.calls {
+		if key == nil || k == string(key) {
+			call.stale = true
+		}
+	}
+}
+
+// expiry tracks when the keys of a table with a TTL expire
+type expiry struct {
+	mtx      sync.Mutex
+	ttl      time.Duration
+	deadline map[string]time.Time
+	// swept is when the expired keys were last dropped; see sweep
+	swept time.Time
+}
+
+func newExpiry(ttl time.Duration) *expiry {
+	return &expiry{ttl: ttl, deadline: make(map[string]time.Time), swept: time.Now()}
+}
+
+func (e *expiry) touch(k []byte) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.ttl <= 0 {
+		return
+	}
+	e.deadline[string(k)] = time.Now().Add(e.ttl)
+}
+
+// setTTL changes the TTL of keys written from now on; a TTL of
+// zero also stops the keys already tracked from expiring
+func (e *expiry) setTTL(ttl time.Duration) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.ttl = ttl
+	if ttl <= 0 {
+		e.deadline = make(map[string]time.Time)
+	}
+}
+
+// expired returns true once, the first time k is seen past its deadline
+func (e *expiry) expired(k []byte) bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.ttl <= 0 {
+		return false
+	}
+	deadline, ok := e.deadline[string(k)]
+	if !ok || time.Now().Before(deadline) {
+		return false
+	}
+	delete(e.deadline, string(k))
+	return true
+}
+
+// passed returns true while k is past its deadline; scans use it to
+// hide the keys they find expired
+func (e *expiry) passed(k []byte) bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	deadline, ok := e.deadline[string(k)]
+	return ok && !time.Now().Before(deadline)
+}
+
+// sweep calls drop with the keys past their deadline and stops
+// tracking them, at most once per TTL. It holds the lock while drop
+// runs, so a key touched before it is written is not dropped.
+func (e *expiry) sweep(drop func(k []byte)) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	now := time.Now()
+	if e.ttl <= 0 || now.Sub(e.swept) < e.ttl {
+		return
+	}
+	e.swept = now
+	for k, deadline := range e.deadline {
+		if !now.Before(deadline) {
+			drop([]byte(k))
+			delete(e.deadline, k)
+		}
+	}
+}
+
+// reader returns the table reads go through; reads count their work
+// in stats when it is set
+func (va *Table) reader(stats *gdb.ReadStats) gdb.Table {
+	if stats == nil {
+		return va.impl
+	}
+	return va.impl.Trace(stats)
+}
+
+// scan returns an iterator over the table that hides expired keys,
+// counting its work in stats when it is set
+func (va *Table) scan(stats *gdb.ReadStats) gdb.Iterator {
+	return gdb.NewSkipIterator(va.reader(stats).Iterator(), va.expiry.passed)
+}
+
+// get reads k from the table, dropping it first if its TTL has passed
+func (va *Table) get(k []byte, stats *gdb.ReadStats) ([]byte, bool) {
+	if va.expiry.expired(k) {
+		_ = va.impl.Delete(k)
+		return nil, false
+	}
+	value, ok := va.reader(stats).Get(k)
+	if ok && stats != nil {
+		stats.RowsScanned++
+		stats.CacheHits++
+	}
+	return value, ok
+}
+
+// load reads k through the table's Loader; concurrent loads of the
+// same key share a single call, which is not bound to ctx so one
+// caller giving up does not fail the others
+func (va *Table) load(ctx context.Context, k []byte) ([]byte, bool, error) {
+	if va.loader == nil {
+		return nil, false, nil
+	}
+	value, err := va.loads.do(ctx, string(k), func() ([]byte, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), gdb.DefaultTimeout)
+		defer cancel()
+		return va.loader.Load(ctx, va.name, k)
+	}, func(value []byte) error {
+		va.touch(k)
+		return va.impl.Set(k, value)
+	})
+	switch {
+	case errors.Is(err, gdb.ErrKeyNotFound):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, err
+	default:
+		return value, true, nil
+	}
+}
+
+// touch restarts k's TTL before it is written, dropping the keys whose
+// TTL has passed once a TTL has gone by since they were last dropped
+func (va *Table) touch(k []byte) {
+	va.expiry.touch(k)
+	va.expiry.sweep(func(k []byte) {
+		_ = va.impl.Delete(k)
+	})
+}
+
+// set writes k to the table and hands it to the table's Writer
+func (va *Table) set(ctx context.Context, k, v []byte) error {
+	if va.writer != nil && va.writeMode == gdb.WriteThrough {
+		if err := va.writer.Write(ctx, va.name, k, v); err != nil {
+			return err
+		}
+	}
+	va.loads.forget(k)
+	va.touch(k)
+	if err := va.impl.Set(k, v); err != nil {
+		return fmt.Errorf("%w: %s", gdb.ErrWriteFailed, err)
+	}
+	if va.writer != nil && va.writeMode == gdb.WriteBehind {
+		va.behind <- gdb.KeyValue{Key: k, Value: v}
+	}
+	return nil
+}
+
+// getMany reads keys from the table, returning the ones it is missing
+func (va *Table) getMany(keys [][]byte, stats *gdb.ReadStats) ([]gdb.KeyValue, [][]byte) {
+	for _, k := range keys {
+		if va.expiry.expired(k) {
+			_ = va.impl.Delete(k)
+		}
+	}
+	values := va.reader(stats).GetMany(keys)
+	if stats != nil {
+		stats.RowsScanned += uint(len(values))
+		stats.CacheHits += uint(len(values))
+	}
+	if len(values) == len(keys) {
+		return values, nil
+	}
+	found := make(map[string]struct{}, len(values))
+	for _, kv := range values {
+		found[string(kv.Key)] = struct{}{}
+	}
+	var missing [][]byte
+	for _, k := range keys {
+		if _, ok := found[string(k)]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	return values, missing
+}
+
+// loadMany loads the missing keys through the table's Loader and
+// returns them with values in the order of keys
+func (va *Table) loadMany(ctx context.Context, keys [][]byte, values []gdb.KeyValue, missing [][]byte) ([]gdb.KeyValue, error) {
+	found := make(map[string][]byte, len(keys))
+	for _, kv := range values {
+		found[string(kv.Key)] = kv.Value
+	}
+	for _, k := range missing {
+		value, ok, err := va.load(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found[string(k)] = value
+		}
+	}
+	values = make([]gdb.KeyValue, 0, len(found))
+	for _, k := range keys {
+		if value, ok := found[string(k)]; ok {
+			values = append(values, gdb.KeyValue{Key: k, Value: value})
+		}
+	}
+	return values, nil
+}
+
+// merge applies operand to k, hands the merged value to the table's
+// Writer and returns it
+func (va *Table) merge(ctx context.Context, k, operand []byte) ([]byte, error) {
+	if va.expiry.expired(k) {
+		// operands apply to an expired value as to a missing one
+		_ = va.impl.Delete(k)
+	}
+	va.loads.forget(k)
+	va.touch(k)
+	value, err := va.impl.Merge(k, operand)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case va.writer == nil:
+	case va.writeMode == gdb.WriteBehind:
+		va.behind <- gdb.KeyValue{Key: k, Value: value}
+	default:
+		err = va.writer.Write(ctx, va.name, k, value)
+	}
+	return value, err
+}
+
+// writeBehind drains queued writes into the table's Writer until Stop
+func (va *Table) writeBehind() {
+	defer close(va.flushed)
+	for kv := range va.behind {
+		err := va.writer.Write(context.Background(), va.name, kv.Key, kv.Value)
+		if err != nil {
+			glog.Track("%s write behind %s failed: %s", va.name, kv.Key, err)
+		}
+	}
+}
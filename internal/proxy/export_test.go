@@ -0,0 +1,29 @@
+package proxy
+
+// Refs returns the number of references held on the table
+func (va *Table) Refs() int {
+	va.refs.mu.Lock()
+	defer va.refs.mu.Unlock()
+	return va.refs.n
+}
+
+// Drained returns a channel closed once a dropped or truncated table
+// was released by every query and iterator, or nil before it is freed
+func (va *Table) Drained() <-chan struct{} {
+	va.refs.mu.Lock()
+	defer va.refs.mu.Unlock()
+	return va.refs.drained
+}
+
+// SetWorkers gives a pool that has not started n workers
+func (w *WorkPool) SetWorkers(n int) {
+	w.queues = make([]*queue, n)
+	for i := range w.queues {
+		w.queues[i] = newQueue()
+	}
+}
+
+// Owner returns the index of the worker that runs the queries for key
+func (w *WorkPool) Owner(table, key []byte) int {
+	return w.owner(table, key)
+}
@@ -4,18 +4,26 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"hash/fnv"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	gdb "github.com/blong14/gache/internal/db"
+	gerrors "github.com/blong14/gache/internal/errors"
 	glog "github.com/blong14/gache/internal/logging"
 	gtable "github.com/blong14/gache/internal/map/tablemap"
 )
 
 type Worker struct {
-	id    string
+	id string
+	// index is the worker's position in the pool's queues; the control
+	// worker has none
+	index int
+	// inbox carries Admin queries to the control worker
 	inbox <-chan *gdb.Query
+	queue *queue
 	stop  chan interface{}
 	pool  *WorkPool
 }
@@ -23,23 +31,87 @@ type Worker struct {
 func (s *Worker) Start(ctx context.Context) {
 	glog.Track("%T::%s starting", s.pool, s.id)
 	for {
+		t, ok := s.next(ctx)
+		if !ok {
+			return
+		}
+		if !s.run(ctx, t) {
+			return
+		}
+	}
+}
+
+// run executes t; a barrier's query is only run by its owner, once
+// every other worker has reached the barrier. It returns false when
+// the worker was stopped while waiting at a barrier.
+func (s *Worker) run(ctx context.Context, t *task) bool {
+	query := t.query
+	if b := t.barrier; b != nil {
+		if b.owner != s.index {
+			b.arrived <- struct{}{}
+			select {
+			case <-ctx.Done():
+				return false
+			case <-s.stop:
+				glog.Track("%T::%s stopping at a barrier", s.pool, s.id)
+				return false
+			case <-b.done:
+				return true
+			}
+		}
+		defer close(b.done)
+		for n := cap(b.arrived); n > 0; n-- {
+			select {
+			case <-ctx.Done():
+				s.pool.answer(t, ctx.Err())
+				return false
+			case <-s.stop:
+				glog.Track("%T::%s stopping at a barrier", s.pool, s.id)
+				s.pool.answer(t, ErrStopped)
+				return false
+			case <-b.arrived:
+			}
+		}
+	}
+	if t.admitted {
+		s.pool.release(query)
+	}
+	if err := query.Err(); err != nil {
+		// the caller has given up on queries that expired while queued
+		query.Done(gdb.QueryResponse{Err: err})
+		return true
+	}
+	start := time.Now()
+	s.pool.Execute(ctx, query)
+	glog.Track(
+		"%T::%s executed %s %s [%s]",
+		s.pool, s.id, query.Header.Inst, query.Key, time.Since(start),
+	)
+	return true
+}
+
+// next returns the next task to run, waiting for one to be queued
+func (s *Worker) next(ctx context.Context) (*task, bool) {
+	var ready chan struct{}
+	if s.queue != nil {
+		ready = s.queue.ready
+	}
+	for {
+		if s.queue != nil {
+			if t := s.queue.pop(); t != nil {
+				return t, true
+			}
+		}
 		select {
 		case <-ctx.Done():
 			glog.Track("%T::%s ctx canceled", s.pool, s.id)
-			return
+			return nil, false
 		case <-s.stop:
 			glog.Track("%T::%s stopping", s.pool, s.id)
-			return
+			return nil, false
 		case query, ok := <-s.inbox:
-			if !ok {
-				return
-			}
-			start := time.Now()
-			s.pool.Execute(ctx, query)
-			glog.Track(
-				"%T::%s executed %s %s [%s]",
-				s.pool, s.id, query.Header.Inst, query.Key, time.Since(start),
-			)
+			return &task{query: query, admitted: true}, ok
+		case <-ready:
 		}
 	}
 }
@@ -51,26 +123,73 @@ func (s *Worker) Stop(ctx context.Context) {
 	}
 }
 
+// task is a query queued for a worker, or a worker's part in a barrier
+type task struct {
+	query *gdb.Query
+	// keys are the table and keys the query writes or reads; see queue
+	keys []string
+	// admitted is set on the task holding the query's queue slot
+	admitted bool
+	barrier  *barrier
+}
+
+// barrier runs a query once every worker has run the tasks queued
+// before it, so a query spanning many keys runs in order with the
+// queries for each of them
+type barrier struct {
+	// owner is the index of the worker that runs the query
+	owner int
+	// arrived has room for every other worker to signal it reached
+	// the barrier
+	arrived chan struct{}
+	done    chan struct{}
+}
+
 type WorkPool struct {
+	// inbox carries Admin queries to the control worker
 	inbox chan *gdb.Query
+	// queues carry every other query; one per worker
+	queues []*queue
+	// barriers orders the barriers queued on every worker
+	barriers sync.Mutex
+	// pending counts the queries of each priority waiting to run
+	pending [numPriorities]int64
 	// table name to table view
 	tables  *gtable.TableMap[[]byte, *Table]
 	workers []Worker
+	// defaults returns the options of a table created without any
+	defaults func(name []byte) *gdb.TableOpts
 }
 
 func NewWorkPool(inbox chan *gdb.Query) *WorkPool {
+	queues := make([]*queue, runtime.NumCPU())
+	for i := range queues {
+		queues[i] = newQueue()
+	}
 	return &WorkPool{
-		inbox:   inbox,
-		tables:  gtable.New[[]byte, *Table](bytes.Compare),
-		workers: make([]Worker, 0),
+		inbox:    inbox,
+		queues:   queues,
+		tables:   gtable.New[[]byte, *Table](bytes.Compare),
+		workers:  make([]Worker, 0),
+		defaults: gdb.DefaultTableOpts,
 	}
 }
 
 func (w *WorkPool) Start(ctx context.Context) {
-	for i := 0; i < runtime.NumCPU(); i++ {
+	control := Worker{
+		id:    "worker::control",
+		index: -1,
+		inbox: w.inbox,
+		stop:  make(chan interface{}),
+		pool:  w,
+	}
+	w.workers = append(w.workers, control)
+	go control.Start(ctx)
+	for i := range w.queues {
 		worker := Worker{
 			id:    fmt.Sprintf("worker::%d", i),
-			inbox: w.inbox,
+			index: i,
+			queue: w.queues[i],
 			stop:  make(chan interface{}),
 			pool:  w,
 		}
@@ -79,45 +198,328 @@ func (w *WorkPool) Start(ctx context.Context) {
 	}
 }
 
+// Send admits query under its priority class and routes it to a worker.
+// Admin queries go to the control worker; every other query is hashed by
+// table and key onto a worker, whose queue runs the queries for a key in
+// the order they were sent. A batch is split by the worker owning each of
+// its keys and a range delete runs behind a barrier on every worker.
+// Range reads are hashed by table. A query whose class is already full
+// is answered with ErrBackpressure instead of waiting.
 func (w *WorkPool) Send(ctx context.Context, query *gdb.Query) {
-	select {
-	case <-ctx.Done():
-	case w.inbox <- query:
+	p := priorityOf(query.Header.Inst)
+	if atomic.AddInt64(&w.pending[p], 1) > queueDepth[p] {
+		atomic.AddInt64(&w.pending[p], -1)
+		query.Done(gdb.QueryResponse{Err: ErrBackpressure})
+		return
+	}
+	switch {
+	case p == Admin:
+		select {
+		case <-ctx.Done():
+			atomic.AddInt64(&w.pending[p], -1)
+		case w.inbox <- query:
+		}
+	case query.Header.Inst == gdb.DeleteRange:
+		w.sendBarrier(p, query)
+	case query.Header.Inst == gdb.BatchSetValue:
+		w.sendBatch(p, query)
+	default:
+		key := query.Key
+		if key == nil && len(query.Values) > 0 {
+			key = query.Values[0].Key
+		}
+		t := &task{query: query, admitted: true}
+		if key != nil {
+			t.keys = []string{taskKey(query.Header.TableName, key)}
+		}
+		w.queues[w.owner(query.Header.TableName, key)].push(t, p)
+	}
+}
+
+// sendBarrier queues query behind a barrier on every worker. The
+// barriers are queued under a lock so every worker reaches them in
+// the same order.
+func (w *WorkPool) sendBarrier(p Priority, query *gdb.Query) {
+	b := &barrier{
+		owner:   w.owner(query.Header.TableName, query.KeyRange.Start),
+		arrived: make(chan struct{}, len(w.queues)-1),
+		done:    make(chan struct{}),
+	}
+	w.barriers.Lock()
+	defer w.barriers.Unlock()
+	for i, q := range w.queues {
+		q.push(&task{query: query, admitted: i == b.owner, barrier: b}, p)
+	}
+}
+
+// sendBatch splits a batch by the worker owning each of its keys and
+// answers query once every part is written
+func (w *WorkPool) sendBatch(p Priority, query *gdb.Query) {
+	parts := make([][]gdb.KeyValue, len(w.queues))
+	owners, last := 0, 0
+	for _, kv := range query.Values {
+		i := w.owner(query.Header.TableName, kv.Key)
+		if parts[i] == nil {
+			owners++
+		}
+		parts[i] = append(parts[i], kv)
+		last = i
+	}
+	if owners <= 1 {
+		w.queues[last].push(&task{query: query, keys: batchKeys(query), admitted: true}, p)
+		return
+	}
+	dones := make([]chan gdb.QueryResponse, 0, owners)
+	admitted := true
+	for i, rows := range parts {
+		if rows == nil {
+			continue
+		}
+		part, done := gdb.NewBatchSetValueQuery(query.Context(), query.Header.TableName, rows)
+		w.queues[i].push(&task{query: part, keys: batchKeys(part), admitted: admitted}, p)
+		admitted = false
+		dones = append(dones, done)
+	}
+	go func() {
+		var count uint
+		var errs *gerrors.Error
+		for _, done := range dones {
+			select {
+			case <-query.Context().Done():
+				errs = gerrors.Append(errs, query.Context().Err())
+			case resp := <-done:
+				count += resp.Stats.Count
+				errs = gerrors.Append(errs, resp.Err)
+			}
+		}
+		resp := gdb.QueryResponse{Err: errs.ErrorOrNil()}
+		if resp.Err == nil {
+			resp = gdb.QueryResponse{
+				Stats: gdb.QueryStats{
+					Count: count,
+				},
+				Success: true,
+			}
+		}
+		query.Done(resp)
+	}()
+}
+
+// taskKey identifies key of table in a queue
+func taskKey(table, key []byte) string {
+	return string(table) + "\x00" + string(key)
+}
+
+func batchKeys(query *gdb.Query) []string {
+	keys := make([]string, 0, len(query.Values))
+	for _, kv := range query.Values {
+		keys = append(keys, taskKey(query.Header.TableName, kv.Key))
+	}
+	return keys
+}
+
+// answer fails the query of a task that will not run
+func (w *WorkPool) answer(t *task, err error) {
+	if t.admitted {
+		w.release(t.query)
 	}
+	t.query.Done(gdb.QueryResponse{Err: err})
+}
+
+// release frees the queue slot query held once a worker picks it up
+func (w *WorkPool) release(query *gdb.Query) {
+	atomic.AddInt64(&w.pending[priorityOf(query.Header.Inst)], -1)
+}
+
+// owner returns the index of the worker that runs the queries for key
+func (w *WorkPool) owner(table, key []byte) int {
+	h := fnv.New32a()
+	_, _ = h.Write(table)
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(len(w.queues)))
 }
 
 func (w *WorkPool) Execute(ctx context.Context, query *gdb.Query) {
 	switch query.Header.Inst {
 	case gdb.AddTable:
-		var opts *gdb.TableOpts
-		if query.Header.Opts != nil {
-			opts = query.Header.Opts
-		} else {
-			opts = &gdb.TableOpts{
-				InMemory:  true,
-				WalMode:   false,
-				DataDir:   []byte("testdata"),
-				TableName: query.Header.TableName,
+		opts := query.Header.Opts
+		if opts == nil {
+			opts = w.defaults(query.Header.TableName)
+			// reopen a file backed table with the options it was created with
+			if stored, err := gdb.LoadTableOpts(opts.DataDir, opts.TableName); err == nil {
+				opts = stored
 			}
 		}
-		t := NewTable(opts)
+		if opts.TableName == nil {
+			opts.TableName = query.Header.TableName
+		}
+		if err := opts.Validate(); err != nil {
+			query.Done(gdb.QueryResponse{Err: err})
+			return
+		}
+		t, err := NewTable(opts)
+		if err != nil {
+			query.Done(gdb.QueryResponse{Err: fmt.Errorf("%w: %s", gdb.ErrWriteFailed, err)})
+			return
+		}
 		w.tables.Set(query.Header.TableName, t)
 		query.Done(gdb.QueryResponse{Success: true})
+	case gdb.AlterTable:
+		table, ok := w.tables.Get(query.Header.TableName)
+		if !ok {
+			query.Done(gdb.QueryResponse{Err: gdb.ErrTableNotFound})
+			return
+		}
+		opts, err := table.options().Alter(query.Values)
+		if err != nil {
+			query.Done(gdb.QueryResponse{Err: err})
+			return
+		}
+		if err = table.alter(opts); err != nil {
+			query.Done(gdb.QueryResponse{Err: fmt.Errorf("%w: %s", gdb.ErrWriteFailed, err)})
+			return
+		}
+		query.Done(gdb.QueryResponse{Success: true})
+	case gdb.DropTable:
+		table, ok := w.tables.Remove(query.Header.TableName)
+		if !ok {
+			query.Done(gdb.QueryResponse{Err: gdb.ErrTableNotFound})
+			return
+		}
+		if err := table.Drop(); err != nil {
+			query.Done(gdb.QueryResponse{Err: fmt.Errorf("%w: %s", gdb.ErrWriteFailed, err)})
+			return
+		}
+		query.Done(gdb.QueryResponse{Success: true})
+	case gdb.TruncateTable:
+		table, ok := w.tables.Get(query.Header.TableName)
+		if !ok {
+			query.Done(gdb.QueryResponse{Err: gdb.ErrTableNotFound})
+			return
+		}
+		count := table.impl.Count()
+		// the files are deleted before the table is recreated so the new
+		// table starts from empty files; queries see the old table until
+		// the new one replaces it
+		err := table.impl.Drop()
+		if err == nil {
+			var truncated *Table
+			if truncated, err = NewTable(table.options()); err == nil {
+				w.tables.Set(query.Header.TableName, truncated)
+			}
+		}
+		if err != nil {
+			w.tables.Remove(query.Header.TableName)
+		}
+		table.free()
+		if err != nil {
+			query.Done(gdb.QueryResponse{Err: fmt.Errorf("%w: %s", gdb.ErrWriteFailed, err)})
+			return
+		}
+		query.Done(
+			gdb.QueryResponse{
+				Stats: gdb.QueryStats{
+					Count: uint(count),
+				},
+				Success: true,
+			},
+		)
+	case gdb.ListTables:
+		var values [][][]byte
+		w.tables.Range(func(k []byte, table *Table) bool {
+			storage := "memory"
+			if opts := table.options(); !opts.InMemory {
+				storage = string(opts.DataDir)
+			}
+			values = append(values, [][]byte{k, []byte(storage)})
+			return true
+		})
+		query.Done(
+			gdb.QueryResponse{
+				RangeValues: values,
+				Stats: gdb.QueryStats{
+					Count: uint(len(values)),
+				},
+				Success: true,
+			},
+		)
 	case gdb.Load:
 		glog.Track(
 			"loading csv %s for %s", query.Header.FileName, query.Header.TableName)
-		loader := NewCSVReader(w)
-		loader.Read(ctx, query)
+		// loads write through the data workers, so they run off the
+		// control worker to keep it free for other Admin queries
+		go func() {
+			ctx, cancel := queryContext(query)
+			defer cancel()
+			NewCSVReader(w).Read(ctx, query)
+		}()
+	case gdb.JoinRange:
+		table, ok := w.table(query.Header.TableName)
+		if !ok {
+			query.Done(gdb.QueryResponse{Err: gdb.ErrTableNotFound})
+			return
+		}
+		defer table.refs.release()
+		joined, ok := w.table(query.Join.Table)
+		if !ok {
+			query.Done(gdb.QueryResponse{Err: gdb.ErrTableNotFound})
+			return
+		}
+		defer joined.refs.release()
+		table.join(joined, query)
+	case gdb.InsertRange:
+		src, ok := w.table(query.Header.Source)
+		if !ok {
+			query.Done(gdb.QueryResponse{Err: gdb.ErrTableNotFound})
+			return
+		}
+		if _, found := w.tables.Get(query.Header.TableName); !found {
+			src.refs.release()
+			query.Done(gdb.QueryResponse{Err: gdb.ErrTableNotFound})
+			return
+		}
+		go func() {
+			defer src.refs.release()
+			ctx, cancel := queryContext(query)
+			defer cancel()
+			NewRangeCopier(w).Copy(ctx, src, query)
+		}()
 	default:
-		table, ok := w.tables.Get(query.Header.TableName)
+		table, ok := w.table(query.Header.TableName)
 		if !ok {
-			query.Done(gdb.QueryResponse{Success: false})
+			query.Done(gdb.QueryResponse{Err: gdb.ErrTableNotFound})
 			return
 		}
+		defer table.refs.release()
 		table.Execute(ctx, query)
 	}
 }
 
+// queryContext returns the context of a query run off its worker,
+// which ends when the caller gives up or the query's deadline passes
+func queryContext(query *gdb.Query) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(query.Context(), query.Deadline())
+}
+
+// table returns the named table with a reference taken on it, which
+// the caller releases once it is done with the table
+func (w *WorkPool) table(name []byte) (*Table, bool) {
+	for {
+		table, ok := w.tables.Get(name)
+		if !ok {
+			return nil, false
+		}
+		if table.refs.acquire() {
+			return table, true
+		}
+		// the table was dropped since it was looked up; a truncated
+		// table has been replaced by the new one
+		if current, ok := w.tables.Get(name); !ok || current == table {
+			return nil, false
+		}
+	}
+}
+
 func (w *WorkPool) WaitAndStop(ctx context.Context) {
 	glog.Track("%T stopping...\n", w)
 	var wg sync.WaitGroup
@@ -130,6 +532,14 @@ func (w *WorkPool) WaitAndStop(ctx context.Context) {
 		}(worker)
 	}
 	wg.Wait()
+	// answer the queries no worker will run
+	for i, q := range w.queues {
+		for t := q.pop(); t != nil; t = q.pop() {
+			if t.barrier == nil || t.barrier.owner == i {
+				w.answer(t, ErrStopped)
+			}
+		}
+	}
 	w.tables.Range(func(k []byte, table *Table) bool {
 		table.Stop()
 		return true
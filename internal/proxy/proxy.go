@@ -13,10 +13,18 @@ type QueryProxy struct {
 }
 
 func NewQueryProxy() (*QueryProxy, error) {
-	inbox := make(chan *gdb.Query)
+	return NewQueryProxyWithDefaults(gdb.DefaultTableOpts)
+}
+
+// NewQueryProxyWithDefaults returns a proxy that creates tables
+// added without options with the options returned by defaults
+func NewQueryProxyWithDefaults(defaults func(name []byte) *gdb.TableOpts) (*QueryProxy, error) {
+	inbox := make(chan *gdb.Query, queueDepth[Admin])
+	pool := NewWorkPool(inbox)
+	pool.defaults = defaults
 	return &QueryProxy{
 		inbox: inbox,
-		pool:  NewWorkPool(inbox),
+		pool:  pool,
 	}, nil
 }
 
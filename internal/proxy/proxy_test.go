@@ -3,10 +3,12 @@ package proxy_test
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -56,7 +58,10 @@ func TestQueryProxy_Execute(t *testing.T) {
 	query.Header.TableName = []byte("default")
 	query.Header.Inst = gdb.Count
 	qp.Send(ctx, query)
-	resp := query.GetResponse()
+	resp, err := query.GetResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
 	t.Logf("count %d", resp.Stats.Count)
 }
 
@@ -125,3 +130,490 @@ func randomKey(rng *rand.Rand, b []byte) []byte {
 	binary.LittleEndian.PutUint32(b[4:], key2)
 	return b
 }
+
+func TestQueryProxy_KeyOrdering(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	qp, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Error(err)
+	}
+	gproxy.StartProxy(ctx, qp)
+	t.Cleanup(func() {
+		gproxy.StopProxy(ctx, qp)
+		cancel()
+	})
+
+	// given
+	table := []byte("default")
+	for _, key := range []string{"a", "b", "c"} {
+		for i := 0; i < 100; i++ {
+			query, _ := gdb.NewSetValueQuery(
+				ctx, table, []byte(key), []byte(fmt.Sprintf("%d", i)))
+			qp.Send(ctx, query)
+		}
+	}
+
+	// then
+	for _, key := range []string{"a", "b", "c"} {
+		query, _ := gdb.NewGetValueQuery(ctx, table, []byte(key))
+		qp.Send(ctx, query)
+		resp, err := query.GetResponse(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp.Value) != "99" {
+			t.Errorf("%s: w 99 g %s", key, resp.Value)
+		}
+	}
+}
+
+func TestQueryProxy_BatchAndDeleteRangeOrdering(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	qp, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Error(err)
+	}
+	gproxy.StartProxy(ctx, qp)
+	t.Cleanup(func() {
+		gproxy.StopProxy(ctx, qp)
+		cancel()
+	})
+
+	// given
+	table := []byte("ordered")
+	query, done := gdb.NewAddTableQuery(ctx, table)
+	query.Header.Opts = &gdb.TableOpts{TableName: table, InMemory: true}
+	qp.Send(ctx, query)
+	<-done
+	var rows []gdb.KeyValue
+	for i := 0; i < 64; i++ {
+		k := []byte(fmt.Sprintf("k%02d", i))
+		rows = append(rows, gdb.KeyValue{Key: k, Value: k})
+	}
+
+	// when
+	batch, batched := gdb.NewBatchSetValueQuery(ctx, table, rows)
+	qp.Send(ctx, batch)
+	read, _ := gdb.NewGetValueQuery(ctx, table, []byte("k63"))
+	qp.Send(ctx, read)
+	for _, k := range []string{"k05", "k20", "k40"} {
+		query, _ = gdb.NewSetValueQuery(ctx, table, []byte(k), []byte("set"))
+		qp.Send(ctx, query)
+	}
+	query, _ = gdb.NewDeleteRangeQuery(ctx, table, []byte("k00"), []byte("k31"))
+	qp.Send(ctx, query)
+	query, set := gdb.NewSetValueQuery(ctx, table, []byte("k10"), []byte("again"))
+	qp.Send(ctx, query)
+	<-set
+	written := <-batched
+	readBack, err := read.GetResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _ = gdb.NewGetRangeQuery(ctx, table, gdb.KeyRange{})
+	qp.Send(ctx, query)
+	resp, err := query.GetResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for ; resp.Rows.Valid(); resp.Rows.Next() {
+		keys = append(keys, string(resp.Rows.Key()))
+	}
+	_ = resp.Rows.Close()
+
+	// then
+	if !written.Success || written.Stats.Count != 64 {
+		t.Errorf("w 64 rows written g %d %v", written.Stats.Count, written.Err)
+	}
+	if string(readBack.Value) != "k63" {
+		t.Errorf("a read sent after a batch should see it g %v", readBack.Err)
+	}
+	if len(keys) != 33 || keys[0] != "k10" || keys[1] != "k32" {
+		t.Errorf("w k10 and k32 to k63 g %v", keys)
+	}
+}
+
+func TestQueryProxy_DropAndTruncate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	qp, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Error(err)
+	}
+	gproxy.StartProxy(ctx, qp)
+	t.Cleanup(func() {
+		gproxy.StopProxy(ctx, qp)
+		cancel()
+	})
+	send := func(query *gdb.Query) *gdb.QueryResponse {
+		qp.Send(ctx, query)
+		resp, err := query.GetResponse(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// given
+	dir := t.TempDir()
+	table := []byte("files")
+	query, _ := gdb.NewAddTableQuery(ctx, table)
+	query.Header.Opts = &gdb.TableOpts{
+		TableName: table,
+		DataDir:   []byte(dir),
+		WalMode:   true,
+	}
+	send(query)
+	query, _ = gdb.NewSetValueQuery(ctx, table, []byte("key"), []byte("value"))
+	send(query)
+
+	// when
+	query, _ = gdb.NewTruncateTableQuery(ctx, table)
+	truncated := send(query)
+	query, _ = gdb.NewGetValueQuery(ctx, table, []byte("key"))
+	afterTruncate := send(query)
+	query, _ = gdb.NewDropTableQuery(ctx, table)
+	dropped := send(query)
+	query, _ = gdb.NewListTablesQuery(ctx)
+	tables := send(query)
+
+	// then
+	if !truncated.Success || !errors.Is(afterTruncate.Err, gdb.ErrKeyNotFound) {
+		t.Errorf("expected an empty table after truncate %v", afterTruncate)
+	}
+	if !dropped.Success {
+		t.Errorf("expected the table to be dropped %v", dropped.Err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the table's files to be deleted %v", files)
+	}
+	for _, kv := range tables.RangeValues {
+		if string(kv[0]) == "files" {
+			t.Error("a dropped table should not be listed")
+		}
+	}
+	query, _ = gdb.NewDropTableQuery(ctx, table)
+	if resp := send(query); !errors.Is(resp.Err, gdb.ErrTableNotFound) {
+		t.Errorf("w ErrTableNotFound g %v", resp.Err)
+	}
+}
+
+func TestQueryProxy_DropWithOpenRows(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	qp, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Error(err)
+	}
+	gproxy.StartProxy(ctx, qp)
+	t.Cleanup(func() {
+		gproxy.StopProxy(ctx, qp)
+		cancel()
+	})
+	send := func(query *gdb.Query) *gdb.QueryResponse {
+		qp.Send(ctx, query)
+		resp, err := query.GetResponse(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// given
+	table := []byte("open")
+	query, _ := gdb.NewAddTableQuery(ctx, table)
+	query.Header.Opts = &gdb.TableOpts{
+		TableName: table,
+		DataDir:   []byte(t.TempDir()),
+		WalMode:   true,
+	}
+	send(query)
+	for _, k := range []string{"a", "b", "c"} {
+		query, _ = gdb.NewSetValueQuery(ctx, table, []byte(k), []byte(k))
+		send(query)
+	}
+	query, _ = gdb.NewGetRangeQuery(ctx, table, gdb.KeyRange{})
+	truncatedRows := send(query).Rows
+	query, _ = gdb.NewTruncateTableQuery(ctx, table)
+	send(query)
+	query, _ = gdb.NewSetValueQuery(ctx, table, []byte("d"), []byte("d"))
+	send(query)
+	query, _ = gdb.NewGetRangeQuery(ctx, table, gdb.KeyRange{})
+	droppedRows := send(query).Rows
+
+	// when
+	query, _ = gdb.NewDropTableQuery(ctx, table)
+	dropped := send(query)
+	query, _ = gdb.NewGetValueQuery(ctx, table, []byte("d"))
+	afterDrop := send(query)
+	read := func(rows *gdb.RangeIterator) string {
+		var keys []byte
+		for ; rows.Valid(); rows.Next() {
+			keys = append(keys, rows.Key()...)
+		}
+		if err := rows.Close(); err != nil {
+			t.Error(err)
+		}
+		return string(keys)
+	}
+
+	// then
+	if !dropped.Success || !errors.Is(afterDrop.Err, gdb.ErrTableNotFound) {
+		t.Errorf("expected the table to be dropped %v %v", dropped.Err, afterDrop.Err)
+	}
+	if keys := read(truncatedRows); keys != "abc" {
+		t.Errorf("rows opened before truncate w abc g %s", keys)
+	}
+	if keys := read(droppedRows); keys != "d" {
+		t.Errorf("rows opened before drop w d g %s", keys)
+	}
+}
+
+func TestQueryProxy_AlterTable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	qp, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Error(err)
+	}
+	gproxy.StartProxy(ctx, qp)
+	t.Cleanup(func() {
+		gproxy.StopProxy(ctx, qp)
+		cancel()
+	})
+	send := func(query *gdb.Query) *gdb.QueryResponse {
+		qp.Send(ctx, query)
+		resp, err := query.GetResponse(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// given
+	dir := []byte(t.TempDir())
+	table := []byte("altered")
+	query, _ := gdb.NewAddTableQuery(ctx, table)
+	query.Header.Opts = &gdb.TableOpts{TableName: table, DataDir: dir}
+	send(query)
+
+	// when
+	query, _ = gdb.NewAlterTableQuery(ctx, table, []gdb.KeyValue{
+		{Key: []byte("ttl"), Value: []byte("1h")},
+		{Key: []byte("max_bytes"), Value: []byte("1MB")},
+	})
+	altered := send(query)
+	query, _ = gdb.NewAlterTableQuery(ctx, table, []gdb.KeyValue{
+		{Key: []byte("wal"), Value: []byte("true")},
+	})
+	rejected := send(query)
+
+	// then
+	if !altered.Success {
+		t.Errorf("expected the table to be altered %v", altered.Err)
+	}
+	if !errors.Is(rejected.Err, gdb.ErrInvalidQuery) {
+		t.Errorf("w ErrInvalidQuery g %v", rejected.Err)
+	}
+	opts, err := gdb.LoadTableOpts(dir, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TTL != time.Hour || opts.MaxBytes != 1<<20 || opts.WalMode {
+		t.Errorf("unexpected persisted options %+v", opts)
+	}
+}
+
+func TestQueryProxy_Backpressure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	// workers are never started so admitted queries stay queued
+	qp, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// when
+	var rejected int
+	for i := 0; i < 100; i++ {
+		query, done := gdb.NewBatchSetValueQuery(
+			ctx, []byte("default"), []gdb.KeyValue{{Key: []byte("key"), Value: []byte("value")}})
+		qp.Send(ctx, query)
+		select {
+		case resp := <-done:
+			if !errors.Is(resp.Err, gproxy.ErrBackpressure) {
+				t.Errorf("unexpected response %v", resp)
+			}
+			rejected++
+		default:
+		}
+	}
+	query, done := gdb.NewGetValueQuery(ctx, []byte("default"), []byte("key"))
+	qp.Send(ctx, query)
+
+	// then
+	if rejected != 36 {
+		t.Errorf("w 36 rejected g %d", rejected)
+	}
+	select {
+	case resp := <-done:
+		t.Errorf("interactive query should have been queued %v", resp)
+	default:
+	}
+}
+
+func TestQueryProxy_Deadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	qp, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Error(err)
+	}
+	t.Cleanup(func() {
+		gproxy.StopProxy(ctx, qp)
+		cancel()
+	})
+
+	// given a write that expires while it is queued
+	short, stop := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer stop()
+	query, _ := gdb.NewSetValueQuery(short, []byte("default"), []byte("key"), []byte("value"))
+	qp.Send(short, query)
+	if _, err = query.GetResponse(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("w %s g %v", context.DeadlineExceeded, err)
+	}
+
+	// when
+	gproxy.StartProxy(ctx, qp)
+
+	// then
+	query, _ = gdb.NewGetValueQuery(ctx, []byte("default"), []byte("key"))
+	qp.Send(ctx, query)
+	resp, err := query.GetResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Success {
+		t.Error("expired write should have been skipped")
+	}
+}
+
+func TestWorkPool_StopAtBarrier(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	pool := gproxy.NewWorkPool(make(chan *gdb.Query, 8))
+	pool.SetWorkers(2)
+	pool.Start(ctx)
+	table := []byte("barrier")
+	entered, release := make(chan struct{}), make(chan struct{})
+	query, _ := gdb.NewAddTableQuery(ctx, table)
+	query.Header.Opts = &gdb.TableOpts{
+		TableName: table,
+		InMemory:  true,
+		Writer: gdb.WriterFunc(func(context.Context, []byte, []byte, []byte) error {
+			close(entered)
+			<-release
+			return nil
+		}),
+		WriteMode: gdb.WriteThrough,
+	}
+	pool.Send(ctx, query)
+	if resp, err := query.GetResponse(ctx); err != nil || !resp.Success {
+		t.Fatalf("add table %v %v", resp, err)
+	}
+
+	// given a write holding the worker that does not own the range delete
+	start := []byte("a")
+	key := []byte("k0")
+	for i := 1; pool.Owner(table, key) == pool.Owner(table, start); i++ {
+		key = []byte(fmt.Sprintf("k%d", i))
+	}
+	write, _ := gdb.NewSetValueQuery(ctx, table, key, []byte("value"))
+	pool.Send(ctx, write)
+	<-entered
+
+	// when
+	stopped := make(chan struct{})
+	go func() {
+		pool.WaitAndStop(ctx)
+		close(stopped)
+	}()
+	// let the idle owner stop before the range delete is queued
+	time.Sleep(50 * time.Millisecond)
+	deleted, _ := gdb.NewDeleteRangeQuery(ctx, table, start, []byte("z"))
+	pool.Send(ctx, deleted)
+	close(release)
+
+	// then
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the pool to stop with a range delete queued")
+	}
+	if resp, err := deleted.GetResponse(ctx); err != nil || !errors.Is(resp.Err, gproxy.ErrStopped) {
+		t.Errorf("expected the range delete to fail as the pool stopped %v %v", resp, err)
+	}
+}
+
+func TestQueryProxy_CopyDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	qp, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Error(err)
+	}
+	gproxy.StartProxy(ctx, qp)
+	t.Cleanup(func() {
+		gproxy.StopProxy(ctx, qp)
+		cancel()
+	})
+	send := func(query *gdb.Query) *gdb.QueryResponse {
+		qp.Send(ctx, query)
+		resp, err := query.GetResponse(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// given a copy whose first write blocks past the copy's deadline
+	entered, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	query, _ := gdb.NewAddTableQuery(ctx, []byte("copied"))
+	query.Header.Opts = &gdb.TableOpts{
+		TableName: []byte("copied"),
+		InMemory:  true,
+		Writer: gdb.WriterFunc(func(context.Context, []byte, []byte, []byte) error {
+			once.Do(func() {
+				close(entered)
+				<-release
+			})
+			return nil
+		}),
+		WriteMode: gdb.WriteThrough,
+	}
+	send(query)
+	rows := make([]gdb.KeyValue, 600)
+	for i := range rows {
+		rows[i] = gdb.KeyValue{Key: []byte(fmt.Sprintf("k%03d", i)), Value: []byte("v")}
+	}
+	query, _ = gdb.NewBatchSetValueQuery(ctx, []byte("default"), rows)
+	send(query)
+
+	// when
+	expiring, stop := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer stop()
+	copied, _ := gdb.NewInsertRangeQuery(expiring, []byte("copied"), []byte("default"), gdb.KeyRange{})
+	qp.Send(ctx, copied)
+	<-entered
+	<-expiring.Done()
+	// queued behind the copy's last batch since it reads one of its keys
+	last, _ := gdb.NewGetValueQuery(ctx, []byte("copied"), rows[len(rows)-1].Key)
+	qp.Send(ctx, last)
+	close(release)
+	resp, err := last.GetResponse(ctx)
+
+	// then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Success {
+		t.Error("expected the batches queued past the copy's deadline to be dropped")
+	}
+}
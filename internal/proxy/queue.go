@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// queue holds the tasks waiting for a worker in a FIFO per class.
+// Interactive tasks run before Write tasks and Write tasks before Bulk
+// ones. A task for a key already queued in a later class joins that
+// class instead, so the queries for a key run in the order they were
+// sent whatever their class.
+type queue struct {
+	mu    sync.Mutex
+	fifos [Admin][]*task
+	// keys counts the tasks queued in each class for a key
+	keys map[string]*[Admin]int
+	// barriers counts the barriers queued; while one is, every task
+	// joins the Bulk class behind it
+	barriers int
+	// ready is signalled when a task is pushed
+	ready chan struct{}
+}
+
+func newQueue() *queue {
+	return &queue{
+		keys:  make(map[string]*[Admin]int),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// push queues t under class p, or a later class holding one of its keys
+func (q *queue) push(t *task, p Priority) {
+	q.mu.Lock()
+	if t.barrier != nil || q.barriers > 0 {
+		p = Bulk
+	}
+	for _, k := range t.keys {
+		if counts, ok := q.keys[k]; ok {
+			for c := Bulk; c > p; c-- {
+				if counts[c] > 0 {
+					p = c
+					break
+				}
+			}
+		}
+	}
+	for _, k := range t.keys {
+		counts, ok := q.keys[k]
+		if !ok {
+			counts = new([Admin]int)
+			q.keys[k] = counts
+		}
+		counts[p]++
+	}
+	if t.barrier != nil {
+		q.barriers++
+	}
+	q.fifos[p] = append(q.fifos[p], t)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the first task of the earliest class holding one, or
+// nil when the queue is empty
+func (q *queue) pop() *task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := range q.fifos {
+		if len(q.fifos[p]) == 0 {
+			continue
+		}
+		t := q.fifos[p][0]
+		q.fifos[p][0] = nil
+		q.fifos[p] = q.fifos[p][1:]
+		for _, k := range t.keys {
+			counts := q.keys[k]
+			if counts[p]--; *counts == [Admin]int{} {
+				delete(q.keys, k)
+			}
+		}
+		if t.barrier != nil {
+			q.barriers--
+		}
+		return t
+	}
+	return nil
+}
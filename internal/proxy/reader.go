@@ -2,15 +2,26 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	gdb "github.com/blong14/gache/internal/db"
+	gerrors "github.com/blong14/gache/internal/errors"
 	gfile "github.com/blong14/gache/internal/io/file"
 )
 
 type waiter struct {
 	sync.WaitGroup
 	chns []chan gdb.QueryResponse
+	// written counts the rows the awaited batches wrote
+	written uint64
+	// unfinished counts the batches not sent or not answered in time
+	unfinished int32
+	mtx        sync.Mutex
+	// errs collects the errors of the batches that failed
+	errs *gerrors.Error
 }
 
 func (w *waiter) Add(ch chan gdb.QueryResponse) {
@@ -18,17 +29,43 @@ func (w *waiter) Add(ch chan gdb.QueryResponse) {
 	w.WaitGroup.Add(1)
 }
 
-func (w *waiter) Wait(ctx context.Context) {
+// done records the response of a batch
+func (w *waiter) done(resp gdb.QueryResponse) {
+	atomic.AddUint64(&w.written, uint64(resp.Stats.Count))
+	w.fail(resp.Err)
+}
+
+// fail records err, if any, as a batch failure
+func (w *waiter) fail(err error) {
+	if err == nil {
+		return
+	}
+	w.mtx.Lock()
+	w.errs = gerrors.Append(w.errs, err)
+	w.mtx.Unlock()
+}
+
+// Wait waits for the awaited batches and returns the errors of those
+// that failed. Batches still running when ctx ends count as failed.
+func (w *waiter) Wait(ctx context.Context) error {
 	for _, ch := range w.chns {
 		go func(done chan gdb.QueryResponse) {
 			defer w.WaitGroup.Done()
 			select {
 			case <-ctx.Done():
-			case <-done:
+				atomic.AddInt32(&w.unfinished, 1)
+			case resp := <-done:
+				w.done(resp)
 			}
 		}(ch)
 	}
 	w.WaitGroup.Wait()
+	if atomic.LoadInt32(&w.unfinished) > 0 {
+		w.fail(ctx.Err())
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.errs.ErrorOrNil()
 }
 
 type CSVReader struct {
@@ -45,9 +82,7 @@ func NewCSVReader(worker Actor) *CSVReader {
 
 func (f *CSVReader) Read(ctx context.Context, query *gdb.Query) {
 	if query.Header.Inst != gdb.Load {
-		if query != nil {
-			query.Done(gdb.QueryResponse{Success: false})
-		}
+		query.Done(gdb.QueryResponse{Err: gdb.ErrInvalidQuery})
 		return
 	}
 	reader := gfile.ScanCSV(string(query.Header.FileName))
@@ -61,19 +96,103 @@ func (f *CSVReader) Read(ctx context.Context, query *gdb.Query) {
 				Value: []byte(r[1]),
 			})
 		}
-		q, done := gdb.NewBatchSetValueQuery(ctx, query.Header.TableName, rows)
-		f.waiter.Add(done)
-		f.worker.Send(ctx, q)
-	}
-	f.waiter.Wait(ctx)
-	success := false
-	if err := reader.Err(); err == nil {
-		success = true
+		f.send(ctx, query.Header.TableName, rows)
 	}
+	err := gerrors.Append(f.waiter.Wait(ctx), reader.Err().ErrorOrNil()).ErrorOrNil()
 	query.Done(
 		gdb.QueryResponse{
-			Success: success,
+			Success: err == nil,
 			Value:   []byte("done"),
+			Stats: gdb.QueryStats{
+				Count: uint(atomic.LoadUint64(&f.waiter.written)),
+			},
+			Err: err,
 		},
 	)
 }
+
+func (f *CSVReader) send(ctx context.Context, table []byte, rows []gdb.KeyValue) {
+	sendBatch(ctx, f.worker, f.waiter, table, rows)
+}
+
+// copyBatchSize is how many rows a RangeCopier writes in one batch
+const copyBatchSize = 256
+
+// RangeCopier copies the rows of one table into another in batches
+type RangeCopier struct {
+	worker Actor
+	waiter *waiter
+}
+
+func NewRangeCopier(worker Actor) *RangeCopier {
+	return &RangeCopier{
+		worker: worker,
+		waiter: &waiter{chns: make([]chan gdb.QueryResponse, 0)},
+	}
+}
+
+// Copy writes the rows of src an InsertRange query selects into the
+// query's table. The first two columns of each row are its key and
+// value; a NULL value is written as an empty value.
+func (c *RangeCopier) Copy(ctx context.Context, src *Table, query *gdb.Query) {
+	if query.Header.Inst != gdb.InsertRange {
+		query.Done(gdb.QueryResponse{Err: gdb.ErrInvalidQuery})
+		return
+	}
+	rows := gdb.NewRangeIterator(src.scan(nil), query.KeyRange)
+	rows.Project = query.Project
+	batch := make([]gdb.KeyValue, 0, copyBatchSize)
+	for ; rows.Valid(); rows.Next() {
+		row := rows.Row()
+		// copy the row since the iterator's memory is released by Close
+		batch = append(batch, gdb.KeyValue{
+			Key:   append([]byte{}, row[0]...),
+			Value: append([]byte{}, row[1]...),
+		})
+		if len(batch) == copyBatchSize {
+			sendBatch(ctx, c.worker, c.waiter, query.Header.TableName, batch)
+			batch = make([]gdb.KeyValue, 0, copyBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		sendBatch(ctx, c.worker, c.waiter, query.Header.TableName, batch)
+	}
+	err := gerrors.Append(c.waiter.Wait(ctx), rows.Err(), rows.Close()).ErrorOrNil()
+	query.Done(
+		gdb.QueryResponse{
+			Success: err == nil,
+			Stats: gdb.QueryStats{
+				Count: uint(atomic.LoadUint64(&c.waiter.written)),
+			},
+			Err: err,
+		},
+	)
+}
+
+// sendBatch queues a batch of rows, backing off while the bulk queue is full
+func sendBatch(ctx context.Context, worker Actor, w *waiter, table []byte, rows []gdb.KeyValue) {
+	backoff := time.Millisecond
+	for {
+		q, done := gdb.NewBatchSetValueQuery(ctx, table, rows)
+		worker.Send(ctx, q)
+		select {
+		case resp := <-done:
+			if !errors.Is(resp.Err, ErrBackpressure) {
+				w.done(resp)
+				return
+			}
+		default:
+			w.Add(done)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			atomic.AddInt32(&w.unfinished, 1)
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 100*time.Millisecond {
+			backoff *= 2
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
+
 	gdb "github.com/blong14/gache/internal/db"
 	gerrors "github.com/blong14/gache/internal/errors"
 )
@@ -10,31 +14,150 @@ import (
 type Table struct {
 	impl gdb.Table
 	name []byte
+	// opts holds the table's *gdb.TableOpts; see options
+	opts      atomic.Value
+	loader    gdb.Loader
+	loads     flightGroup
+	writer    gdb.Writer
+	writeMode gdb.WriteMode
+	expiry    *expiry
+	behind    chan gdb.KeyValue
+	flushed   chan struct{}
+	// refs counts the queries and open iterators using the table
+	refs refs
+}
+
+// refs counts the users of a table, so a dropped table is only freed
+// once the queries and iterators reading it are done with it
+type refs struct {
+	mu      sync.Mutex
+	n       int
+	closing bool
+	drained chan struct{}
+}
+
+// acquire takes a reference unless the table is closing
+func (r *refs) acquire() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closing {
+		return false
+	}
+	r.n++
+	return true
+}
+
+// retain takes another reference for a caller already holding one
+func (r *refs) retain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.n++
+}
+
+func (r *refs) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.n--
+	if r.n == 0 && r.closing {
+		close(r.drained)
+	}
+}
+
+// close stops new references from being taken and returns a channel
+// that is closed once the held ones are released
+func (r *refs) close() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closing {
+		r.closing = true
+		r.drained = make(chan struct{})
+		if r.n == 0 {
+			close(r.drained)
+		}
+	}
+	return r.drained
+}
+
+// tableIterator holds a reference on the table it reads until it is closed
+type tableIterator struct {
+	gdb.Iterator
+	release func()
+	once    sync.Once
 }
 
-func NewTable(opts *gdb.TableOpts) *Table {
-	return &Table{
-		name: opts.TableName,
-		impl: gdb.New(opts),
+func (it *tableIterator) Close() error {
+	err := it.Iterator.Close()
+	it.once.Do(it.release)
+	return err
+}
+
+// NewTable opens the table opts describes
+func NewTable(opts *gdb.TableOpts) (*Table, error) {
+	impl, err := gdb.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	t := &Table{
+		name:      opts.TableName,
+		impl:      impl,
+		loader:    opts.Loader,
+		writer:    opts.Writer,
+		writeMode: opts.WriteMode,
+		expiry:    newExpiry(opts.TTL),
 	}
+	t.opts.Store(opts)
+	if t.writer != nil && t.writeMode == gdb.WriteBehind {
+		t.behind = make(chan gdb.KeyValue, 1024)
+		t.flushed = make(chan struct{})
+		go t.writeBehind()
+	}
+	return t, nil
+}
+
+// options returns the table's current options, which AlterTable
+// replaces while queries run
+func (va *Table) options() *gdb.TableOpts {
+	return va.opts.Load().(*gdb.TableOpts)
 }
 
-func (va *Table) Execute(_ context.Context, query *gdb.Query) {
+func (va *Table) Execute(ctx context.Context, query *gdb.Query) {
+	var reads *gdb.ReadStats
+	if query.Header.Analyze {
+		reads = new(gdb.ReadStats)
+	}
 	switch query.Header.Inst {
 	case gdb.GetValue:
-		var resp gdb.QueryResponse
-		if value, ok := va.impl.Get(query.Key); ok {
-			resp = gdb.QueryResponse{
-				Key:         query.Key,
-				Value:       value,
-				RangeValues: [][][]byte{{query.Key, value}},
-				Stats: gdb.QueryStats{
-					Count: 1,
-				},
-				Success: true,
+		value, ok := va.get(query.Key, reads)
+		if !ok && va.loader != nil {
+			// loads run off the worker so a slow store does not hold
+			// up the other queries queued for it
+			va.refs.retain()
+			go func() {
+				defer va.refs.release()
+				value, ok, err := va.load(query.Context(), query.Key)
+				answerGet(query, value, ok, err, reads)
+			}()
+			return
+		}
+		answerGet(query, value, ok, nil, reads)
+	case gdb.BatchGetValue:
+		keys := make([][]byte, 0, len(query.Values))
+		for _, kv := range query.Values {
+			if kv.Valid() {
+				keys = append(keys, kv.Key)
 			}
 		}
-		query.Done(resp)
+		values, missing := va.getMany(keys, reads)
+		if missing == nil || va.loader == nil {
+			answerGetMany(query, values, nil, reads)
+			return
+		}
+		va.refs.retain()
+		go func() {
+			defer va.refs.release()
+			values, err := va.loadMany(query.Context(), keys, values, missing)
+			answerGetMany(query, values, err, reads)
+		}()
 	case gdb.Count:
 		count := va.impl.Count()
 		query.Done(
@@ -49,22 +172,61 @@ func (va *Table) Execute(_ context.Context, query *gdb.Query) {
 			},
 		)
 	case gdb.GetRange:
-		var resp gdb.QueryResponse
-		values, ok := va.impl.ScanWithLimit(
-			query.KeyRange.Start, query.KeyRange.End, query.KeyRange.Limit)
-		if ok {
-			resp = gdb.QueryResponse{
+		seq := va.impl.Sequence()
+		rows := gdb.NewRangeIteratorWithStats(va.iterator(reads), query.KeyRange, reads)
+		rows.StartAt(seq)
+		rows.Project = query.Project
+		stream(query, rows, reads)
+	case gdb.Aggregate:
+		// rows are folded as they are read so only the aggregates leave the worker
+		rows := gdb.NewRangeIteratorWithStats(va.scan(reads), query.KeyRange, reads)
+		agg := gdb.NewAggregator(query.Aggregates, query.GroupBy)
+		for ; rows.Valid(); rows.Next() {
+			agg.Add(rows.Key(), rows.Value())
+		}
+		err := gerrors.Append(nil, rows.Err(), rows.Close()).ErrorOrNil()
+		values := agg.Rows()
+		query.Done(
+			gdb.QueryResponse{
 				RangeValues: values,
 				Stats: gdb.QueryStats{
 					Count: uint(len(values)),
+					Reads: reads,
 				},
-				Success: true,
+				Success: err == nil,
+				Err:     err,
+			},
+		)
+	case gdb.Range:
+		// a full table dump; the query's key range is ignored
+		seq := va.impl.Sequence()
+		rows := gdb.NewRangeIterator(va.iterator(nil), gdb.KeyRange{})
+		rows.StartAt(seq)
+		stream(query, rows, nil)
+	case gdb.Print:
+		var buf bytes.Buffer
+		if err := va.impl.Print(&buf); err != nil {
+			query.Done(gdb.QueryResponse{Err: err})
+			return
+		}
+		var values [][][]byte
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			if kv := bytes.SplitN(line, []byte("\t"), 2); len(kv) == 2 {
+				values = append(values, kv)
 			}
 		}
-		query.Done(resp)
+		query.Done(
+			gdb.QueryResponse{
+				Value:       buf.Bytes(),
+				RangeValues: values,
+				Success:     true,
+			},
+		)
 	case gdb.SetValue:
 		var resp gdb.QueryResponse
-		if err := va.impl.Set(query.Key, query.Value); err == nil {
+		if err := va.set(ctx, query.Key, query.Value); err != nil {
+			resp.Err = err
+		} else {
 			resp = gdb.QueryResponse{
 				Key:   query.Key,
 				Value: query.Value,
@@ -75,15 +237,46 @@ func (va *Table) Execute(_ context.Context, query *gdb.Query) {
 			}
 		}
 		query.Done(resp)
+	case gdb.Merge:
+		var resp gdb.QueryResponse
+		if value, err := va.merge(ctx, query.Key, query.Value); err != nil {
+			resp.Err = err
+		} else {
+			resp = gdb.QueryResponse{
+				Key:   query.Key,
+				Value: value,
+				Stats: gdb.QueryStats{
+					Count: 1,
+				},
+				Success: true,
+			}
+		}
+		query.Done(resp)
+	case gdb.DeleteRange:
+		// count the keys first so the caller learns how many were deleted
+		count := va.count(gdb.KeyRange{Start: query.KeyRange.Start, End: query.KeyRange.End})
+		var resp gdb.QueryResponse
+		va.loads.forget(nil)
+		if err := va.impl.DeleteRange(query.KeyRange.Start, query.KeyRange.End); err != nil {
+			resp.Err = fmt.Errorf("%w: %s", gdb.ErrWriteFailed, err)
+		} else {
+			resp = gdb.QueryResponse{
+				Stats: gdb.QueryStats{
+					Count: count,
+				},
+				Success: true,
+			}
+		}
+		query.Done(resp)
 	case gdb.BatchSetValue:
 		var errs *gerrors.Error
 		for _, kv := range query.Values {
 			if kv.Valid() {
-				errs = gerrors.Append(errs, va.impl.Set(kv.Key, kv.Value))
+				errs = gerrors.Append(errs, va.set(ctx, kv.Key, kv.Value))
 			}
 		}
-		var resp gdb.QueryResponse
-		if errs.ErrorOrNil() == nil {
+		resp := gdb.QueryResponse{Err: errs.ErrorOrNil()}
+		if resp.Err == nil {
 			resp = gdb.QueryResponse{
 				Stats: gdb.QueryStats{
 					Count: uint(len(query.Values)),
@@ -93,9 +286,150 @@ func (va *Table) Execute(_ context.Context, query *gdb.Query) {
 		}
 		query.Done(resp)
 	default:
+		query.Done(gdb.QueryResponse{
+			Err: fmt.Errorf("%w: unsupported instruction %s", gdb.ErrInvalidQuery, query.Header.Inst),
+		})
 	}
 }
 
+// Stop flushes the table's queued writes and closes it
 func (va *Table) Stop() {
+	va.stopWriteBehind()
 	va.impl.Close()
 }
+
+// join streams the rows of a JoinRange query, merge joining the rows
+// of the table with the rows of joined
+func (va *Table) join(joined *Table, query *gdb.Query) {
+	var reads *gdb.ReadStats
+	if query.Header.Analyze {
+		reads = new(gdb.ReadStats)
+	}
+	seq := va.impl.Sequence()
+	it := gdb.NewJoinIterator(va.iterator(reads), joined.iterator(reads), query.Join)
+	rows := gdb.NewRangeIteratorWithStats(it, query.KeyRange, reads)
+	rows.StartAt(seq)
+	rows.Project = query.Project
+	stream(query, rows, reads)
+}
+
+// iterator returns an iterator over the table that holds a reference
+// on it until it is closed. The caller must already hold one.
+func (va *Table) iterator(stats *gdb.ReadStats) gdb.Iterator {
+	va.refs.retain()
+	return &tableIterator{Iterator: va.scan(stats), release: va.refs.release}
+}
+
+// answerGet answers a GetValue query with the value read or loaded for its key
+func answerGet(query *gdb.Query, value []byte, ok bool, err error, reads *gdb.ReadStats) {
+	resp := gdb.QueryResponse{Err: err}
+	if ok && !query.KeyRange.Filter.Match(value) {
+		// a value the filter rejects reads as a miss
+		ok = false
+	}
+	if !ok && err == nil {
+		resp.Err = gdb.ErrKeyNotFound
+	}
+	if ok {
+		resp = gdb.QueryResponse{
+			Key:         query.Key,
+			Value:       value,
+			RangeValues: [][][]byte{gdb.Project(query.Project, query.Key, value)},
+			Stats: gdb.QueryStats{
+				Count: 1,
+				Reads: reads,
+			},
+			Success: true,
+		}
+	}
+	query.Done(resp)
+}
+
+// answerGetMany answers a BatchGetValue query with the values read or
+// loaded for its keys
+func answerGetMany(query *gdb.Query, values []gdb.KeyValue, err error, reads *gdb.ReadStats) {
+	rows := make([][][]byte, 0, len(values))
+	for _, kv := range values {
+		if query.KeyRange.Filter.Match(kv.Value) {
+			rows = append(rows, gdb.Project(query.Project, kv.Key, kv.Value))
+		}
+	}
+	query.Done(
+		gdb.QueryResponse{
+			RangeValues: rows,
+			Stats: gdb.QueryStats{
+				Count: uint(len(rows)),
+				Reads: reads,
+			},
+			Success: err == nil,
+			Err:     err,
+		},
+	)
+}
+
+// stream answers query with rows, closing them instead when the scan
+// failed to start so the table is not held by rows nobody reads
+func stream(query *gdb.Query, rows *gdb.RangeIterator, reads *gdb.ReadStats) {
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		query.Done(gdb.QueryResponse{Err: err})
+		return
+	}
+	query.Done(
+		gdb.QueryResponse{
+			Rows: rows,
+			Stats: gdb.QueryStats{
+				Reads: reads,
+			},
+			Success: true,
+		},
+	)
+}
+
+// count returns the number of keys in kr
+func (va *Table) count(kr gdb.KeyRange) uint {
+	rows := gdb.NewRangeIterator(va.scan(nil), kr)
+	defer func() { _ = rows.Close() }()
+	var n uint
+	for ; rows.Valid(); rows.Next() {
+		n++
+	}
+	return n
+}
+
+// alter applies the options that can change while the table is open
+func (va *Table) alter(opts *gdb.TableOpts) error {
+	if err := va.impl.Alter(opts); err != nil {
+		return err
+	}
+	va.expiry.setTTL(opts.TTL)
+	va.opts.Store(opts)
+	return nil
+}
+
+// Drop deletes the table's files and frees it once the queries and
+// iterators using it are done. The caller has already stopped routing
+// queries to it.
+func (va *Table) Drop() error {
+	err := va.impl.Drop()
+	va.free()
+	return err
+}
+
+// free closes the table once the queries and iterators holding a
+// reference on it are done; no new references can be taken
+func (va *Table) free() {
+	drained := va.refs.close()
+	go func() {
+		<-drained
+		// the writers are done, so the write behind queue can be closed
+		va.Stop()
+	}()
+}
+
+func (va *Table) stopWriteBehind() {
+	if va.behind != nil {
+		close(va.behind)
+		<-va.flushed
+	}
+}
@@ -3,7 +3,12 @@ package proxy_test
 import (
 	"bytes"
 	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	gdb "github.com/blong14/gache/internal/db"
 	gproxy "github.com/blong14/gache/internal/proxy"
@@ -62,9 +67,8 @@ func testScanHit(ctx context.Context, v *gproxy.Table, expected *gdb.QueryRespon
 			}
 		}
 
-		query, outbox = gdb.NewGetValueQuery(ctx, []byte("default"), expected.Key)
-		query.Header.Inst = gdb.GetRange
-		query.KeyRange.Start = expected.Key
+		query, outbox = gdb.NewGetRangeQuery(
+			ctx, []byte("default"), gdb.KeyRange{Start: expected.Key, End: expected.Key})
 		go v.Execute(query.Context(), query)
 		select {
 		case <-ctx.Done():
@@ -73,14 +77,21 @@ func testScanHit(ctx context.Context, v *gproxy.Table, expected *gdb.QueryRespon
 			if !ok || !actual.Success {
 				t.Errorf("not ok %v", query)
 			}
-			for _, r := range actual.RangeValues {
-				assertMatch(t, expected.Value, r[1])
+			var count int
+			for ; actual.Rows.Valid(); actual.Rows.Next() {
+				assertMatch(t, expected.Value, actual.Rows.Value())
+				count++
+			}
+			if err := actual.Rows.Close(); err != nil {
+				t.Error(err)
+			}
+			if count != 1 {
+				t.Errorf("w 1 row g %d", count)
 			}
 		}
 
-		query, outbox = gdb.NewGetValueQuery(ctx, []byte("default"), expected.Key)
-		query.Header.Inst = gdb.GetRange
-		query.KeyRange.Start = expected.Key
+		query, outbox = gdb.NewGetRangeQuery(
+			ctx, []byte("default"), gdb.KeyRange{Start: expected.Key, End: expected.Key})
 		go v.Execute(query.Context(), query)
 		select {
 		case <-ctx.Done():
@@ -89,8 +100,16 @@ func testScanHit(ctx context.Context, v *gproxy.Table, expected *gdb.QueryRespon
 			if !ok || !actual.Success {
 				t.Errorf("not ok %v", query)
 			}
-			for _, r := range actual.RangeValues {
-				assertMatch(t, expected.Value, r[1])
+			var count int
+			for ; actual.Rows.Valid(); actual.Rows.Next() {
+				assertMatch(t, expected.Value, actual.Rows.Value())
+				count++
+			}
+			if err := actual.Rows.Close(); err != nil {
+				t.Error(err)
+			}
+			if count != 1 {
+				t.Errorf("w 1 row g %d", count)
 			}
 		}
 	}
@@ -105,7 +124,10 @@ func TestTable_Get(t *testing.T) {
 		TableName: []byte("default"),
 		InMemory:  true,
 	}
-	v := gproxy.NewTable(opts)
+	v, err := gproxy.NewTable(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
 	hit := &gdb.QueryResponse{
 		Key:   []byte("key"),
 		Value: []byte("value"),
@@ -113,3 +135,491 @@ func TestTable_Get(t *testing.T) {
 	t.Run("hit", testGetHit(ctx, v, hit))
 	t.Run("hit", testScanHit(ctx, v, hit))
 }
+
+func TestTable_GetRangeCursor(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	v, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("default"),
+		InMemory:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		query, outbox := gdb.NewSetValueQuery(ctx, []byte("default"), []byte(k), []byte(k))
+		v.Execute(ctx, query)
+		<-outbox
+	}
+
+	// when
+	var pages []string
+	var cursor, first []byte
+	for {
+		query, outbox := gdb.NewGetRangeQuery(
+			ctx, []byte("default"), gdb.KeyRange{Limit: 2, Cursor: cursor})
+		v.Execute(ctx, query)
+		resp := <-outbox
+		if !resp.Success {
+			t.Fatalf("not ok %v", query)
+		}
+		var page []byte
+		for ; resp.Rows.Valid(); resp.Rows.Next() {
+			page = append(page, resp.Rows.Key()...)
+		}
+		pages = append(pages, string(page))
+		cursor = resp.Rows.Cursor()
+		_ = resp.Rows.Close()
+		if first == nil {
+			first = cursor
+		}
+		if cursor == nil {
+			break
+		}
+	}
+	query, outbox := gdb.NewSetValueQuery(ctx, []byte("default"), []byte("bb"), []byte("bb"))
+	v.Execute(ctx, query)
+	<-outbox
+	query, outbox = gdb.NewGetRangeQuery(
+		ctx, []byte("default"), gdb.KeyRange{Limit: 2, Cursor: first})
+	v.Execute(ctx, query)
+	resumed := <-outbox
+	var page []byte
+	for ; resumed.Success && resumed.Rows.Valid(); resumed.Rows.Next() {
+		page = append(page, resumed.Rows.Key()...)
+	}
+	if resumed.Rows != nil {
+		_ = resumed.Rows.Close()
+	}
+
+	// then
+	if strings.Join(pages, ",") != "ab,cd,e" {
+		t.Errorf("w ab,cd,e g %v", pages)
+	}
+	if !resumed.Success || string(page) != "bbc" {
+		t.Errorf("expected a write to show up past the cursor w bbc g %s %v", page, resumed.Err)
+	}
+}
+
+func TestTable_ReadThrough(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	var loads int32
+	release := make(chan struct{})
+	v, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("default"),
+		InMemory:  true,
+		TTL:       50 * time.Millisecond,
+		Loader: gdb.LoaderFunc(func(_ context.Context, _, key []byte) ([]byte, error) {
+			atomic.AddInt32(&loads, 1)
+			switch string(key) {
+			case "missing":
+				return nil, gdb.ErrKeyNotFound
+			case "broken":
+				return nil, errors.New("backing store down")
+			}
+			<-release
+			return append([]byte("loaded:"), key...), nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(key string) *gdb.QueryResponse {
+		query, _ := gdb.NewGetValueQuery(ctx, []byte("default"), []byte(key))
+		go v.Execute(ctx, query)
+		resp, err := query.GetResponse(ctx)
+		if err != nil {
+			t.Error(err)
+			return &gdb.QueryResponse{}
+		}
+		return resp
+	}
+
+	// when
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := get("key")
+			if !resp.Success || string(resp.Value) != "loaded:key" {
+				t.Errorf("unexpected response %v", resp)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// then
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("w 1 load g %d", n)
+	}
+	if resp := get("key"); !resp.Success || atomic.LoadInt32(&loads) != 1 {
+		t.Errorf("expected a cached hit %v", resp)
+	}
+	if resp := get("missing"); resp.Success || !errors.Is(resp.Err, gdb.ErrKeyNotFound) {
+		t.Errorf("expected a miss %v", resp)
+	}
+	if resp := get("broken"); resp.Success || resp.Err == nil {
+		t.Errorf("expected a loader error %v", resp)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if resp := get("key"); !resp.Success || atomic.LoadInt32(&loads) != 4 {
+		t.Errorf("expected the expired key to be reloaded %v", resp)
+	}
+}
+
+func TestTable_WriteThrough(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	written := make(map[string]string)
+	v, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("default"),
+		InMemory:  true,
+		Writer: gdb.WriterFunc(func(_ context.Context, _, key, value []byte) error {
+			if string(key) == "rejected" {
+				return errors.New("backing store down")
+			}
+			written[string(key)] = string(value)
+			return nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(key, value string) *gdb.QueryResponse {
+		query, _ := gdb.NewSetValueQuery(ctx, []byte("default"), []byte(key), []byte(value))
+		v.Execute(ctx, query)
+		resp, err := query.GetResponse(ctx)
+		if err != nil {
+			t.Error(err)
+			return &gdb.QueryResponse{}
+		}
+		return resp
+	}
+
+	// when
+	ok := set("key", "value")
+	rejected := set("rejected", "value")
+
+	// then
+	if !ok.Success || written["key"] != "value" {
+		t.Errorf("expected the write to reach the writer %v", written)
+	}
+	if rejected.Success || rejected.Err == nil {
+		t.Errorf("expected a writer error %v", rejected)
+	}
+	query, _ := gdb.NewGetValueQuery(ctx, []byte("default"), []byte("rejected"))
+	v.Execute(ctx, query)
+	if resp, _ := query.GetResponse(ctx); resp.Success {
+		t.Error("a failed write through should not reach the table")
+	}
+}
+
+func TestTable_RangeAndPrint(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	v, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("default"),
+		InMemory:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		query, outbox := gdb.NewSetValueQuery(ctx, []byte("default"), []byte(k), []byte(k))
+		v.Execute(ctx, query)
+		<-outbox
+	}
+
+	// when
+	query, _ := gdb.NewRangeQuery(ctx, []byte("default"))
+	v.Execute(ctx, query)
+	dump, err := query.GetResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _ = gdb.NewPrintQuery(ctx, []byte("default"))
+	v.Execute(ctx, query)
+	desc, err := query.GetResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// then
+	var keys []byte
+	for ; dump.Rows.Valid(); dump.Rows.Next() {
+		keys = append(keys, dump.Rows.Key()...)
+	}
+	_ = dump.Rows.Close()
+	if string(keys) != "abc" {
+		t.Errorf("w abc g %s", keys)
+	}
+	if !desc.Success || !bytes.Contains(desc.Value, []byte("memtable.keys\t3\n")) {
+		t.Errorf("unexpected description %s", desc.Value)
+	}
+}
+
+func TestTable_TTLScan(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	v, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("default"),
+		InMemory:  true,
+		TTL:       30 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := func(k string) {
+		query, outbox := gdb.NewSetValueQuery(ctx, []byte("default"), []byte(k), []byte(k))
+		v.Execute(ctx, query)
+		<-outbox
+	}
+	set("a")
+	set("b")
+	time.Sleep(40 * time.Millisecond)
+	set("c")
+
+	// when
+	query, _ := gdb.NewGetRangeQuery(ctx, []byte("default"), gdb.KeyRange{})
+	v.Execute(ctx, query)
+	scan, err := query.GetResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []byte
+	for ; scan.Rows.Valid(); scan.Rows.Next() {
+		keys = append(keys, scan.Rows.Key()...)
+	}
+	_ = scan.Rows.Close()
+	query = gdb.NewQuery(ctx, nil)
+	query.Header.TableName = []byte("default")
+	query.Header.Inst = gdb.Count
+	v.Execute(ctx, query)
+	count, err := query.GetResponse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// then
+	if string(keys) != "c" {
+		t.Errorf("expected expired keys to be hidden from scans w c g %s", keys)
+	}
+	if count.Stats.Count != 1 {
+		t.Errorf("expected expired keys to be dropped w 1 g %d", count.Stats.Count)
+	}
+}
+
+func TestTable_LoadCancel(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	release := make(chan struct{})
+	v, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("default"),
+		InMemory:  true,
+		Loader: gdb.LoaderFunc(func(ctx context.Context, _, key []byte) ([]byte, error) {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-release:
+			}
+			return append([]byte("loaded:"), key...), nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// when
+	cancelled, stop := context.WithCancel(ctx)
+	first, _ := gdb.NewGetValueQuery(cancelled, []byte("default"), []byte("key"))
+	v.Execute(ctx, first)
+	second, _ := gdb.NewGetValueQuery(ctx, []byte("default"), []byte("key"))
+	v.Execute(ctx, second)
+	stop()
+	close(release)
+	resp, err := second.GetResponse(ctx)
+
+	// then
+	if err != nil || !resp.Success || string(resp.Value) != "loaded:key" {
+		t.Errorf("expected the load to outlive a cancelled caller %v %v", resp, err)
+	}
+}
+
+type actorFunc func(ctx context.Context, q *gdb.Query)
+
+func (f actorFunc) Send(ctx context.Context, q *gdb.Query) { f(ctx, q) }
+
+func TestRangeCopier_Failures(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	src, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("src"),
+		InMemory:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		query, _ := gdb.NewSetValueQuery(ctx, []byte("src"), []byte(key), []byte("value"))
+		src.Execute(ctx, query)
+		if resp, err := query.GetResponse(ctx); err != nil || !resp.Success {
+			t.Fatalf("set %s %v %v", key, resp, err)
+		}
+	}
+	cases := map[string]struct {
+		worker gproxy.Actor
+		ctx    func() context.Context
+	}{
+		"batch error": {
+			worker: actorFunc(func(_ context.Context, q *gdb.Query) {
+				q.Done(gdb.QueryResponse{Err: errors.New("backing store down")})
+			}),
+			ctx: func() context.Context { return ctx },
+		},
+		"cancelled": {
+			worker: actorFunc(func(context.Context, *gdb.Query) {}),
+			ctx: func() context.Context {
+				cancelled, stop := context.WithCancel(ctx)
+				stop()
+				return cancelled
+			},
+		},
+	}
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			// when
+			query, _ := gdb.NewInsertRangeQuery(ctx, []byte("dst"), []byte("src"), gdb.KeyRange{})
+			gproxy.NewRangeCopier(tc.worker).Copy(tc.ctx(), src, query)
+			resp, err := query.GetResponse(ctx)
+
+			// then
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Success || resp.Err == nil {
+				t.Errorf("expected the copy to fail %v", resp)
+			}
+		})
+	}
+}
+
+func TestTable_AbandonedRows(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	v, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("default"),
+		InMemory:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _ := gdb.NewSetValueQuery(ctx, []byte("default"), []byte("key"), []byte("value"))
+	v.Execute(ctx, query)
+	if _, err := query.GetResponse(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]func() (*gdb.QueryResponse, error){
+		"timed out before the answer": func() (*gdb.QueryResponse, error) {
+			expired, stop := context.WithTimeout(ctx, time.Millisecond)
+			defer stop()
+			<-expired.Done()
+			query, _ := gdb.NewGetRangeQuery(expired, []byte("default"), gdb.KeyRange{})
+			v.Execute(ctx, query)
+			return query.GetResponse(ctx)
+		},
+		"answered after the caller gave up": func() (*gdb.QueryResponse, error) {
+			query, _ := gdb.NewGetRangeQuery(ctx, []byte("default"), gdb.KeyRange{})
+			waited, stop := context.WithTimeout(ctx, time.Millisecond)
+			defer stop()
+			resp, err := query.GetResponse(waited)
+			v.Execute(ctx, query)
+			return resp, err
+		},
+		"caller gave up on an answer": func() (*gdb.QueryResponse, error) {
+			query, _ := gdb.NewGetRangeQuery(ctx, []byte("default"), gdb.KeyRange{})
+			v.Execute(ctx, query)
+			cancelled, stop := context.WithCancel(ctx)
+			stop()
+			return query.GetResponse(cancelled)
+		},
+	}
+	for name, abandon := range cases {
+		t.Run(name, func(t *testing.T) {
+			// when
+			for i := 0; i < 20; i++ {
+				resp, err := abandon()
+				if err == nil && resp.Rows != nil {
+					// the response won the race, so the caller owns the rows
+					_ = resp.Rows.Close()
+				}
+			}
+
+			// then
+			if refs := v.Refs(); refs != 0 {
+				t.Errorf("expected the abandoned rows to release the table, %d refs held", refs)
+			}
+		})
+	}
+}
+
+func TestTable_DropAfterCancelledRange(t *testing.T) {
+	t.Parallel()
+	// given
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	v, err := gproxy.NewTable(&gdb.TableOpts{
+		TableName: []byte("default"),
+		DataDir:   []byte(t.TempDir()),
+		WalMode:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _ := gdb.NewSetValueQuery(ctx, []byte("default"), []byte("key"), []byte("value"))
+	v.Execute(ctx, query)
+	if _, err := query.GetResponse(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, stop := context.WithCancel(ctx)
+	query, _ = gdb.NewGetRangeQuery(cancelled, []byte("default"), gdb.KeyRange{})
+	v.Execute(ctx, query)
+	stop()
+	if resp, err := query.GetResponse(cancelled); err == nil {
+		// the response won the race, so the caller owns the rows
+		_ = resp.Rows.Close()
+	}
+
+	// when
+	if err := v.Drop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// then
+	select {
+	case <-v.Drained():
+	case <-time.After(time.Second):
+		t.Errorf("expected the dropped table to be freed, %d refs held", v.Refs())
+	}
+}
@@ -3,9 +3,11 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
 
 	gdb "github.com/blong14/gache/internal/db"
 	ghttp "github.com/blong14/gache/internal/io/http"
@@ -28,6 +30,28 @@ type GetValueResponse struct {
 	Value  string `json:"value"`
 }
 
+// errorStatus maps a query error to an HTTP status
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, gdb.ErrTableNotFound), errors.Is(err, gdb.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, gdb.ErrInvalidQuery),
+		errors.Is(err, gdb.ErrInvalidCursor),
+		errors.Is(err, gdb.ErrInvalidOperand),
+		errors.Is(err, gdb.ErrMergeOperatorNotSet):
+		return http.StatusBadRequest
+	case errors.Is(err, gdb.ErrWriteFailed):
+		return http.StatusInternalServerError
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, gproxy.ErrBackpressure):
+		return http.StatusServiceUnavailable
+	default:
+		// errors from a table's Loader or Writer
+		return http.StatusBadGateway
+	}
+}
+
 func getValueService(proxy *gproxy.QueryProxy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		urlQuery := r.URL.Query()
@@ -45,14 +69,23 @@ func getValueService(proxy *gproxy.QueryProxy) http.HandlerFunc {
 		defer cancel()
 		query, _ := gdb.NewGetValueQuery(ctx, []byte(table), []byte(key))
 		proxy.Send(ctx, query)
-		result := query.GetResponse()
+		result, err := query.GetResponse(ctx)
+		if err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(err), resp)
+			return
+		}
 		var resp GetValueResponse
 		var status int
 		switch {
-		case !result.Success:
+		case errors.Is(result.Err, gdb.ErrKeyNotFound):
 			status = http.StatusNotFound
 			resp.Status = "not found"
 			resp.Key = key
+		case result.Err != nil:
+			err := ErrorResponse{Error: result.Err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(result.Err), err)
+			return
 		default:
 			status = http.StatusOK
 			resp.Status = "ok"
@@ -63,6 +96,90 @@ func getValueService(proxy *gproxy.QueryProxy) http.HandlerFunc {
 	}
 }
 
+type KeyValueResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func scanService(proxy *gproxy.QueryProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urlQuery := r.URL.Query()
+		table := urlQuery.Get("table")
+		if table == "" {
+			table = "default"
+		}
+		var kr gdb.KeyRange
+		if urlQuery.Has("start") {
+			kr.Start = []byte(urlQuery.Get("start"))
+		}
+		if urlQuery.Has("end") {
+			kr.End = []byte(urlQuery.Get("end"))
+		}
+		if urlQuery.Has("prefix") {
+			kr.Prefix = []byte(urlQuery.Get("prefix"))
+		}
+		if urlQuery.Has("reverse") {
+			reverse, err := strconv.ParseBool(urlQuery.Get("reverse"))
+			if err != nil {
+				err := ErrorResponse{Error: "invalid reverse"}
+				ghttp.MustWriteJSON(w, r, http.StatusBadRequest, err)
+				return
+			}
+			kr.Reverse = reverse
+		}
+		if urlQuery.Has("cursor") {
+			kr.Cursor = []byte(urlQuery.Get("cursor"))
+		}
+		if urlQuery.Has("limit") {
+			limit, err := strconv.Atoi(urlQuery.Get("limit"))
+			if err != nil {
+				err := ErrorResponse{Error: "invalid limit"}
+				ghttp.MustWriteJSON(w, r, http.StatusBadRequest, err)
+				return
+			}
+			kr.Limit = limit
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		query, _ := gdb.NewGetRangeQuery(ctx, []byte(table), kr)
+		proxy.Send(ctx, query)
+		result, err := query.GetResponse(ctx)
+		if err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(err), resp)
+			return
+		}
+		if result.Err != nil {
+			if result.Rows != nil {
+				_ = result.Rows.Close()
+			}
+			err := ErrorResponse{Error: result.Err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(result.Err), err)
+			return
+		}
+		rows := result.Rows
+		defer func() { _ = rows.Close() }()
+		started := false
+		next := func() (interface{}, bool) {
+			if started {
+				rows.Next()
+			}
+			started = true
+			if !rows.Valid() {
+				return nil, false
+			}
+			return KeyValueResponse{Key: string(rows.Key()), Value: string(rows.Value())}, true
+		}
+		tail := func() map[string]interface{} {
+			return map[string]interface{}{"cursor": string(rows.Cursor())}
+		}
+		err = ghttp.StreamJSON(w, r, http.StatusOK, "rows", next, tail)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 type SetValueRequest struct {
 	Table string `json:"table"`
 	Key   string `json:"key"`
@@ -95,10 +212,19 @@ func setValueService(proxy *gproxy.QueryProxy) http.HandlerFunc {
 		defer cancel()
 		query, _ := gdb.NewSetValueQuery(ctx, []byte(req.Table), []byte(req.Key), []byte(req.Value))
 		proxy.Send(ctx, query)
-		result := query.GetResponse()
+		result, err := query.GetResponse(ctx)
+		if err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(err), resp)
+			return
+		}
 		var resp SetValueResponse
 		var status int
 		switch {
+		case result.Err != nil:
+			err := ErrorResponse{Error: result.Err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(result.Err), err)
+			return
 		case !result.Success:
 			status = http.StatusNotFound
 			resp.Status = "not found"
@@ -113,10 +239,228 @@ func setValueService(proxy *gproxy.QueryProxy) http.HandlerFunc {
 	}
 }
 
+type GetManyRequest struct {
+	Table string   `json:"table"`
+	Keys  []string `json:"keys"`
+}
+
+type GetManyResponse struct {
+	Status string             `json:"status"`
+	Values []KeyValueResponse `json:"values"`
+}
+
+func getManyService(proxy *gproxy.QueryProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		if body == nil {
+			resp := ErrorResponse{Error: "server error"}
+			ghttp.MustWriteJSON(w, r, http.StatusInternalServerError, resp)
+			return
+		}
+		defer func() { _ = body.Close() }()
+		decoder := json.NewDecoder(body)
+		var req GetManyRequest
+		if err := decoder.Decode(&req); err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, http.StatusUnprocessableEntity, resp)
+			return
+		}
+		if req.Table == "" {
+			req.Table = "default"
+		}
+		keys := make([][]byte, len(req.Keys))
+		for i, k := range req.Keys {
+			keys[i] = []byte(k)
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		query, _ := gdb.NewBatchGetValueQuery(ctx, []byte(req.Table), keys)
+		proxy.Send(ctx, query)
+		result, err := query.GetResponse(ctx)
+		if err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(err), resp)
+			return
+		}
+		if result.Err != nil {
+			err := ErrorResponse{Error: result.Err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(result.Err), err)
+			return
+		}
+		resp := GetManyResponse{
+			Status: "ok",
+			Values: make([]KeyValueResponse, len(result.RangeValues)),
+		}
+		for i, kv := range result.RangeValues {
+			resp.Values[i] = KeyValueResponse{Key: string(kv[0]), Value: string(kv[1])}
+		}
+		ghttp.MustWriteJSON(w, r, http.StatusOK, resp)
+	}
+}
+
+type IncrRequest struct {
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	Delta int64  `json:"delta"`
+}
+
+func incrService(proxy *gproxy.QueryProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		if body == nil {
+			resp := ErrorResponse{Error: "server error"}
+			ghttp.MustWriteJSON(w, r, http.StatusInternalServerError, resp)
+			return
+		}
+		defer func() { _ = body.Close() }()
+		decoder := json.NewDecoder(body)
+		var req IncrRequest
+		if err := decoder.Decode(&req); err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, http.StatusUnprocessableEntity, resp)
+			return
+		}
+		if req.Key == "" {
+			err := ErrorResponse{Error: "missing key"}
+			ghttp.MustWriteJSON(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if req.Table == "" {
+			req.Table = "default"
+		}
+		if req.Delta == 0 {
+			req.Delta = 1
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		operand := []byte(strconv.FormatInt(req.Delta, 10))
+		query, _ := gdb.NewMergeQuery(ctx, []byte(req.Table), []byte(req.Key), operand)
+		proxy.Send(ctx, query)
+		result, err := query.GetResponse(ctx)
+		if err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(err), resp)
+			return
+		}
+		var resp GetValueResponse
+		var status int
+		switch {
+		case result.Err != nil:
+			err := ErrorResponse{Error: result.Err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(result.Err), err)
+			return
+		case !result.Success:
+			status = http.StatusNotFound
+			resp.Status = "not found"
+			resp.Key = req.Key
+		default:
+			status = http.StatusOK
+			resp.Status = "ok"
+			resp.Key = req.Key
+			resp.Value = string(result.Value)
+		}
+		ghttp.MustWriteJSON(w, r, status, resp)
+	}
+}
+
+type TableRequest struct {
+	Table string `json:"table"`
+}
+
+type TableResponse struct {
+	Status string `json:"status"`
+	Table  string `json:"table"`
+}
+
+// tableService answers requests naming a single table with the
+// query built by newQuery, e.g. dropping or truncating it
+func tableService(
+	proxy *gproxy.QueryProxy,
+	newQuery func(ctx context.Context, table []byte) (*gdb.Query, chan gdb.QueryResponse),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := r.Body
+		if body == nil {
+			resp := ErrorResponse{Error: "server error"}
+			ghttp.MustWriteJSON(w, r, http.StatusInternalServerError, resp)
+			return
+		}
+		defer func() { _ = body.Close() }()
+		decoder := json.NewDecoder(body)
+		var req TableRequest
+		if err := decoder.Decode(&req); err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, http.StatusUnprocessableEntity, resp)
+			return
+		}
+		if req.Table == "" {
+			err := ErrorResponse{Error: "missing table"}
+			ghttp.MustWriteJSON(w, r, http.StatusBadRequest, err)
+			return
+		}
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		query, _ := newQuery(ctx, []byte(req.Table))
+		proxy.Send(ctx, query)
+		result, err := query.GetResponse(ctx)
+		if err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(err), resp)
+			return
+		}
+		if result.Err != nil {
+			err := ErrorResponse{Error: result.Err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(result.Err), err)
+			return
+		}
+		ghttp.MustWriteJSON(w, r, http.StatusOK, TableResponse{Status: "ok", Table: req.Table})
+	}
+}
+
+type ListTablesResponse struct {
+	Status string             `json:"status"`
+	Tables []KeyValueResponse `json:"tables"`
+}
+
+func listTablesService(proxy *gproxy.QueryProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		query, _ := gdb.NewListTablesQuery(ctx)
+		proxy.Send(ctx, query)
+		result, err := query.GetResponse(ctx)
+		if err != nil {
+			resp := ErrorResponse{Error: err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(err), resp)
+			return
+		}
+		if result.Err != nil {
+			err := ErrorResponse{Error: result.Err.Error()}
+			ghttp.MustWriteJSON(w, r, errorStatus(result.Err), err)
+			return
+		}
+		resp := ListTablesResponse{
+			Status: "ok",
+			Tables: make([]KeyValueResponse, len(result.RangeValues)),
+		}
+		for i, kv := range result.RangeValues {
+			// the value is where the table is stored
+			resp.Tables[i] = KeyValueResponse{Key: string(kv[0]), Value: string(kv[1])}
+		}
+		ghttp.MustWriteJSON(w, r, http.StatusOK, resp)
+	}
+}
+
 func HTTPHandlers(proxy *gproxy.QueryProxy) ghttp.Handler {
 	return map[string]http.HandlerFunc{
-		"/healthz": HealthzService,
-		"/get":     MustBe(http.MethodGet, getValueService(proxy)),
-		"/set":     MustBe(http.MethodPost, setValueService(proxy)),
+		"/healthz":         HealthzService,
+		"/get":             MustBe(http.MethodGet, getValueService(proxy)),
+		"/mget":            MustBe(http.MethodPost, getManyService(proxy)),
+		"/set":             MustBe(http.MethodPost, setValueService(proxy)),
+		"/incr":            MustBe(http.MethodPost, incrService(proxy)),
+		"/scan":            MustBe(http.MethodGet, scanService(proxy)),
+		"/tables":          MustBe(http.MethodGet, listTablesService(proxy)),
+		"/tables/drop":     MustBe(http.MethodPost, tableService(proxy, gdb.NewDropTableQuery)),
+		"/tables/truncate": MustBe(http.MethodPost, tableService(proxy, gdb.NewTruncateTableQuery)),
 	}
 }
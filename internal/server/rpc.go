@@ -3,7 +3,9 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/rpc"
+	"strings"
 	"time"
 
 	gdb "github.com/blong14/gache/internal/db"
@@ -11,7 +13,6 @@ import (
 	grpc "github.com/blong14/gache/internal/io/rpc"
 	glog "github.com/blong14/gache/internal/logging"
 	gproxy "github.com/blong14/gache/internal/proxy"
-	gache "github.com/blong14/gache/sql"
 )
 
 var ErrNilClient = gerrors.NewGError(errors.New("nil client"))
@@ -23,49 +24,141 @@ type QueryService struct {
 type QueryRequest struct {
 	Queries []*gdb.Query
 	Query   *gdb.Query
+	// Deadline is when the client gives up on the query; the query's
+	// own deadline is not exported so it is sent here
+	Deadline time.Time
 }
 
 type QueryResponse struct {
 	Success bool
 	Key     []byte
 	Value   []byte
+	// RangeValues holds every row of the response; range queries are
+	// read to the end on the server since rows cannot be streamed
+	RangeValues [][][]byte
+	// Cursor resumes a paged range after its last row
+	Cursor []byte
+	Count  uint
+	// Reads is the storage work of an analyzed query
+	Reads *gdb.ReadStats
 }
 
 func (qs *QueryService) OnQuery(req *QueryRequest, resp *QueryResponse) error {
 	start := time.Now()
 	ctx := context.Background()
+	if !req.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, req.Deadline)
+		defer cancel()
+	}
 	query := req.Query
 	qry := gdb.NewQuery(ctx, nil)
 	qry.Header = query.Header
 	qry.Key = query.Key
 	qry.Value = query.Value
 	qry.Values = query.Values
+	qry.KeyRange = query.KeyRange
+	qry.Project = query.Project
+	qry.Aggregates = query.Aggregates
+	qry.GroupBy = query.GroupBy
+	qry.Join = query.Join
 
 	qs.Proxy.Send(ctx, qry)
-	r := qry.GetResponse()
+	r, err := qry.GetResponse(ctx)
+	if err != nil {
+		return err
+	}
+	if r.Err != nil {
+		if r.Rows != nil {
+			_ = r.Rows.Close()
+		}
+		return r.Err
+	}
 	resp.Success = r.Success
 	resp.Key = r.Key
 	resp.Value = r.Value
+	resp.RangeValues = r.RangeValues
+	resp.Count = r.Stats.Count
+	if rows := r.Rows; rows != nil {
+		for ; rows.Valid(); rows.Next() {
+			// copy the row since the iterator's memory is released by Close
+			row := rows.Row()
+			for i, column := range row {
+				if column != nil {
+					row[i] = append([]byte{}, column...)
+				}
+			}
+			resp.RangeValues = append(resp.RangeValues, row)
+		}
+		resp.Cursor = rows.Cursor()
+		err = gerrors.Append(nil, rows.Err(), rows.Close()).ErrorOrNil()
+		if err != nil {
+			return err
+		}
+	}
+	// read after the rows are drained since scanning them counts too
+	resp.Reads = r.Stats.Reads
 	glog.Track("%T %v in %s", req, resp.Success, time.Since(start))
 	return nil
 }
 
 func PublishQuery(client *rpc.Client, queries ...*gdb.Query) (*QueryResponse, error) {
+	return PublishQueryContext(context.Background(), client, queries...)
+}
+
+// PublishQueryContext publishes a query and waits for its response
+// until ctx is done
+func PublishQueryContext(ctx context.Context, client *rpc.Client, queries ...*gdb.Query) (*QueryResponse, error) {
 	if client == nil {
 		return nil, ErrNilClient
 	}
 	req := new(QueryRequest)
 	req.Query = queries[0]
+	req.Deadline = req.Query.Deadline()
+	if deadline, ok := ctx.Deadline(); ok && (req.Deadline.IsZero() || deadline.Before(req.Deadline)) {
+		req.Deadline = deadline
+	}
 	resp := new(QueryResponse)
-	err := client.Call("QueryService.OnQuery", req, resp)
+	var err error
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case call := <-client.Go("QueryService.OnQuery", req, resp, make(chan *rpc.Call, 1)).Done:
+		err = call.Error
+	}
+	var serverErr rpc.ServerError
+	if errors.As(err, &serverErr) {
+		err = rpcError(serverErr)
+	}
 	return resp, err
 }
 
-func RPCHandlers() []grpc.Handler {
-	proxy, err := gache.GetProxy()
-	if err != nil {
-		panic(err)
+// rpcErrors are the errors a QueryService call can fail with
+var rpcErrors = []error{
+	gdb.ErrTableNotFound,
+	gdb.ErrKeyNotFound,
+	gdb.ErrInvalidQuery,
+	gdb.ErrWriteFailed,
+	gproxy.ErrBackpressure,
+	context.DeadlineExceeded,
+}
+
+// rpcError turns the text of a server error back into the typed
+// error it was created from; net/rpc only carries the text across the wire
+func rpcError(serverErr rpc.ServerError) error {
+	msg := string(serverErr)
+	for _, err := range rpcErrors {
+		switch {
+		case msg == err.Error():
+			return err
+		case strings.HasPrefix(msg, err.Error()+": "):
+			return fmt.Errorf("%w%s", err, strings.TrimPrefix(msg, err.Error()))
+		}
 	}
+	return serverErr
+}
+
+func RPCHandlers(proxy *gproxy.QueryProxy) []grpc.Handler {
 	return []grpc.Handler{
 		&QueryService{
 			Proxy: proxy,
@@ -0,0 +1,237 @@
+package sql
+
+import "fmt"
+
+// Statement is the root of a parsed SQL statement
+type Statement interface {
+	stmt()
+}
+
+// Expr is a value in a statement: a literal or a placeholder
+type Expr interface {
+	expr()
+	Position() Pos
+}
+
+// Literal is a quoted string, a number or a bare word used as a value
+type Literal struct {
+	Pos   Pos
+	Value string
+}
+
+// Placeholder is a parameter bound when the statement is executed.
+// Positional placeholders (? and $<n>) have an Ordinal counted from 1;
+// named placeholders (:<name>) have a Name.
+type Placeholder struct {
+	Pos     Pos
+	Ordinal int
+	Name    string
+}
+
+func (*Literal) expr()     {}
+func (*Placeholder) expr() {}
+
+func (l *Literal) Position() Pos     { return l.Pos }
+func (p *Placeholder) Position() Pos { return p.Pos }
+
+func (p *Placeholder) String() string {
+	if p.Name != "" {
+		return ":" + p.Name
+	}
+	return fmt.Sprintf("$%d", p.Ordinal)
+}
+
+// Ident names a table or a column
+type Ident struct {
+	Pos  Pos
+	Name string
+}
+
+// Condition is a where clause: comparisons combined with and, or and not
+type Condition interface {
+	cond()
+	Position() Pos
+}
+
+// JSONPath extracts a member of a JSON column: -> extracts it as
+// JSON and ->> as text
+type JSONPath struct {
+	Pos  Pos
+	Path string
+	Text bool
+}
+
+// Comparison tests a column, or the member of it Path selects,
+// against its arguments
+type Comparison struct {
+	Pos    Pos
+	Column *Ident
+	Path   *JSONPath
+	// Op is one of =, <>, <, <=, >, >=, between, in or like
+	Op   string
+	Args []Expr
+}
+
+// Logical joins two conditions with and or or
+type Logical struct {
+	Pos         Pos
+	Op          string
+	Left, Right Condition
+}
+
+// Not negates a condition
+type Not struct {
+	Pos  Pos
+	Cond Condition
+}
+
+func (*Comparison) cond() {}
+func (*Logical) cond()    {}
+func (*Not) cond()        {}
+
+func (c *Comparison) Position() Pos { return c.Pos }
+func (l *Logical) Position() Pos    { return l.Pos }
+func (n *Not) Position() Pos        { return n.Pos }
+
+// OrderBy sorts rows by Column
+type OrderBy struct {
+	Column *Ident
+	Desc   bool
+}
+
+// GroupBy groups rows by prefix(<column>, <separator>, <parts>), the
+// first parts of the column split on separator
+type GroupBy struct {
+	Pos       Pos
+	Column    *Ident
+	Separator Expr
+	Parts     Expr
+}
+
+// SelectItem is one entry of a select list: a column, a member of a
+// JSON column, * or an aggregate function of a column or its member
+type SelectItem struct {
+	Pos    Pos
+	Column string
+	Path   *JSONPath
+	Func   string
+}
+
+// Join joins the rows of a select with the rows of Table that have
+// the same key: [inner | left [outer]] join <table> on <a>.key = <b>.key
+type Join struct {
+	Pos Pos
+	// Outer is set for left joins
+	Outer       bool
+	Table       *Ident
+	Left, Right *Ident
+}
+
+type SelectStmt struct {
+	Items   []*SelectItem
+	Table   *Ident
+	Join    *Join
+	Where   Condition
+	GroupBy *GroupBy
+	OrderBy *OrderBy
+	Limit   Expr
+	After   Expr
+}
+
+// InsertStmt is one of
+//
+//	insert into <table> set key = <key>, value = <value>
+//	insert into <table> [(key, value)] values (<key>, <value>), ...
+//	insert into <table> [(key, value)] select key, value from ...
+type InsertStmt struct {
+	Table *Ident
+	Key   Expr
+	Value Expr
+	// Rows are the rows of a values list
+	Rows []*InsertRow
+	// Select reads the rows to insert from a table
+	Select *SelectStmt
+}
+
+// InsertRow is a row of a values list; Value is nil when the column
+// list leaves it out
+type InsertRow struct {
+	Key   Expr
+	Value Expr
+}
+
+// UpdateStmt sets a key's value, or merges an operand into it when
+// Operator is + or -
+type UpdateStmt struct {
+	Table    *Ident
+	Value    Expr
+	Operator string
+	Where    Condition
+}
+
+type DeleteStmt struct {
+	Table *Ident
+	Where Condition
+}
+
+// CopyStmt loads a csv file into a table
+type CopyStmt struct {
+	Table *Ident
+	File  Expr
+}
+
+// Option is a table option given as <name> = <value>
+type Option struct {
+	Pos   Pos
+	Name  string
+	Value Expr
+}
+
+type CreateTableStmt struct {
+	Table   *Ident
+	Options []*Option
+}
+
+type AlterTableStmt struct {
+	Table   *Ident
+	Options []*Option
+}
+
+type DropTableStmt struct {
+	Table *Ident
+}
+
+type TruncateTableStmt struct {
+	Table *Ident
+}
+
+type ShowTablesStmt struct{}
+
+type DescribeStmt struct {
+	Table *Ident
+}
+
+type DumpStmt struct {
+	Table *Ident
+}
+
+// ExplainStmt describes how Stmt reads its table; Analyze also runs
+// it and reports the work it did
+type ExplainStmt struct {
+	Analyze bool
+	Stmt    Statement
+}
+
+func (*SelectStmt) stmt()        {}
+func (*InsertStmt) stmt()        {}
+func (*UpdateStmt) stmt()        {}
+func (*DeleteStmt) stmt()        {}
+func (*CopyStmt) stmt()          {}
+func (*CreateTableStmt) stmt()   {}
+func (*AlterTableStmt) stmt()    {}
+func (*DropTableStmt) stmt()     {}
+func (*TruncateTableStmt) stmt() {}
+func (*ShowTablesStmt) stmt()    {}
+func (*DescribeStmt) stmt()      {}
+func (*DumpStmt) stmt()          {}
+func (*ExplainStmt) stmt()       {}
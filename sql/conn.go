@@ -5,76 +5,73 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"errors"
-	"fmt"
 	"io"
-	"strconv"
-	"strings"
-	"sync"
+	"time"
 
 	gdb "github.com/blong14/gache/internal/db"
+	gerrors "github.com/blong14/gache/internal/errors"
 	glog "github.com/blong14/gache/internal/logging"
 	gproxy "github.com/blong14/gache/internal/proxy"
 )
 
-type QueryResponse struct {
-	Key         []byte
-	Value       []byte
-	RangeValues [][][]byte
-	Stats       gdb.QueryStats
-	Success     bool
-}
+// Errors returned by queries
+var (
+	ErrTableNotFound = gdb.ErrTableNotFound
+	ErrInvalidQuery  = gdb.ErrInvalidQuery
+	ErrWriteFailed   = gdb.ErrWriteFailed
+	ErrBackpressure  = gproxy.ErrBackpressure
+)
 
-type rows struct {
-	next *QueryResponse
-	done bool
+// result reports how many rows a statement wrote
+type result struct {
+	rowsAffected int64
 }
 
-func (r *rows) Columns() []string {
-	return []string{"value"}
+func (r result) LastInsertId() (int64, error) {
+	return 0, errors.New("gache does not generate ids")
 }
 
-func (r *rows) Close() error {
-	return nil
+func (r result) RowsAffected() (int64, error) {
+	return r.rowsAffected, nil
 }
 
-func (r *rows) Next(dest []driver.Value) error {
-	dest[0] = r.next
-	r.done = true
-	return nil
+type conn struct {
+	backend backend
+	stmts   *statementCache
 }
 
-func (r *rows) HasNextResultSet() bool {
-	hasNext := r.next != nil && !r.done
-	return hasNext
+func (c *conn) Commit() error {
+	return errors.New("not implemented")
 }
 
-func (r *rows) NextResultSet() error {
-	if r.next == nil {
-		return io.EOF
-	}
-	r.next = nil
-	return nil
+func (c *conn) Rollback() error {
+	return errors.New("not implemented")
 }
 
-type conn struct {
-	proxy *gproxy.QueryProxy
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
 }
 
-func (c *conn) Commit() error {
-	return errors.New("not implemented")
+func (c *conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	return c.prepare(query)
 }
 
-func (c *conn) Rollback() error {
-	return errors.New("not implemented")
+// prepare returns the statement for query from the statement cache
+func (c *conn) prepare(query string) (*stmt, error) {
+	cached, err := c.stmts.get(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, ast: cached.ast, numInput: cached.numInput, template: cached.template}, nil
 }
 
-func (c *conn) Prepare(_ string) (driver.Stmt, error) {
-	return nil, errors.New("not implemented")
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	return checkNamedValue(nv)
 }
 
 func (c *conn) Close() error {
 	glog.Track("closing db connection...")
-	return nil
+	return c.backend.close()
 }
 
 func (c *conn) Begin() (driver.Tx, error) {
@@ -85,53 +82,105 @@ func (c *conn) Query(query string, args []driver.NamedValue) (driver.Rows, error
 	return c.QueryContext(context.Background(), query, args)
 }
 
+// QueryContext runs query with its placeholders bound to args
 func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
-	q, err := parse(strings.NewReader(query))
+	s, err := c.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return s.QueryContext(ctx, args)
+}
+
+// ExecContext runs query with its placeholders bound to args and
+// reports how many rows it wrote
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s, err := c.prepare(query)
 	if err != nil {
 		return nil, err
 	}
-	for _, arg := range args {
-		valueOrKey := arg.Value.([]byte)
-		switch arg.Name {
-		case "table":
-			q.Header.TableName = valueOrKey
-		case "start":
-			q.KeyRange.Start = valueOrKey
-		case "end":
-			q.KeyRange.End = valueOrKey
-		case "key":
-			q.Key = valueOrKey
-		case "value":
-			q.Value = valueOrKey
-		case "limit":
-			q.KeyRange.Limit, err = strconv.Atoi(string(valueOrKey))
-			if err != nil {
-				return nil, fmt.Errorf("invalid limit arg: %w", err)
-			}
-		default:
-			return nil, errors.New("invalid args")
+	return s.ExecContext(ctx, args)
+}
+
+// send runs q on the connection's backend; a missing key is not an error
+func (c *conn) send(ctx context.Context, q *gdb.Query) (*gdb.QueryResponse, error) {
+	resp, err := c.backend.run(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Err != nil && !errors.Is(resp.Err, gdb.ErrKeyNotFound) {
+		return nil, resp.Err
+	}
+	return resp, nil
+}
+
+func (c *conn) exec(ctx context.Context, q *gdb.Query) (driver.Result, error) {
+	resp, err := c.send(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rows != nil {
+		if err = resp.Rows.Close(); err != nil {
+			return nil, err
 		}
 	}
-	c.proxy.Send(ctx, q)
-	resp := q.GetResponse()
+	return result{rowsAffected: int64(resp.Stats.Count)}, nil
+}
+
+func (c *conn) query(ctx context.Context, qp *queryPlan) (driver.Rows, error) {
+	switch {
+	case qp.analyze:
+		return c.analyze(ctx, qp)
+	case qp.explain:
+		return &rows{columns: nameValueColumns, values: gdb.Explain(qp.query)}, nil
+	}
+	resp, err := c.send(ctx, qp.query)
+	if err != nil {
+		return nil, err
+	}
+	return newRows(qp, resp), nil
+}
+
+// analyze runs an explained query, reading its rows to the end, and
+// returns its plan followed by the work it did
+func (c *conn) analyze(ctx context.Context, qp *queryPlan) (driver.Rows, error) {
+	start := time.Now()
+	resp, err := c.send(ctx, qp.query)
+	if err != nil {
+		return nil, err
+	}
+	executed := time.Now()
+	result := newRows(qp, resp)
+	dest := make([]driver.Value, len(result.columns))
+	var n uint
+	for err = result.Next(dest); err == nil; err = result.Next(dest) {
+		n++
+	}
+	if err = gerrors.Append(nil, ignoreEOF(err), result.Close()).ErrorOrNil(); err != nil {
+		return nil, err
+	}
+	stats := resp.Stats
+	stats.Count = n
+	stats.Stages = []gdb.Stage{
+		{Name: "plan", Duration: qp.planTime},
+		{Name: "execute", Duration: executed.Sub(start)},
+		{Name: "fetch", Duration: time.Since(executed)},
+	}
 	return &rows{
-		next: &QueryResponse{
-			Key:         resp.Key,
-			Value:       resp.Value,
-			RangeValues: resp.RangeValues,
-			Stats:       resp.Stats,
-			Success:     resp.Success,
-		},
+		columns: nameValueColumns,
+		values:  append(gdb.Explain(qp.query), stats.Analyze()...),
 	}, nil
 }
 
+// ignoreEOF returns nil for io.EOF, which ends a read of rows
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
 func (c *conn) Ping() error {
-	result, err := c.Query(
-		"select value from tables where key = %s;",
-		[]driver.NamedValue{
-			{Name: "key", Ordinal: 1, Value: "default"},
-		},
-	)
+	result, err := c.Query("show tables;", nil)
 	if err != nil {
 		return err
 	}
@@ -141,29 +190,29 @@ func (c *conn) Ping() error {
 	return nil
 }
 
-var queryProxy *gproxy.QueryProxy
-
 const MEMORY = ":memory:"
 
-type Driver struct {
-	once sync.Once
-}
+// Driver opens connections to the data source named by a DSN; see
+// Config for the forms a DSN takes
+type Driver struct{}
 
 func (d *Driver) Open(dsn string) (driver.Conn, error) {
-	var err error
-	d.once.Do(func() {
-		var qp *gproxy.QueryProxy
-		qp, err = gproxy.NewQueryProxy()
-		queryProxy = qp
-		gproxy.StartProxy(context.Background(), queryProxy)
-	})
-	return &conn{proxy: queryProxy}, err
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
 }
 
-func init() {
-	sql.Register("gache", &Driver{})
+// OpenConnector parses dsn and returns a connector for its data source
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	cfg, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newConnector(d, cfg), nil
 }
 
-func GetProxy() (*gproxy.QueryProxy, error) {
-	return queryProxy, nil
+func init() {
+	sql.Register("gache", &Driver{})
 }
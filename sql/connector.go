@@ -0,0 +1,119 @@
+package sql
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+
+	gdb "github.com/blong14/gache/internal/db"
+	grpc "github.com/blong14/gache/internal/io/rpc"
+	gproxy "github.com/blong14/gache/internal/proxy"
+	gserver "github.com/blong14/gache/internal/server"
+)
+
+// backend runs the queries of a connection
+type backend interface {
+	run(ctx context.Context, q *gdb.Query) (*gdb.QueryResponse, error)
+	close() error
+}
+
+// embedded runs queries on a proxy in this process
+type embedded struct {
+	proxy *gproxy.QueryProxy
+}
+
+func (e embedded) run(ctx context.Context, q *gdb.Query) (*gdb.QueryResponse, error) {
+	q = q.WithContext(ctx)
+	e.proxy.Send(ctx, q)
+	return q.GetResponse(ctx)
+}
+
+func (e embedded) close() error {
+	return nil
+}
+
+// remote sends queries to a gache server's QueryService
+type remote struct {
+	client  *rpc.Client
+	timeout time.Duration
+}
+
+func (r remote) run(ctx context.Context, q *gdb.Query) (*gdb.QueryResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	resp, err := gserver.PublishQueryContext(ctx, r.client, q)
+	if err != nil {
+		return &gdb.QueryResponse{Err: err}, nil
+	}
+	return &gdb.QueryResponse{
+		Key:         resp.Key,
+		Value:       resp.Value,
+		RangeValues: resp.RangeValues,
+		Cursor:      resp.Cursor,
+		Stats: gdb.QueryStats{
+			Count: resp.Count,
+			Reads: resp.Reads,
+		},
+		Success: resp.Success,
+	}, nil
+}
+
+func (r remote) close() error {
+	return r.client.Close()
+}
+
+// connector opens connections to the data source of one DSN. Embedded
+// data sources share a proxy started by the first connection and
+// stopped when the connector is closed.
+type connector struct {
+	driver *Driver
+	cfg    *Config
+	stmts  *statementCache
+	once   sync.Once
+	proxy  *gproxy.QueryProxy
+	err    error
+}
+
+func newConnector(d *Driver, cfg *Config) *connector {
+	return &connector{driver: d, cfg: cfg, stmts: newStatementCache()}
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.cfg.Mode == Remote {
+		client, err := grpc.ClientTimeout(c.cfg.Addr, c.cfg.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		return &conn{backend: remote{client: client, timeout: c.cfg.Timeout}, stmts: c.stmts}, nil
+	}
+	c.once.Do(func() {
+		if c.cfg.Mode == File {
+			if c.err = os.MkdirAll(c.cfg.DataDir, 0755); c.err != nil {
+				return
+			}
+		}
+		c.proxy, c.err = gproxy.NewQueryProxyWithDefaults(c.cfg.tableOpts)
+		if c.err == nil {
+			gproxy.StartProxy(context.Background(), c.proxy)
+		}
+	})
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &conn{backend: embedded{proxy: c.proxy}, stmts: c.stmts}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close stops the proxy of an embedded data source
+func (c *connector) Close() error {
+	if c.proxy != nil {
+		gproxy.StopProxy(context.Background(), c.proxy)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	gdb "github.com/blong14/gache/internal/db"
+)
+
+// ErrInvalidDSN is returned for a data source name that cannot be parsed
+var ErrInvalidDSN = errors.New("invalid dsn")
+
+// Mode is where the tables of a data source live
+type Mode int
+
+const (
+	// Memory keeps tables in memory in this process
+	Memory Mode = iota
+	// File keeps tables in files in this process
+	File
+	// Remote sends queries to a gache server
+	Remote
+)
+
+// defaultPort is the port of the gache rpc server
+const defaultPort = "8080"
+
+// Config is a parsed data source name. A DSN is one of
+//
+//	:memory:
+//	file:/var/lib/gache?wal=true&sync=always
+//	gache://host:8080?timeout=2s
+type Config struct {
+	Mode Mode
+	// DataDir is the directory a File data source keeps tables in
+	DataDir string
+	// WAL logs writes to File tables
+	WAL bool
+	// Sync syncs the WAL after every write
+	Sync bool
+	// Addr is the host and port of a Remote server
+	Addr string
+	// Timeout bounds connecting to a Remote server and each query sent to it
+	Timeout time.Duration
+}
+
+// ParseDSN parses a data source name in one of the forms described by Config
+func ParseDSN(dsn string) (*Config, error) {
+	if dsn == "" || dsn == MEMORY {
+		return &Config{Mode: Memory}, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidDSN, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return parseFileDSN(u)
+	case "gache":
+		return parseRemoteDSN(u)
+	default:
+		return nil, fmt.Errorf("%w: unknown scheme in %s", ErrInvalidDSN, dsn)
+	}
+}
+
+func parseFileDSN(u *url.URL) (*Config, error) {
+	cfg := &Config{Mode: File, DataDir: u.Path}
+	if u.Opaque != "" {
+		// a relative path such as file:data
+		cfg.DataDir = u.Opaque
+	}
+	if cfg.DataDir == "" {
+		return nil, fmt.Errorf("%w: missing data dir", ErrInvalidDSN)
+	}
+	for name, values := range u.Query() {
+		value := values[len(values)-1]
+		var err error
+		switch name {
+		case "wal":
+			cfg.WAL, err = strconv.ParseBool(value)
+		case "sync":
+			switch value {
+			case "always":
+				cfg.Sync = true
+			case "never":
+				cfg.Sync = false
+			default:
+				err = errors.New("expected always or never")
+			}
+		default:
+			return nil, fmt.Errorf("%w: unknown parameter %s", ErrInvalidDSN, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidDSN, name, err)
+		}
+	}
+	if cfg.Sync && !cfg.WAL {
+		return nil, fmt.Errorf("%w: sync=always requires wal=true", ErrInvalidDSN)
+	}
+	return cfg, nil
+}
+
+func parseRemoteDSN(u *url.URL) (*Config, error) {
+	cfg := &Config{Mode: Remote, Addr: u.Host, Timeout: gdb.DefaultTimeout}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: missing host", ErrInvalidDSN)
+	}
+	if u.Port() == "" {
+		cfg.Addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("%w: unexpected path %s", ErrInvalidDSN, u.Path)
+	}
+	for name, values := range u.Query() {
+		value := values[len(values)-1]
+		switch name {
+		case "timeout":
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("%w: invalid timeout %s", ErrInvalidDSN, value)
+			}
+			cfg.Timeout = timeout
+		default:
+			return nil, fmt.Errorf("%w: unknown parameter %s", ErrInvalidDSN, name)
+		}
+	}
+	return cfg, nil
+}
+
+// tableOpts returns the options of a table created without any
+func (c *Config) tableOpts(name []byte) *gdb.TableOpts {
+	opts := gdb.DefaultTableOpts(name)
+	if c.Mode == File {
+		opts.InMemory = false
+		opts.DataDir = []byte(c.DataDir)
+		opts.WalMode = c.WAL
+		opts.SyncWAL = c.Sync
+	}
+	return opts
+}
@@ -0,0 +1,279 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	gdb "github.com/blong14/gache/internal/db"
+)
+
+// Pos is a line and column in a statement, both counted from 1
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+// SyntaxError reports where a statement could not be tokenized or parsed
+type SyntaxError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %s: %s", e.Pos, e.Msg)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return gdb.ErrInvalidQuery
+}
+
+type tokenKind int
+
+const (
+	tkEOF tokenKind = iota
+	// tkIdent is a bare word; keywords are identifiers matched by the parser
+	tkIdent
+	// tkQuotedIdent is a double quoted identifier that is never a keyword
+	tkQuotedIdent
+	tkString
+	tkNumber
+	// tkPlaceholder is ?, $<n> or :<name>
+	tkPlaceholder
+	tkSymbol
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tkEOF:
+		return "end of statement"
+	case tkIdent, tkQuotedIdent:
+		return "identifier"
+	case tkString:
+		return "string"
+	case tkNumber:
+		return "number"
+	case tkPlaceholder:
+		return "placeholder"
+	case tkSymbol:
+		return "symbol"
+	default:
+		return "unknown"
+	}
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  Pos
+}
+
+func (t token) String() string {
+	if t.kind == tkEOF {
+		return t.kind.String()
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// lexer splits a statement into tokens
+type lexer struct {
+	src  []rune
+	off  int
+	line int
+	col  int
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: []rune(src), line: 1, col: 1}
+}
+
+// tokenize returns every token in the statement ending with tkEOF
+func tokenize(src string) ([]token, error) {
+	l := newLexer(src)
+	tokens := make([]token, 0)
+	for {
+		tkn, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tkn)
+		if tkn.kind == tkEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) peek(n int) rune {
+	if l.off+n >= len(l.src) {
+		return 0
+	}
+	return l.src[l.off+n]
+}
+
+func (l *lexer) advance() rune {
+	r := l.src[l.off]
+	l.off++
+	if r == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	return r
+}
+
+func (l *lexer) pos() Pos {
+	return Pos{Line: l.line, Column: l.col}
+}
+
+func (l *lexer) errorf(pos Pos, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) skipSpaceAndComments() {
+	for l.off < len(l.src) {
+		switch r := l.peek(0); {
+		case unicode.IsSpace(r):
+			l.advance()
+		case r == '-' && l.peek(1) == '-':
+			for l.off < len(l.src) && l.peek(0) != '\n' {
+				l.advance()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	l.skipSpaceAndComments()
+	pos := l.pos()
+	if l.off >= len(l.src) {
+		return token{kind: tkEOF, pos: pos}, nil
+	}
+	switch r := l.peek(0); {
+	case r == '\'':
+		text, err := l.quoted('\'')
+		return token{kind: tkString, text: text, pos: pos}, err
+	case r == '"':
+		text, err := l.quoted('"')
+		return token{kind: tkQuotedIdent, text: text, pos: pos}, err
+	case r == '?':
+		l.advance()
+		return token{kind: tkPlaceholder, text: "?", pos: pos}, nil
+	case r == '$' && unicode.IsDigit(l.peek(1)):
+		l.advance()
+		return token{kind: tkPlaceholder, text: "$" + l.run(unicode.IsDigit), pos: pos}, nil
+	case r == ':' && isIdentStart(l.peek(1)):
+		l.advance()
+		return token{kind: tkPlaceholder, text: ":" + l.run(isWordPart), pos: pos}, nil
+	case unicode.IsDigit(r):
+		text := l.word()
+		if isNumber(text) {
+			return token{kind: tkNumber, text: text, pos: pos}, nil
+		}
+		return token{kind: tkIdent, text: text, pos: pos}, nil
+	case isIdentStart(r), r == '.' && (l.peek(1) == '/' || l.peek(1) == '.'), r == '/':
+		return token{kind: tkIdent, text: l.word(), pos: pos}, nil
+	case r == '<' || r == '>' || r == '!':
+		l.advance()
+		if l.peek(0) == '=' {
+			l.advance()
+			return token{kind: tkSymbol, text: string(r) + "=", pos: pos}, nil
+		}
+		if r == '<' && l.peek(0) == '>' {
+			l.advance()
+			return token{kind: tkSymbol, text: "<>", pos: pos}, nil
+		}
+		if r == '!' {
+			return token{}, l.errorf(pos, "unexpected character '!'")
+		}
+		return token{kind: tkSymbol, text: string(r), pos: pos}, nil
+	case r == '-' && l.peek(1) == '>':
+		l.advance()
+		l.advance()
+		if l.peek(0) == '>' {
+			l.advance()
+			return token{kind: tkSymbol, text: "->>", pos: pos}, nil
+		}
+		return token{kind: tkSymbol, text: "->", pos: pos}, nil
+	case strings.ContainsRune("(),;=*+-.", r):
+		l.advance()
+		return token{kind: tkSymbol, text: string(r), pos: pos}, nil
+	default:
+		return token{}, l.errorf(pos, "unexpected character '%c'", r)
+	}
+}
+
+// quoted reads a literal enclosed in quote; a doubled quote escapes it
+func (l *lexer) quoted(quote rune) (string, error) {
+	start := l.pos()
+	l.advance()
+	var b strings.Builder
+	for l.off < len(l.src) {
+		r := l.advance()
+		if r != quote {
+			b.WriteRune(r)
+			continue
+		}
+		if l.peek(0) != quote {
+			return b.String(), nil
+		}
+		b.WriteRune(l.advance())
+	}
+	return "", l.errorf(start, "unterminated quoted literal")
+}
+
+func (l *lexer) run(accept func(r rune) bool) string {
+	start := l.off
+	for l.off < len(l.src) && accept(l.peek(0)) {
+		l.advance()
+	}
+	return string(l.src[start:l.off])
+}
+
+// word reads a bare word; a '-' belongs to the word only between two
+// identifier characters, so user-1 and UUIDs stay one word while
+// value - 5 and a -> path operator do not
+func (l *lexer) word() string {
+	start := l.off
+	for l.off < len(l.src) {
+		if r := l.peek(0); !isIdentPart(r) && !(r == '-' && isIdentPart(l.peek(1))) {
+			break
+		}
+		l.advance()
+	}
+	return string(l.src[start:l.off])
+}
+
+func isIdentStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+func isWordPart(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// isIdentPart accepts the characters of bare keys and file paths
+// such as user:1 or ./data/persons.csv; word also keeps an inner '-'
+func isIdentPart(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.:/", r)
+}
+
+func isNumber(text string) bool {
+	seenDot := false
+	for _, r := range text {
+		switch {
+		case unicode.IsDigit(r):
+		case r == '.' && !seenDot:
+			seenDot = true
+		default:
+			return false
+		}
+	}
+	return !strings.HasSuffix(text, ".")
+}
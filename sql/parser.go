@@ -0,0 +1,791 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parser is a recursive descent parser over the tokens of one statement
+type parser struct {
+	tokens []token
+	off    int
+	// positional counts the ? placeholders seen so far
+	positional int
+	// ordinals is the highest ordinal of a positional placeholder
+	ordinals int
+	// named is set once a :<name> placeholder is seen
+	named bool
+}
+
+// parseStatement parses src into the AST of a single statement and
+// returns the number of arguments it takes, or -1 when it has named
+// placeholders. A trailing semicolon is optional.
+func parseStatement(src string) (Statement, int, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	p := &parser{tokens: tokens}
+	stmt, err := p.statement()
+	if err != nil {
+		return nil, 0, err
+	}
+	p.acceptSymbol(";")
+	if tkn := p.peek(); tkn.kind != tkEOF {
+		return nil, 0, p.errorf(tkn, "unexpected %s after the end of the statement", tkn)
+	}
+	if p.named {
+		return stmt, -1, nil
+	}
+	return stmt, p.ordinals, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.off]
+}
+
+func (p *parser) peekAt(n int) token {
+	if p.off+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.off+n]
+}
+
+func (p *parser) next() token {
+	tkn := p.tokens[p.off]
+	if tkn.kind != tkEOF {
+		p.off++
+	}
+	return tkn
+}
+
+func (p *parser) errorf(tkn token, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: tkn.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isKeyword(tkn token, keyword string) bool {
+	return tkn.kind == tkIdent && strings.EqualFold(tkn.text, keyword)
+}
+
+func isSymbol(tkn token, symbol string) bool {
+	return tkn.kind == tkSymbol && tkn.text == symbol
+}
+
+func (p *parser) acceptKeyword(keyword string) bool {
+	if isKeyword(p.peek(), keyword) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if tkn := p.next(); !isKeyword(tkn, keyword) {
+		return p.errorf(tkn, "expected %s, found %s", keyword, tkn)
+	}
+	return nil
+}
+
+func (p *parser) acceptSymbol(symbol string) bool {
+	if isSymbol(p.peek(), symbol) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectSymbol(symbol string) error {
+	if tkn := p.next(); !isSymbol(tkn, symbol) {
+		return p.errorf(tkn, "expected '%s', found %s", symbol, tkn)
+	}
+	return nil
+}
+
+// ident parses an identifier; what describes it in errors
+func (p *parser) ident(what string) (*Ident, error) {
+	tkn := p.next()
+	if tkn.kind != tkIdent && tkn.kind != tkQuotedIdent {
+		return nil, p.errorf(tkn, "expected %s, found %s", what, tkn)
+	}
+	return &Ident{Pos: tkn.pos, Name: tkn.text}, nil
+}
+
+// expr parses a literal or a placeholder. Bare words are literals,
+// so keys can be written without quotes.
+func (p *parser) expr() (Expr, error) {
+	tkn := p.next()
+	switch tkn.kind {
+	case tkString, tkNumber, tkIdent:
+		return &Literal{Pos: tkn.pos, Value: tkn.text}, nil
+	case tkPlaceholder:
+		return p.placeholder(tkn)
+	case tkSymbol:
+		if tkn.text == "-" && p.peek().kind == tkNumber {
+			return &Literal{Pos: tkn.pos, Value: "-" + p.next().text}, nil
+		}
+	}
+	return nil, p.errorf(tkn, "expected a value, found %s", tkn)
+}
+
+func (p *parser) placeholder(tkn token) (Expr, error) {
+	var n int
+	switch tkn.text[0] {
+	case '?':
+		p.positional++
+		n = p.positional
+	case '$':
+		var err error
+		if n, err = strconv.Atoi(tkn.text[1:]); err != nil || n < 1 {
+			return nil, p.errorf(tkn, "invalid placeholder %s", tkn)
+		}
+	default:
+		p.named = true
+		return &Placeholder{Pos: tkn.pos, Name: tkn.text[1:]}, nil
+	}
+	if n > p.ordinals {
+		p.ordinals = n
+	}
+	return &Placeholder{Pos: tkn.pos, Ordinal: n}, nil
+}
+
+func (p *parser) statement() (Statement, error) {
+	tkn := p.peek()
+	if tkn.kind != tkIdent {
+		return nil, p.errorf(tkn, "expected a statement, found %s", tkn)
+	}
+	switch strings.ToLower(tkn.text) {
+	case "select":
+		return p.selectStmt()
+	case "insert":
+		return p.insertStmt()
+	case "update":
+		return p.updateStmt()
+	case "delete":
+		return p.deleteStmt()
+	case "copy":
+		return p.copyStmt()
+	case "create":
+		return p.createTableStmt()
+	case "alter":
+		return p.alterTableStmt()
+	case "drop":
+		p.next()
+		table, err := p.tableClause()
+		return &DropTableStmt{Table: table}, err
+	case "truncate":
+		p.next()
+		table, err := p.tableClause()
+		return &TruncateTableStmt{Table: table}, err
+	case "show":
+		p.next()
+		return &ShowTablesStmt{}, p.expectKeyword("tables")
+	case "describe":
+		p.next()
+		table, err := p.ident("table name")
+		return &DescribeStmt{Table: table}, err
+	case "dump":
+		p.next()
+		table, err := p.ident("table name")
+		return &DumpStmt{Table: table}, err
+	case "explain":
+		p.next()
+		stmt := &ExplainStmt{Analyze: p.acceptKeyword("analyze")}
+		if isKeyword(p.peek(), "explain") {
+			return nil, p.errorf(p.peek(), "explain cannot explain itself")
+		}
+		var err error
+		stmt.Stmt, err = p.statement()
+		return stmt, err
+	default:
+		return nil, p.errorf(tkn, "unknown statement %s", tkn)
+	}
+}
+
+// tableClause parses table <name>
+func (p *parser) tableClause() (*Ident, error) {
+	if err := p.expectKeyword("table"); err != nil {
+		return nil, err
+	}
+	return p.ident("table name")
+}
+
+// select <items> from <table> [join ...] [where ...] [group by prefix(...)]
+// [order by <column> [asc|desc]] [limit <n>] [after <cursor>]
+func (p *parser) selectStmt() (*SelectStmt, error) {
+	p.next()
+	stmt := &SelectStmt{}
+	for {
+		item, err := p.selectItem()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Items = append(stmt.Items, item)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	var err error
+	if err = p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if stmt.Join, err = p.join(); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("group") {
+		if stmt.GroupBy, err = p.groupBy(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("order") {
+		if err = p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		stmt.OrderBy = &OrderBy{}
+		if stmt.OrderBy.Column, err = p.ident("column"); err != nil {
+			return nil, err
+		}
+		if p.acceptKeyword("desc") {
+			stmt.OrderBy.Desc = true
+		} else {
+			p.acceptKeyword("asc")
+		}
+	}
+	if p.acceptKeyword("limit") {
+		if stmt.Limit, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if p.acceptKeyword("after") {
+		if stmt.After, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// selectItem parses *, <column>, <func>(<column>) or <func>(*), where
+// a column may be followed by a json path; a bare count is count(*)
+func (p *parser) selectItem() (*SelectItem, error) {
+	tkn := p.next()
+	if isSymbol(tkn, "*") {
+		return &SelectItem{Pos: tkn.pos, Column: "*"}, nil
+	}
+	if tkn.kind != tkIdent && tkn.kind != tkQuotedIdent {
+		return nil, p.errorf(tkn, "expected a column, found %s", tkn)
+	}
+	item := &SelectItem{Pos: tkn.pos, Column: tkn.text}
+	if !p.acceptSymbol("(") {
+		if isKeyword(tkn, "count") {
+			item.Func, item.Column = "count", "*"
+			return item, nil
+		}
+		var err error
+		item.Path, err = p.jsonPath()
+		return item, err
+	}
+	item.Func = strings.ToLower(tkn.text)
+	arg := p.next()
+	switch {
+	case isSymbol(arg, "*"):
+		item.Column = arg.text
+	case arg.kind == tkIdent || arg.kind == tkQuotedIdent:
+		item.Column = arg.text
+		var err error
+		if item.Path, err = p.jsonPath(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, p.errorf(arg, "expected a column, found %s", arg)
+	}
+	return item, p.expectSymbol(")")
+}
+
+// join parses an optional [inner | left [outer]] join <table> on
+// <column> = <column> clause
+func (p *parser) join() (*Join, error) {
+	tkn := p.peek()
+	j := &Join{Pos: tkn.pos}
+	switch {
+	case isKeyword(tkn, "inner"):
+		p.next()
+	case isKeyword(tkn, "left"):
+		p.next()
+		j.Outer = true
+		p.acceptKeyword("outer")
+	case !isKeyword(tkn, "join"):
+		return nil, nil
+	}
+	if err := p.expectKeyword("join"); err != nil {
+		return nil, err
+	}
+	var err error
+	if j.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if err = p.expectKeyword("on"); err != nil {
+		return nil, err
+	}
+	if j.Left, err = p.ident("column"); err != nil {
+		return nil, err
+	}
+	if err = p.expectSymbol("="); err != nil {
+		return nil, err
+	}
+	if j.Right, err = p.ident("column"); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// groupBy parses the by prefix(<column>, <separator>, <parts>) of a
+// group by clause
+func (p *parser) groupBy() (*GroupBy, error) {
+	if err := p.expectKeyword("by"); err != nil {
+		return nil, err
+	}
+	tkn := p.next()
+	if !isKeyword(tkn, "prefix") {
+		return nil, p.errorf(tkn, "expected prefix, found %s", tkn)
+	}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	g := &GroupBy{Pos: tkn.pos}
+	var err error
+	if g.Column, err = p.ident("column"); err != nil {
+		return nil, err
+	}
+	if err = p.expectSymbol(","); err != nil {
+		return nil, err
+	}
+	if g.Separator, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if err = p.expectSymbol(","); err != nil {
+		return nil, err
+	}
+	if g.Parts, err = p.expr(); err != nil {
+		return nil, err
+	}
+	return g, p.expectSymbol(")")
+}
+
+// where parses an optional where clause of comparisons joined by and
+func (p *parser) where() (Condition, error) {
+	if !p.acceptKeyword("where") {
+		return nil, nil
+	}
+	return p.or()
+}
+
+// or parses conditions joined by or, which binds looser than and
+func (p *parser) or() (Condition, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for isKeyword(p.peek(), "or") {
+		tkn := p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Pos: tkn.pos, Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (Condition, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for isKeyword(p.peek(), "and") {
+		tkn := p.next()
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Pos: tkn.pos, Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// not parses a negated condition, a parenthesized condition or a comparison
+func (p *parser) not() (Condition, error) {
+	tkn := p.peek()
+	switch {
+	case isKeyword(tkn, "not"):
+		p.next()
+		cond, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Pos: tkn.pos, Cond: cond}, nil
+	case isSymbol(tkn, "("):
+		p.next()
+		cond, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return cond, nil
+	default:
+		return p.comparison()
+	}
+}
+
+var comparisonOps = map[string]bool{
+	"=": true, "<>": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+func (p *parser) comparison() (*Comparison, error) {
+	column, err := p.ident("column")
+	if err != nil {
+		return nil, err
+	}
+	cmp := &Comparison{Pos: column.Pos, Column: column}
+	if cmp.Path, err = p.jsonPath(); err != nil {
+		return nil, err
+	}
+	tkn := p.next()
+	switch {
+	case tkn.kind == tkSymbol && comparisonOps[tkn.text]:
+		cmp.Op = tkn.text
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		cmp.Args = []Expr{arg}
+	case isKeyword(tkn, "between"):
+		cmp.Op = "between"
+		low, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectKeyword("and"); err != nil {
+			return nil, err
+		}
+		high, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		cmp.Args = []Expr{low, high}
+	case isKeyword(tkn, "in"):
+		cmp.Op = "in"
+		if cmp.Args, err = p.exprList(); err != nil {
+			return nil, err
+		}
+	case isKeyword(tkn, "like"):
+		cmp.Op = "like"
+		pattern, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		cmp.Args = []Expr{pattern}
+	default:
+		return nil, p.errorf(tkn, "expected a comparison operator, found %s", tkn)
+	}
+	return cmp, nil
+}
+
+// jsonPath parses the -> '<path>' or ->> '<path>' following a column,
+// if there is one
+func (p *parser) jsonPath() (*JSONPath, error) {
+	tkn := p.peek()
+	if !isSymbol(tkn, "->") && !isSymbol(tkn, "->>") {
+		return nil, nil
+	}
+	p.next()
+	path := p.next()
+	if path.kind != tkString {
+		return nil, p.errorf(path, "expected a quoted json path, found %s", path)
+	}
+	return &JSONPath{Pos: path.pos, Path: path.text, Text: tkn.text == "->>"}, nil
+}
+
+// exprList parses a parenthesized, comma separated list of values
+func (p *parser) exprList() ([]Expr, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var list []Expr
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, e)
+		if !p.acceptSymbol(",") {
+			return list, p.expectSymbol(")")
+		}
+	}
+}
+
+// insert into <table> set key = <key>, value = <value>
+// insert into <table> [(<columns>)] values (<values>), ...
+// insert into <table> [(key, value)] select ...
+func (p *parser) insertStmt() (*InsertStmt, error) {
+	p.next()
+	if err := p.expectKeyword("into"); err != nil {
+		return nil, err
+	}
+	stmt := &InsertStmt{}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if p.acceptKeyword("set") {
+		return stmt, p.insertSet(stmt)
+	}
+	columns := []*Ident{{Name: keyColumn}, {Name: valueColumn}}
+	if isSymbol(p.peek(), "(") {
+		if columns, err = p.columnList(); err != nil {
+			return nil, err
+		}
+	}
+	switch tkn := p.peek(); {
+	case isKeyword(tkn, "values"):
+		p.next()
+		return stmt, p.insertValues(stmt, columns)
+	case isKeyword(tkn, "select"):
+		if len(columns) != 2 || !strings.EqualFold(columns[0].Name, keyColumn) ||
+			!strings.EqualFold(columns[1].Name, valueColumn) {
+			return nil, &SyntaxError{Pos: columns[0].Pos, Msg: "insert select writes the columns key, value"}
+		}
+		stmt.Select, err = p.selectStmt()
+		return stmt, err
+	default:
+		return nil, p.errorf(tkn, "expected set, values or select, found %s", tkn)
+	}
+}
+
+// insertSet parses the key = <key>, value = <value> of an insert
+func (p *parser) insertSet(stmt *InsertStmt) error {
+	for {
+		column, err := p.ident("column")
+		if err != nil {
+			return err
+		}
+		if err = p.expectSymbol("="); err != nil {
+			return err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return err
+		}
+		switch strings.ToLower(column.Name) {
+		case "key":
+			stmt.Key = value
+		case "value":
+			stmt.Value = value
+		default:
+			return &SyntaxError{Pos: column.Pos, Msg: fmt.Sprintf("unknown column %s", column.Name)}
+		}
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if stmt.Key == nil {
+		return p.errorf(p.peek(), "insert requires a key")
+	}
+	return nil
+}
+
+// columnList parses a parenthesized list of the columns key and value
+func (p *parser) columnList() ([]*Ident, error) {
+	open := p.next()
+	var columns []*Ident
+	seen := make(map[string]bool)
+	for {
+		column, err := p.ident("column")
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(column.Name)
+		switch {
+		case name != keyColumn && name != valueColumn:
+			return nil, &SyntaxError{Pos: column.Pos, Msg: fmt.Sprintf("unknown column %s", column.Name)}
+		case seen[name]:
+			return nil, &SyntaxError{Pos: column.Pos, Msg: fmt.Sprintf("duplicate column %s", column.Name)}
+		}
+		seen[name] = true
+		columns = append(columns, column)
+		if !p.acceptSymbol(",") {
+			break
+		}
+	}
+	if !seen[keyColumn] {
+		return nil, p.errorf(open, "insert requires a key")
+	}
+	return columns, p.expectSymbol(")")
+}
+
+// insertValues parses the rows of a values list, each with a value for
+// every column
+func (p *parser) insertValues(stmt *InsertStmt, columns []*Ident) error {
+	for {
+		open := p.peek()
+		values, err := p.exprList()
+		if err != nil {
+			return err
+		}
+		if len(values) != len(columns) {
+			return p.errorf(open, "expected %d values, found %d", len(columns), len(values))
+		}
+		row := &InsertRow{}
+		for i, column := range columns {
+			if strings.EqualFold(column.Name, keyColumn) {
+				row.Key = values[i]
+			} else {
+				row.Value = values[i]
+			}
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.acceptSymbol(",") {
+			return nil
+		}
+	}
+}
+
+// update <table> set value = <value> [where ...]
+// update <table> set value = value (+|-) <operand> [where ...]
+func (p *parser) updateStmt() (*UpdateStmt, error) {
+	p.next()
+	stmt := &UpdateStmt{}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if err = p.expectKeyword("set"); err != nil {
+		return nil, err
+	}
+	if err = p.expectKeyword("value"); err != nil {
+		return nil, err
+	}
+	if err = p.expectSymbol("="); err != nil {
+		return nil, err
+	}
+	switch tkn, op := p.peek(), p.peekAt(1); {
+	case isKeyword(tkn, "value") && (isSymbol(op, "+") || isSymbol(op, "-")):
+		p.next()
+		stmt.Operator = p.next().text
+	case tkn.kind == tkIdent && len(tkn.text) > len("value-") &&
+		strings.EqualFold(tkn.text[:len("value-")], "value-") && isNumber(tkn.text[len("value-"):]):
+		// value-5 lexes as one word because bare keys may hold a '-'
+		p.next()
+		stmt.Operator = "-"
+		pos := tkn.pos
+		pos.Column += len("value-")
+		stmt.Value = &Literal{Pos: pos, Value: tkn.text[len("value-"):]}
+	}
+	if stmt.Value == nil {
+		if stmt.Value, err = p.expr(); err != nil {
+			return nil, err
+		}
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// delete from <table> [where ...]
+func (p *parser) deleteStmt() (*DeleteStmt, error) {
+	p.next()
+	if err := p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	stmt := &DeleteStmt{}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// copy <table> from <file>
+func (p *parser) copyStmt() (*CopyStmt, error) {
+	p.next()
+	stmt := &CopyStmt{}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if err = p.expectKeyword("from"); err != nil {
+		return nil, err
+	}
+	if stmt.File, err = p.expr(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// create table <table> [with (<option> = <value>, ...)]
+func (p *parser) createTableStmt() (*CreateTableStmt, error) {
+	p.next()
+	table, err := p.tableClause()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &CreateTableStmt{Table: table}
+	if p.acceptKeyword("with") {
+		if stmt.Options, err = p.options(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// alter table <table> set (<option> = <value>, ...)
+func (p *parser) alterTableStmt() (*AlterTableStmt, error) {
+	p.next()
+	table, err := p.tableClause()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expectKeyword("set"); err != nil {
+		return nil, err
+	}
+	stmt := &AlterTableStmt{Table: table}
+	if stmt.Options, err = p.options(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (p *parser) options() ([]*Option, error) {
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	var options []*Option
+	for {
+		name, err := p.ident("option name")
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, &Option{Pos: name.Pos, Name: strings.ToLower(name.Name), Value: value})
+		if !p.acceptSymbol(",") {
+			return options, p.expectSymbol(")")
+		}
+	}
+}
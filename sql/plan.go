@@ -0,0 +1,986 @@
+package sql
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	gdb "github.com/blong14/gache/internal/db"
+)
+
+// planner turns a statement's AST into the query that executes it,
+// binding its placeholders to args
+type planner struct {
+	args []driver.NamedValue
+	// slots is set while planning a template; see newTemplate
+	slots map[string]*Placeholder
+	// inspected is set once the template's plan depends on the value
+	// of a placeholder
+	inspected bool
+}
+
+// queryPlan is the query that executes a statement and the columns
+// of the rows it returns
+type queryPlan struct {
+	query *gdb.Query
+	// columns are the columns a select list projects, one for each of
+	// the query's projections; nil keeps the columns of the response
+	columns []column
+	// explain describes the query instead of returning its rows
+	explain bool
+	// analyze runs an explained query; planning took planTime
+	analyze  bool
+	planTime time.Duration
+}
+
+func plan(stmt Statement, args []driver.NamedValue) (*queryPlan, error) {
+	if stmt, ok := stmt.(*ExplainStmt); ok {
+		return planExplain(stmt, args)
+	}
+	return (&planner{args: args}).plan(stmt)
+}
+
+func (p *planner) plan(stmt Statement) (*queryPlan, error) {
+	query := gdb.NewQuery(context.Background(), nil)
+	qp := &queryPlan{query: query}
+	var err error
+	switch stmt := stmt.(type) {
+	case *SelectStmt:
+		err = p.selectStmt(qp, stmt)
+	case *InsertStmt:
+		err = p.insertStmt(qp, stmt)
+	case *UpdateStmt:
+		err = p.updateStmt(query, stmt)
+	case *DeleteStmt:
+		err = p.deleteStmt(query, stmt)
+	case *CopyStmt:
+		query.Header.Inst = gdb.Load
+		query.Header.TableName = []byte(stmt.Table.Name)
+		query.Header.FileName, err = p.value(stmt.File)
+	case *CreateTableStmt:
+		err = p.createTableStmt(query, stmt)
+	case *AlterTableStmt:
+		query.Header.Inst = gdb.AlterTable
+		query.Header.TableName = []byte(stmt.Table.Name)
+		query.Values, err = p.options(stmt.Options)
+	case *DropTableStmt:
+		query.Header.Inst = gdb.DropTable
+		query.Header.TableName = []byte(stmt.Table.Name)
+	case *TruncateTableStmt:
+		query.Header.Inst = gdb.TruncateTable
+		query.Header.TableName = []byte(stmt.Table.Name)
+	case *ShowTablesStmt:
+		query.Header.Inst = gdb.ListTables
+	case *DescribeStmt:
+		query.Header.Inst = gdb.Print
+		query.Header.TableName = []byte(stmt.Table.Name)
+	case *DumpStmt:
+		query.Header.Inst = gdb.Range
+		query.Header.TableName = []byte(stmt.Table.Name)
+	default:
+		err = fmt.Errorf("%w: unsupported statement %T", gdb.ErrInvalidQuery, stmt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return qp, nil
+}
+
+func planExplain(stmt *ExplainStmt, args []driver.NamedValue) (*queryPlan, error) {
+	if _, ok := stmt.Stmt.(*SelectStmt); stmt.Analyze && !ok {
+		return nil, fmt.Errorf("%w: explain analyze only runs select statements", gdb.ErrInvalidQuery)
+	}
+	start := time.Now()
+	qp, err := plan(stmt.Stmt, args)
+	if err != nil {
+		return nil, err
+	}
+	qp.explain, qp.analyze, qp.planTime = true, stmt.Analyze, time.Since(start)
+	qp.query.Header.Analyze = stmt.Analyze
+	return qp, nil
+}
+
+// project adds columns computed by projections to the plan
+func (qp *queryPlan) project(projections ...gdb.Projection) {
+	for _, p := range projections {
+		qp.column(p.String(), p, false)
+	}
+}
+
+// column adds a column named name computed by a projection to the plan
+func (qp *queryPlan) column(name string, p gdb.Projection, nullable bool) {
+	c := column{name: name, typ: bytesType, field: len(qp.columns), nullable: nullable}
+	if p.Path != nil {
+		// a path that selects nothing is NULL
+		c.typ, c.nullable = jsonType, true
+		if p.Path.Text {
+			c.typ = textType
+		}
+	}
+	qp.columns = append(qp.columns, c)
+	qp.query.Project = append(qp.query.Project, p)
+}
+
+func planErrorf(pos Pos, format string, args ...interface{}) error {
+	return fmt.Errorf("%w at %s: %s", gdb.ErrInvalidQuery, pos, fmt.Sprintf(format, args...))
+}
+
+// value returns the bytes of a literal
+func (p *planner) value(e Expr) ([]byte, error) {
+	switch e := e.(type) {
+	case *Literal:
+		return []byte(e.Value), nil
+	case *Placeholder:
+		if p.slots != nil {
+			slot := "\x00" + e.String() + "\x00"
+			p.slots[slot] = e
+			return []byte(slot), nil
+		}
+		for _, arg := range p.args {
+			if e.Name != "" && arg.Name == e.Name || e.Name == "" && arg.Ordinal == e.Ordinal {
+				v, ok := arg.Value.([]byte)
+				if !ok {
+					return nil, planErrorf(e.Pos, "unsupported argument type %T for %s", arg.Value, e)
+				}
+				return v, nil
+			}
+		}
+		return nil, planErrorf(e.Pos, "missing argument for %s", e)
+	default:
+		return nil, fmt.Errorf("%w: unsupported expression %T", gdb.ErrInvalidQuery, e)
+	}
+}
+
+// inspect returns the bytes of a literal the plan depends on, such as
+// a limit, so a template cannot be planned with a placeholder there
+func (p *planner) inspect(e Expr) ([]byte, error) {
+	if _, ok := e.(*Placeholder); ok && p.slots != nil {
+		p.inspected = true
+	}
+	return p.value(e)
+}
+
+// keyPlan is what the comparisons of a where clause say about keys
+type keyPlan struct {
+	// point is set by key = <key>
+	point []byte
+	// keys is set by key in (...)
+	keys [][]byte
+	kr   gdb.KeyRange
+}
+
+// where splits a where clause into the key comparisons joined to it
+// by and, which bound the keys read, and a filter on the values of
+// the rows read
+func (p *planner) where(cond Condition) ([]*Comparison, *gdb.Predicate, error) {
+	var keys []*Comparison
+	var filters []*gdb.Predicate
+	for _, c := range conjuncts(cond) {
+		if cmp, ok := c.(*Comparison); ok && strings.EqualFold(cmp.Column.Name, keyColumn) && cmp.Path == nil {
+			keys = append(keys, cmp)
+			continue
+		}
+		filter, err := p.filter(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		filters = append(filters, filter)
+	}
+	return keys, conjunction(filters), nil
+}
+
+// conjunction returns a predicate matching the values all filters match
+func conjunction(filters []*gdb.Predicate) *gdb.Predicate {
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	default:
+		return gdb.NewLogical(gdb.And, filters...)
+	}
+}
+
+// conjuncts returns the conditions joined by the top level ands of cond
+func conjuncts(cond Condition) []Condition {
+	if cond == nil {
+		return nil
+	}
+	if l, ok := cond.(*Logical); ok && l.Op == "and" {
+		return append(conjuncts(l.Left), conjuncts(l.Right)...)
+	}
+	return []Condition{cond}
+}
+
+var predicateOps = map[string]gdb.PredicateOp{
+	"=":    gdb.Equal,
+	"<>":   gdb.NotEqual,
+	"<":    gdb.Less,
+	"<=":   gdb.LessOrEqual,
+	">":    gdb.Greater,
+	">=":   gdb.GreaterOrEqual,
+	"like": gdb.Like,
+}
+
+// filter compiles a condition on values into a predicate
+func (p *planner) filter(cond Condition) (*gdb.Predicate, error) {
+	switch c := cond.(type) {
+	case *Logical:
+		left, err := p.filter(c.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.filter(c.Right)
+		if err != nil {
+			return nil, err
+		}
+		op := gdb.And
+		if c.Op == "or" {
+			op = gdb.Or
+		}
+		return gdb.NewLogical(op, left, right), nil
+	case *Not:
+		arg, err := p.filter(c.Cond)
+		if err != nil {
+			return nil, err
+		}
+		return gdb.NewLogical(gdb.Not, arg), nil
+	case *Comparison:
+		return p.valueComparison(c)
+	default:
+		return nil, fmt.Errorf("%w: unsupported condition %T", gdb.ErrInvalidQuery, cond)
+	}
+}
+
+func (p *planner) valueComparison(cmp *Comparison) (*gdb.Predicate, error) {
+	switch {
+	case strings.EqualFold(cmp.Column.Name, keyColumn) && cmp.Path != nil:
+		return nil, planErrorf(cmp.Path.Pos, "json paths are only supported on value")
+	case strings.EqualFold(cmp.Column.Name, keyColumn):
+		return nil, planErrorf(cmp.Pos, "key conditions cannot be combined with or and not")
+	case !strings.EqualFold(cmp.Column.Name, valueColumn):
+		return nil, planErrorf(cmp.Column.Pos, "unsupported column %s", cmp.Column.Name)
+	}
+	args, err := p.values(cmp.Args)
+	if err != nil {
+		return nil, err
+	}
+	path, err := p.jsonPath(cmp.Path)
+	if err != nil {
+		return nil, err
+	}
+	compare := func(op gdb.PredicateOp, operand []byte) *gdb.Predicate {
+		pred := gdb.NewComparison(op, operand)
+		pred.Path = path
+		return pred
+	}
+	switch cmp.Op {
+	case "between":
+		return gdb.NewLogical(gdb.And,
+			compare(gdb.GreaterOrEqual, args[0]),
+			compare(gdb.LessOrEqual, args[1])), nil
+	case "in":
+		in := make([]*gdb.Predicate, len(args))
+		for i, arg := range args {
+			in[i] = compare(gdb.Equal, arg)
+		}
+		return gdb.NewLogical(gdb.Or, in...), nil
+	default:
+		op, ok := predicateOps[cmp.Op]
+		if !ok {
+			return nil, planErrorf(cmp.Pos, "unsupported value comparison %s", cmp.Op)
+		}
+		return compare(op, args[0]), nil
+	}
+}
+
+// jsonPath parses the path of a column, which may have none
+func (p *planner) jsonPath(path *JSONPath) (*gdb.JSONPath, error) {
+	if path == nil {
+		return nil, nil
+	}
+	parsed, err := gdb.ParseJSONPath(path.Path, path.Text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path.Pos, err)
+	}
+	return parsed, nil
+}
+
+// values returns the bytes of each expression
+func (p *planner) values(exprs []Expr) ([][]byte, error) {
+	values := make([][]byte, len(exprs))
+	for i, e := range exprs {
+		v, err := p.value(e)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// keys plans the key comparisons of a where clause
+func (p *planner) keys(where []*Comparison) (*keyPlan, error) {
+	kp := &keyPlan{}
+	var bounded bool
+	for _, cmp := range where {
+		if (kp.point != nil || kp.keys != nil) || ((cmp.Op == "=" || cmp.Op == "in") && bounded) {
+			return nil, planErrorf(cmp.Pos, "key %s cannot be combined with other key conditions", cmp.Op)
+		}
+		args, err := p.values(cmp.Args)
+		if err != nil {
+			return nil, err
+		}
+		bounded = true
+		switch cmp.Op {
+		case "=":
+			kp.point = args[0]
+		case "in":
+			kp.keys = args
+		case "between":
+			if kp.kr.Start != nil || kp.kr.End != nil {
+				return nil, planErrorf(cmp.Pos, "key is already bounded")
+			}
+			kp.kr.Start, kp.kr.End = args[0], args[1]
+		case ">", ">=":
+			if kp.kr.Start != nil {
+				return nil, planErrorf(cmp.Pos, "key already has a lower bound")
+			}
+			kp.kr.Start, kp.kr.StartExclusive = args[0], cmp.Op == ">"
+		case "<", "<=":
+			if kp.kr.End != nil {
+				return nil, planErrorf(cmp.Pos, "key already has an upper bound")
+			}
+			kp.kr.End, kp.kr.EndExclusive = args[0], cmp.Op == "<"
+		case "like":
+			if _, err = p.inspect(cmp.Args[0]); err != nil {
+				return nil, err
+			}
+			pattern := string(args[0])
+			prefix := strings.TrimSuffix(pattern, "%")
+			if prefix == pattern || strings.ContainsAny(prefix, "%_") {
+				return nil, planErrorf(cmp.Args[0].Position(), "unsupported key pattern %s", pattern)
+			}
+			kp.kr.Prefix = []byte(prefix)
+		default:
+			return nil, planErrorf(cmp.Pos, "unsupported key comparison %s", cmp.Op)
+		}
+	}
+	return kp, nil
+}
+
+func (p *planner) selectStmt(qp *queryPlan, stmt *SelectStmt) error {
+	query := qp.query
+	query.Header.TableName = []byte(stmt.Table.Name)
+	query.Header.Inst = gdb.GetRange
+	if stmt.Join != nil {
+		return p.joinStmt(qp, stmt)
+	}
+	for _, item := range stmt.Items {
+		if item.Func != "" || stmt.GroupBy != nil {
+			return p.aggregateStmt(qp, stmt)
+		}
+	}
+	for _, item := range stmt.Items {
+		switch {
+		case item.Column == "*" && len(stmt.Items) == 1:
+			// rows are their key and value without a projection
+		case item.Column == "*":
+			qp.project(gdb.Projection{Column: keyColumn}, gdb.Projection{Column: valueColumn})
+		case strings.EqualFold(item.Column, keyColumn) && item.Path == nil:
+			qp.project(gdb.Projection{Column: keyColumn})
+		case strings.EqualFold(item.Column, valueColumn):
+			path, err := p.jsonPath(item.Path)
+			if err != nil {
+				return err
+			}
+			qp.project(gdb.Projection{Column: valueColumn, Path: path})
+		case item.Path != nil:
+			return planErrorf(item.Path.Pos, "json paths are only supported on value")
+		default:
+			return planErrorf(item.Pos, "unknown column %s", item.Column)
+		}
+	}
+	keys, filter, err := p.where(stmt.Where)
+	if err != nil {
+		return err
+	}
+	kp, err := p.keys(keys)
+	if err != nil {
+		return err
+	}
+	switch {
+	case kp.point != nil:
+		query.Header.Inst = gdb.GetValue
+		query.Key = kp.point
+	case kp.keys != nil:
+		query.Header.Inst = gdb.BatchGetValue
+		for _, k := range kp.keys {
+			query.Values = append(query.Values, gdb.KeyValue{Key: k})
+		}
+	default:
+		query.KeyRange = kp.kr
+	}
+	query.KeyRange.Filter = filter
+	if query.Header.Inst != gdb.GetRange {
+		if stmt.OrderBy != nil || stmt.Limit != nil || stmt.After != nil {
+			return fmt.Errorf(
+				"%w: order, limit and after need a range of keys", gdb.ErrInvalidQuery)
+		}
+		return nil
+	}
+	return p.scanClauses(query, stmt, func(column *Ident) bool {
+		return strings.EqualFold(column.Name, keyColumn)
+	})
+}
+
+// scanClauses plans the order, limit and after clauses of a select
+// that scans a range of keys; isKey reports whether a column is the key
+func (p *planner) scanClauses(query *gdb.Query, stmt *SelectStmt, isKey func(column *Ident) bool) error {
+	if stmt.OrderBy != nil {
+		if !isKey(stmt.OrderBy.Column) {
+			return planErrorf(stmt.OrderBy.Column.Pos, "rows can only be ordered by key")
+		}
+		query.KeyRange.Reverse = stmt.OrderBy.Desc
+	}
+	if stmt.Limit != nil {
+		limit, err := p.inspect(stmt.Limit)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(string(limit))
+		if err != nil || n < 0 {
+			return planErrorf(stmt.Limit.Position(), "invalid limit %s", limit)
+		}
+		query.KeyRange.Limit = n
+	}
+	if stmt.After != nil {
+		var err error
+		if query.KeyRange.Cursor, err = p.value(stmt.After); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var aggregateFuncs = map[string]gdb.AggregateFunc{
+	"count": gdb.AggCount,
+	"sum":   gdb.AggSum,
+	"min":   gdb.AggMin,
+	"max":   gdb.AggMax,
+	"avg":   gdb.AggAvg,
+}
+
+// aggregateStmt plans a select of aggregate functions, which the
+// worker computes as it reads the rows. Grouped rows start with
+// their group.
+func (p *planner) aggregateStmt(qp *queryPlan, stmt *SelectStmt) error {
+	query := qp.query
+	query.Header.Inst = gdb.Aggregate
+	if stmt.OrderBy != nil || stmt.Limit != nil || stmt.After != nil {
+		return fmt.Errorf(
+			"%w: aggregates do not take an order, limit or after clause", gdb.ErrInvalidQuery)
+	}
+	if g := stmt.GroupBy; g != nil {
+		if !strings.EqualFold(g.Column.Name, keyColumn) {
+			return planErrorf(g.Column.Pos, "rows can only be grouped by a prefix of key")
+		}
+		sep, err := p.inspect(g.Separator)
+		if err != nil {
+			return err
+		}
+		parts, err := p.inspect(g.Parts)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(string(parts))
+		if err != nil || n < 1 || len(sep) == 0 {
+			return planErrorf(g.Pos, "invalid prefix(key, '%s', %s)", sep, parts)
+		}
+		query.GroupBy = &gdb.GroupBy{Separator: sep, Parts: n}
+		name := fmt.Sprintf("prefix(key, '%s', %d)", sep, n)
+		qp.columns = append(qp.columns, column{name: name, typ: bytesType})
+	}
+	for _, item := range stmt.Items {
+		fn, ok := aggregateFuncs[item.Func]
+		switch {
+		case item.Func == "":
+			return planErrorf(item.Pos, "%s must be an aggregate function", item.Column)
+		case !ok:
+			return planErrorf(item.Pos, "unsupported function %s", item.Func)
+		}
+		agg := gdb.Aggregation{Func: fn}
+		switch {
+		case item.Column == "*" && fn == gdb.AggCount:
+		case item.Column == "*":
+			return planErrorf(item.Pos, "%s needs a column", item.Func)
+		case strings.EqualFold(item.Column, valueColumn):
+			path, err := p.jsonPath(item.Path)
+			if err != nil {
+				return err
+			}
+			agg.Arg = &gdb.Projection{Column: valueColumn, Path: path}
+		default:
+			return planErrorf(item.Pos, "%s is only supported on value", item.Func)
+		}
+		c := column{name: agg.String(), typ: integerType, field: len(qp.columns)}
+		if fn != gdb.AggCount {
+			// aggregates of no numbers are NULL
+			c.typ, c.nullable = numericType, true
+		}
+		qp.columns = append(qp.columns, c)
+		query.Aggregates = append(query.Aggregates, agg)
+	}
+	keys, filter, err := p.where(stmt.Where)
+	if err != nil {
+		return err
+	}
+	kp, err := p.keys(keys)
+	if err != nil {
+		return err
+	}
+	switch {
+	case kp.point != nil:
+		query.KeyRange = gdb.KeyRange{Start: kp.point, End: kp.point}
+	case kp.keys != nil:
+		return fmt.Errorf("%w: aggregates need a range of keys", gdb.ErrInvalidQuery)
+	default:
+		query.KeyRange = kp.kr
+	}
+	query.KeyRange.Filter = filter
+	return nil
+}
+
+// joinTables are the tables of a join. Columns name their table as in
+// a.value, except key, which the tables share.
+type joinTables struct {
+	left, right string
+}
+
+// column resolves a column of a join to its name and whether it is
+// read from the joined table
+func (j joinTables) column(ident *Ident) (string, bool, error) {
+	table, name := "", ident.Name
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		table, name = name[:i], name[i+1:]
+	}
+	name = strings.ToLower(name)
+	if name != keyColumn && name != valueColumn {
+		return "", false, planErrorf(ident.Pos, "unknown column %s", ident.Name)
+	}
+	switch table {
+	case j.left:
+		return name, false, nil
+	case j.right:
+		return name, true, nil
+	case "":
+		if name == keyColumn {
+			return name, false, nil
+		}
+		return "", false, planErrorf(ident.Pos, "column %s is ambiguous; name its table", ident.Name)
+	default:
+		return "", false, planErrorf(ident.Pos, "unknown table %s", table)
+	}
+}
+
+// unqualify rewrites a condition on the columns of one table of a join
+// as a condition on that table's rows; joined reports which table it is
+func (j joinTables) unqualify(cond Condition) (out Condition, joined bool, err error) {
+	switch c := cond.(type) {
+	case *Logical:
+		left, ljoined, err := j.unqualify(c.Left)
+		if err != nil {
+			return nil, false, err
+		}
+		right, rjoined, err := j.unqualify(c.Right)
+		if err != nil {
+			return nil, false, err
+		}
+		if ljoined != rjoined {
+			return nil, false, planErrorf(c.Pos, "conditions combined with or and not must name one table")
+		}
+		return &Logical{Pos: c.Pos, Op: c.Op, Left: left, Right: right}, ljoined, nil
+	case *Not:
+		arg, joined, err := j.unqualify(c.Cond)
+		if err != nil {
+			return nil, false, err
+		}
+		return &Not{Pos: c.Pos, Cond: arg}, joined, nil
+	case *Comparison:
+		name, joined, err := j.column(c.Column)
+		if err != nil {
+			return nil, false, err
+		}
+		cmp := *c
+		cmp.Column = &Ident{Pos: c.Column.Pos, Name: name}
+		return &cmp, joined, nil
+	default:
+		return nil, false, fmt.Errorf("%w: unsupported condition %T", gdb.ErrInvalidQuery, cond)
+	}
+}
+
+// joinStmt plans a select that merge joins the rows of two tables with
+// the same key. The worker reads both tables in key order, so the rows
+// of a join are a range of the keys of its first table. A condition on
+// the joined table's value or key keeps only the rows that match it,
+// which turns a left join into an inner join.
+func (p *planner) joinStmt(qp *queryPlan, stmt *SelectStmt) error {
+	query := qp.query
+	tables := joinTables{left: stmt.Table.Name, right: stmt.Join.Table.Name}
+	if tables.left == tables.right {
+		return planErrorf(stmt.Join.Table.Pos, "a table cannot be joined with itself")
+	}
+	left, ljoined, err := tables.column(stmt.Join.Left)
+	if err != nil {
+		return err
+	}
+	right, rjoined, err := tables.column(stmt.Join.Right)
+	if err != nil {
+		return err
+	}
+	if left != keyColumn || right != keyColumn || ljoined == rjoined {
+		return planErrorf(stmt.Join.Pos, "tables can only be joined on their keys")
+	}
+	if stmt.GroupBy != nil {
+		return planErrorf(stmt.GroupBy.Pos, "joins cannot be grouped")
+	}
+	query.Header.Inst = gdb.JoinRange
+	join := &gdb.Join{Table: []byte(tables.right), Outer: stmt.Join.Outer}
+	query.Join = join
+	for _, item := range stmt.Items {
+		if item.Func != "" {
+			return planErrorf(item.Pos, "aggregates are not supported on joins")
+		}
+		if item.Column == "*" {
+			qp.column(keyColumn, gdb.Projection{Column: keyColumn}, false)
+			qp.column(tables.left+"."+valueColumn, gdb.Projection{Column: valueColumn}, false)
+			qp.column(tables.right+"."+valueColumn,
+				gdb.Projection{Column: valueColumn, Joined: true}, join.Outer)
+			continue
+		}
+		name, joined, err := tables.column(&Ident{Pos: item.Pos, Name: item.Column})
+		if err != nil {
+			return err
+		}
+		if name == keyColumn && item.Path != nil {
+			return planErrorf(item.Path.Pos, "json paths are only supported on value")
+		}
+		path, err := p.jsonPath(item.Path)
+		if err != nil {
+			return err
+		}
+		column := item.Column
+		if path != nil {
+			column += path.String()
+		}
+		qp.column(column, gdb.Projection{Column: name, Path: path, Joined: joined}, joined && join.Outer)
+	}
+	var keys []*Comparison
+	var filters, joinFilters []*gdb.Predicate
+	for _, c := range conjuncts(stmt.Where) {
+		cond, joined, err := tables.unqualify(c)
+		if err != nil {
+			return err
+		}
+		if cmp, ok := cond.(*Comparison); ok && cmp.Column.Name == keyColumn && cmp.Path == nil {
+			// the keys of joined rows are equal, so a bound on either
+			// bounds both, but left rows with no match fail the joined one
+			if joined {
+				join.Outer = false
+			}
+			keys = append(keys, cmp)
+			continue
+		}
+		filter, err := p.filter(cond)
+		if err != nil {
+			return err
+		}
+		if joined {
+			joinFilters = append(joinFilters, filter)
+			join.Outer = false
+		} else {
+			filters = append(filters, filter)
+		}
+	}
+	kp, err := p.keys(keys)
+	if err != nil {
+		return err
+	}
+	switch {
+	case kp.point != nil:
+		query.KeyRange = gdb.KeyRange{Start: kp.point, End: kp.point}
+	case kp.keys != nil:
+		return fmt.Errorf("%w: joins need a range of keys", gdb.ErrInvalidQuery)
+	default:
+		query.KeyRange = kp.kr
+	}
+	query.KeyRange.Filter = conjunction(filters)
+	join.Filter = conjunction(joinFilters)
+	return p.scanClauses(query, stmt, func(column *Ident) bool {
+		name, _, err := tables.column(column)
+		return err == nil && name == keyColumn
+	})
+}
+
+// writeKeys plans the where clause of a statement that writes keys,
+// which cannot filter on values
+func (p *planner) writeKeys(where Condition, verb string) (*keyPlan, error) {
+	keys, filter, err := p.where(where)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		return nil, fmt.Errorf("%w: %s cannot filter on value", gdb.ErrInvalidQuery, verb)
+	}
+	return p.keys(keys)
+}
+
+func (p *planner) insertStmt(qp *queryPlan, stmt *InsertStmt) error {
+	query := qp.query
+	switch {
+	case stmt.Select != nil:
+		return p.insertSelect(qp, stmt)
+	case stmt.Rows != nil:
+		// the rows are written in one batch
+		query.Header.Inst = gdb.BatchSetValue
+		query.Header.TableName = []byte(stmt.Table.Name)
+		for _, row := range stmt.Rows {
+			var kv gdb.KeyValue
+			var err error
+			if kv.Key, err = p.value(row.Key); err != nil {
+				return err
+			}
+			if row.Value != nil {
+				if kv.Value, err = p.value(row.Value); err != nil {
+					return err
+				}
+			}
+			query.Values = append(query.Values, kv)
+		}
+		return nil
+	}
+	query.Header.Inst = gdb.SetValue
+	query.Header.TableName = []byte(stmt.Table.Name)
+	var err error
+	if query.Key, err = p.value(stmt.Key); err != nil {
+		return err
+	}
+	if stmt.Value != nil {
+		query.Value, err = p.value(stmt.Value)
+	}
+	return err
+}
+
+// insertSelect plans an insert of the rows a select reads, which the
+// proxy copies between the tables without returning them
+func (p *planner) insertSelect(qp *queryPlan, stmt *InsertStmt) error {
+	if err := p.selectStmt(qp, stmt.Select); err != nil {
+		return err
+	}
+	query := qp.query
+	switch query.Header.Inst {
+	case gdb.GetRange:
+	case gdb.GetValue:
+		query.KeyRange.Start, query.KeyRange.End = query.Key, query.Key
+		query.Key = nil
+	default:
+		return fmt.Errorf("%w: insert select needs a range of keys", gdb.ErrInvalidQuery)
+	}
+	if n := len(qp.columns); n != 0 && n != 2 {
+		return planErrorf(stmt.Select.Items[0].Pos, "insert select needs a key and a value, found %d columns", n)
+	}
+	if len(qp.columns) == 2 && qp.query.Project[0].Column != keyColumn {
+		return planErrorf(stmt.Select.Items[0].Pos, "insert select needs key as its first column")
+	}
+	query.Header.Inst = gdb.InsertRange
+	query.Header.Source = query.Header.TableName
+	query.Header.TableName = []byte(stmt.Table.Name)
+	qp.columns = nil
+	return nil
+}
+
+func (p *planner) updateStmt(query *gdb.Query, stmt *UpdateStmt) error {
+	query.Header.Inst = gdb.SetValue
+	query.Header.TableName = []byte(stmt.Table.Name)
+	kp, err := p.writeKeys(stmt.Where, "update")
+	if err != nil {
+		return err
+	}
+	if kp.point == nil {
+		return fmt.Errorf("%w: update needs a where key = <key> clause", gdb.ErrInvalidQuery)
+	}
+	query.Key = kp.point
+	valueOf := p.value
+	if stmt.Operator == "-" {
+		// the operand is negated, so the plan depends on its value
+		valueOf = p.inspect
+	}
+	value, err := valueOf(stmt.Value)
+	if err != nil {
+		return err
+	}
+	switch stmt.Operator {
+	case "+":
+		query.Header.Inst = gdb.Merge
+	case "-":
+		// subtracting merges the negated operand
+		query.Header.Inst = gdb.Merge
+		if bytes.HasPrefix(value, []byte("-")) {
+			value = value[1:]
+		} else {
+			value = append([]byte("-"), value...)
+		}
+	}
+	query.Value = value
+	return nil
+}
+
+func (p *planner) deleteStmt(query *gdb.Query, stmt *DeleteStmt) error {
+	query.Header.Inst = gdb.DeleteRange
+	query.Header.TableName = []byte(stmt.Table.Name)
+	kp, err := p.writeKeys(stmt.Where, "delete")
+	if err != nil {
+		return err
+	}
+	switch {
+	case kp.point != nil:
+		query.KeyRange = gdb.KeyRange{Start: kp.point, End: kp.point}
+	case kp.keys != nil, kp.kr.Prefix != nil, kp.kr.StartExclusive, kp.kr.EndExclusive:
+		return fmt.Errorf(
+			"%w: delete needs key =, between, >= or <= conditions", gdb.ErrInvalidQuery)
+	default:
+		query.KeyRange = gdb.KeyRange{Start: kp.kr.Start, End: kp.kr.End}
+	}
+	return nil
+}
+
+func (p *planner) createTableStmt(query *gdb.Query, stmt *CreateTableStmt) error {
+	query.Header.Inst = gdb.AddTable
+	query.Header.TableName = []byte(stmt.Table.Name)
+	if stmt.Options == nil {
+		return nil
+	}
+	opts := gdb.DefaultTableOpts(query.Header.TableName)
+	for _, option := range stmt.Options {
+		value, err := p.inspect(option.Value)
+		if err != nil {
+			return err
+		}
+		if err = opts.SetOption(option.Name, string(value)); err != nil {
+			return fmt.Errorf("%s: %w", option.Pos, err)
+		}
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	query.Header.Opts = opts
+	return nil
+}
+
+// options returns option names paired with their values
+func (p *planner) options(options []*Option) ([]gdb.KeyValue, error) {
+	out := make([]gdb.KeyValue, 0, len(options))
+	for _, option := range options {
+		value, err := p.value(option.Value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, gdb.KeyValue{Key: []byte(option.Name), Value: value})
+	}
+	return out, nil
+}
+
+// planTemplate is the plan of a statement with a placeholder in place
+// of each of its arguments, which bind fills in so a cached statement
+// is not planned again each time it runs
+type planTemplate struct {
+	plan *queryPlan
+	// slots maps the value planned for each placeholder to it
+	slots map[string]*Placeholder
+}
+
+// newTemplate plans stmt with a slot value standing in for each of its
+// placeholders. It returns nil when the plan depends on the value of a
+// placeholder, or when stmt is explained and so is timed as it is planned.
+func newTemplate(stmt Statement) *planTemplate {
+	if _, ok := stmt.(*ExplainStmt); ok {
+		return nil
+	}
+	p := &planner{slots: make(map[string]*Placeholder)}
+	qp, err := p.plan(stmt)
+	if err != nil || p.inspected {
+		return nil
+	}
+	return &planTemplate{plan: qp, slots: p.slots}
+}
+
+// bind returns the template's plan with args in place of its slots
+func (t *planTemplate) bind(args []driver.NamedValue) (*queryPlan, error) {
+	p := &planner{args: args}
+	var err error
+	fill := func(v []byte) []byte {
+		e, ok := t.slots[string(v)]
+		if !ok || err != nil {
+			return v
+		}
+		v, err = p.value(e)
+		return v
+	}
+	tmpl := t.plan.query
+	query := gdb.NewQuery(context.Background(), nil)
+	query.Header = tmpl.Header
+	query.Header.FileName = fill(tmpl.Header.FileName)
+	if tmpl.Header.Opts != nil {
+		// the proxy keeps the options of the table it adds
+		opts := *tmpl.Header.Opts
+		query.Header.Opts = &opts
+	}
+	query.KeyRange = tmpl.KeyRange
+	query.KeyRange.Start = fill(tmpl.KeyRange.Start)
+	query.KeyRange.End = fill(tmpl.KeyRange.End)
+	query.KeyRange.Prefix = fill(tmpl.KeyRange.Prefix)
+	query.KeyRange.Cursor = fill(tmpl.KeyRange.Cursor)
+	query.KeyRange.Filter = bindPredicate(tmpl.KeyRange.Filter, fill)
+	query.Key = fill(tmpl.Key)
+	query.Value = fill(tmpl.Value)
+	if tmpl.Values != nil {
+		query.Values = make([]gdb.KeyValue, len(tmpl.Values))
+		for i, kv := range tmpl.Values {
+			query.Values[i] = gdb.KeyValue{Key: fill(kv.Key), Value: fill(kv.Value)}
+		}
+	}
+	query.Project = tmpl.Project
+	query.Aggregates = tmpl.Aggregates
+	query.GroupBy = tmpl.GroupBy
+	if tmpl.Join != nil {
+		join := *tmpl.Join
+		join.Filter = bindPredicate(tmpl.Join.Filter, fill)
+		query.Join = &join
+	}
+	if err != nil {
+		return nil, err
+	}
+	qp := *t.plan
+	qp.query = query
+	return &qp, nil
+}
+
+// bindPredicate returns a copy of pred with fill applied to its operands
+func bindPredicate(pred *gdb.Predicate, fill func([]byte) []byte) *gdb.Predicate {
+	if pred == nil {
+		return nil
+	}
+	bound := *pred
+	bound.Operand = fill(pred.Operand)
+	if pred.Args != nil {
+		bound.Args = make([]*gdb.Predicate, len(pred.Args))
+		for i, arg := range pred.Args {
+			bound.Args[i] = bindPredicate(arg, fill)
+		}
+	}
+	return &bound
+}
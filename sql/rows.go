@@ -0,0 +1,189 @@
+package sql
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+
+	gdb "github.com/blong14/gache/internal/db"
+)
+
+// Column names of the rows a query returns
+const (
+	keyColumn   = "key"
+	valueColumn = "value"
+)
+
+// Database type names reported for the columns of a row
+const (
+	bytesType   = "BYTES"
+	integerType = "INTEGER"
+	jsonType    = "JSON"
+	numericType = "NUMERIC"
+	textType    = "TEXT"
+)
+
+// nameValueColumns are the columns of rows that describe a table or a query
+var nameValueColumns = []column{{name: "name", typ: textType}, {name: "value", typ: textType, field: 1}}
+
+// cursorColumns are the columns of the result set that follows a paged range
+var cursorColumns = []column{{name: "cursor", typ: textType}}
+
+type column struct {
+	name string
+	typ  string
+	// field is the index of the column in the rows of the response
+	field int
+	// nullable columns read a missing field as NULL
+	nullable bool
+}
+
+// rows streams the result of a query one key/value at a time. Range
+// queries are read from the table iterator as the caller advances;
+// other responses are read from their RangeValues. A paged range, one
+// with a limit or resumed after a cursor, is followed by a result set
+// holding the cursor that resumes it, with no rows once it is exhausted.
+type rows struct {
+	columns []column
+	iter    *gdb.RangeIterator
+	started bool
+	values  [][][]byte
+	// paged is set while the cursor result set is still to come
+	paged  bool
+	cursor []byte
+}
+
+func newRows(qp *queryPlan, resp *gdb.QueryResponse) *rows {
+	r := &rows{iter: resp.Rows, values: resp.RangeValues, cursor: resp.Cursor}
+	switch kr := qp.query.KeyRange; qp.query.Header.Inst {
+	case gdb.GetRange, gdb.JoinRange:
+		r.paged = resp.Success && (kr.Limit > 0 || kr.Cursor != nil)
+	}
+	switch qp.query.Header.Inst {
+	case gdb.ListTables:
+		r.columns = []column{{name: "table", typ: textType}, {name: "storage", typ: textType, field: 1}}
+	case gdb.Print:
+		r.columns = nameValueColumns
+	default:
+		r.columns = qp.columns
+		if r.columns == nil {
+			r.columns = []column{
+				{name: keyColumn, typ: bytesType},
+				{name: valueColumn, typ: bytesType, field: 1},
+			}
+		}
+		if r.values == nil && r.iter == nil && resp.Success && resp.Key != nil {
+			// single key writes answer with the key and its new value
+			r.values = [][][]byte{{resp.Key, resp.Value}}
+		}
+	}
+	return r
+}
+
+// project fills dest with the columns of a row, converting INTEGER
+// and NUMERIC fields to numbers
+func (r *rows) project(dest []driver.Value, row [][]byte) error {
+	for i, c := range r.columns {
+		field := row[c.field]
+		var err error
+		switch {
+		case c.nullable && field == nil:
+			dest[i] = nil
+		case c.typ == integerType:
+			dest[i], err = strconv.ParseInt(string(field), 10, 64)
+		case c.typ == numericType:
+			dest[i], err = strconv.ParseFloat(string(field), 64)
+		default:
+			dest[i] = field
+		}
+		if err != nil {
+			return fmt.Errorf("column %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+func (r *rows) Columns() []string {
+	names := make([]string, len(r.columns))
+	for i, c := range r.columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+// ColumnTypeDatabaseTypeName returns BYTES for keys and values, JSON
+// and TEXT for members of JSON values, INTEGER for counts, NUMERIC for
+// other aggregates and TEXT for table metadata
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.columns[index].typ
+}
+
+func (r *rows) ColumnTypeScanType(index int) reflect.Type {
+	switch r.columns[index].typ {
+	case integerType:
+		return reflect.TypeOf(int64(0))
+	case numericType:
+		return reflect.TypeOf(float64(0))
+	default:
+		return reflect.TypeOf([]byte(nil))
+	}
+}
+
+func (r *rows) Close() error {
+	if r.iter == nil {
+		return nil
+	}
+	iter := r.iter
+	r.iter = nil
+	return iter.Close()
+}
+
+// HasNextResultSet reports whether the cursor of a paged range is still to be read
+func (r *rows) HasNextResultSet() bool {
+	return r.paged
+}
+
+// NextResultSet moves on to the cursor of a paged range, which resumes
+// it after the last row read
+func (r *rows) NextResultSet() error {
+	if !r.paged {
+		return io.EOF
+	}
+	r.paged = false
+	if r.iter != nil {
+		r.cursor = r.iter.Cursor()
+	}
+	r.columns = cursorColumns
+	r.values = nil
+	if r.cursor != nil {
+		r.values = [][][]byte{{r.cursor}}
+	}
+	return r.Close()
+}
+
+// Next fills dest with the next row and returns io.EOF after the last
+func (r *rows) Next(dest []driver.Value) error {
+	switch {
+	case r.iter != nil:
+		if r.started {
+			r.iter.Next()
+		}
+		r.started = true
+		if !r.iter.Valid() {
+			if err := r.iter.Err(); err != nil {
+				return err
+			}
+			return io.EOF
+		}
+		return r.project(dest, r.iter.Row())
+	default:
+		if len(r.values) == 0 {
+			return io.EOF
+		}
+		row := r.values[0]
+		r.values = r.values[1:]
+		return r.project(dest, row)
+	}
+}
@@ -1,10 +1,21 @@
 package sql
 
 import (
+	"context"
+	gosql "database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
 	"strings"
 	"testing"
+	"time"
 
 	gdb "github.com/blong14/gache/internal/db"
+	gproxy "github.com/blong14/gache/internal/proxy"
+	gserver "github.com/blong14/gache/internal/server"
 )
 
 func TestParse(t *testing.T) {
@@ -36,13 +47,120 @@ func TestParse(t *testing.T) {
 			},
 			KeyRange: gdb.KeyRange{Start: []byte("aaa"), End: []byte("ddd")},
 		},
+		"delete from default where key between aaa and ddd;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.DeleteRange,
+				TableName: []byte("default"),
+			},
+			KeyRange: gdb.KeyRange{Start: []byte("aaa"), End: []byte("ddd")},
+		},
+		"dump default;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.Range,
+				TableName: []byte("default"),
+			},
+		},
+		"describe default;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.Print,
+				TableName: []byte("default"),
+			},
+		},
+		"select * from default where key like 'user:%' order by key desc limit 5;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.GetRange,
+				TableName: []byte("default"),
+			},
+			KeyRange: gdb.KeyRange{Prefix: []byte("user:"), Reverse: true, Limit: 5},
+		},
+		"select * from default where key > aaa and key <= ddd;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.GetRange,
+				TableName: []byte("default"),
+			},
+			KeyRange: gdb.KeyRange{
+				Start: []byte("aaa"), End: []byte("ddd"), StartExclusive: true},
+		},
+		"select * from default where key >= a and (value > 10 or not value like '%x%') limit 3;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.GetRange,
+				TableName: []byte("default"),
+			},
+			KeyRange: gdb.KeyRange{
+				Start: []byte("a"), Limit: 3,
+				Filter: gdb.NewLogical(gdb.Or,
+					gdb.NewComparison(gdb.Greater, []byte("10")),
+					gdb.NewLogical(gdb.Not, gdb.NewComparison(gdb.Like, []byte("%x%")))),
+			},
+		},
+		"select * from default limit 2 after 'AAAAAAAAAAFh';": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.GetRange,
+				TableName: []byte("default"),
+			},
+			KeyRange: gdb.KeyRange{Limit: 2, Cursor: []byte("AAAAAAAAAAFh")},
+		},
+		"select * from default where key in (aaa, 'bbb',ccc);": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.BatchGetValue,
+				TableName: []byte("default"),
+			},
+			Values: []gdb.KeyValue{
+				{Key: []byte("aaa")}, {Key: []byte("bbb")}, {Key: []byte("ccc")}},
+		},
 		"select count from default;": {
 			Header: gdb.QueryHeader{
-				Inst:      gdb.Count,
+				Inst:      gdb.Aggregate,
+				TableName: []byte("default"),
+			},
+			Aggregates: []gdb.Aggregation{{Func: gdb.AggCount}},
+		},
+		"select sum(value->'$.n'), max(value) from default where key like 'a:%' group by prefix(key, ':', 2);": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.Aggregate,
 				TableName: []byte("default"),
 			},
+			KeyRange: gdb.KeyRange{Prefix: []byte("a:")},
+			Aggregates: []gdb.Aggregation{
+				{Func: gdb.AggSum, Arg: &gdb.Projection{Column: "value", Path: &gdb.JSONPath{Path: "$.n"}}},
+				{Func: gdb.AggMax, Arg: &gdb.Projection{Column: "value"}},
+			},
+			GroupBy: &gdb.GroupBy{Separator: []byte(":"), Parts: 2},
 		},
 
+		"insert into default (value, key) values (1, a), ('2', 'b');": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.BatchSetValue,
+				TableName: []byte("default"),
+			},
+			Values: []gdb.KeyValue{
+				{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte("2")}},
+		},
+		"insert into backup select key, value->'$.n' from default where key between a and c;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.InsertRange,
+				TableName: []byte("backup"),
+				Source:    []byte("default"),
+			},
+			KeyRange: gdb.KeyRange{Start: []byte("a"), End: []byte("c")},
+			Project: []gdb.Projection{
+				{Column: "key"}, {Column: "value", Path: &gdb.JSONPath{Path: "$.n"}}},
+		},
+		"select key, users.value, orders.value->>'$.total' from users left join orders on users.key = orders.key where key >= u:2 and users.value <> 'x';": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.JoinRange,
+				TableName: []byte("users"),
+			},
+			KeyRange: gdb.KeyRange{
+				Start:  []byte("u:2"),
+				Filter: gdb.NewComparison(gdb.NotEqual, []byte("x")),
+			},
+			Join: &gdb.Join{Table: []byte("orders"), Outer: true},
+			Project: []gdb.Projection{
+				{Column: "key"},
+				{Column: "value"},
+				{Column: "value", Path: &gdb.JSONPath{Path: "$.total", Text: true}, Joined: true}},
+		},
 		"insert into default set key = _key, value = _value;": {
 			Header: gdb.QueryHeader{
 				Inst:      gdb.SetValue,
@@ -52,6 +170,15 @@ func TestParse(t *testing.T) {
 			Value: []byte("_value"),
 		},
 
+		"update default set value = value + 1 where key = __key__;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.Merge,
+				TableName: []byte("default"),
+			},
+			Key:   []byte("__key__"),
+			Value: []byte("1"),
+		},
+
 		"copy default from ./persons.csv;": {
 			Header: gdb.QueryHeader{
 				Inst:      gdb.Load,
@@ -66,6 +193,33 @@ func TestParse(t *testing.T) {
 				TableName: []byte("default"),
 			},
 		},
+		"alter table default set (ttl = '2h', max_bytes = '1MB');": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.AlterTable,
+				TableName: []byte("default"),
+			},
+			Values: []gdb.KeyValue{
+				{Key: []byte("ttl"), Value: []byte("2h")},
+				{Key: []byte("max_bytes"), Value: []byte("1MB")},
+			},
+		},
+		"drop table default;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.DropTable,
+				TableName: []byte("default"),
+			},
+		},
+		"truncate table default;": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.TruncateTable,
+				TableName: []byte("default"),
+			},
+		},
+		"show tables;": {
+			Header: gdb.QueryHeader{
+				Inst: gdb.ListTables,
+			},
+		},
 	}
 	for test, expected := range tests {
 		t.Run(test, func(t *testing.T) {
@@ -81,3 +235,860 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestParse_TableOptions(t *testing.T) {
+	// given
+	stmt := "create table events with (in_memory = false, wal = true, " +
+		"data_dir = '/var/lib/gache', ttl = '1h', max_bytes = '256MB');"
+
+	// when
+	query, err := parse(strings.NewReader(stmt))
+
+	// then
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := query.Header.Opts
+	if opts == nil || opts.InMemory || !opts.WalMode ||
+		string(opts.DataDir) != "/var/lib/gache" ||
+		opts.TTL != time.Hour || opts.MaxBytes != 256<<20 {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	for _, invalid := range []string{
+		"create table events with (wal = true);",
+		"create table events with (ttl = 'soon');",
+		"create table events with (colour = 'blue');",
+		"create table events with ttl = '1h';",
+	} {
+		if _, err = parse(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestParse_Literals(t *testing.T) {
+	tests := map[string]*gdb.Query{
+		"insert into default set key = 'user 1', value = 'it''s here';": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.SetValue,
+				TableName: []byte("default"),
+			},
+			Key:   []byte("user 1"),
+			Value: []byte("it's here"),
+		},
+		"SELECT * FROM default WHERE key IN ('a b','c',d)": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.BatchGetValue,
+				TableName: []byte("default"),
+			},
+			Values: []gdb.KeyValue{
+				{Key: []byte("a b")}, {Key: []byte("c")}, {Key: []byte("d")}},
+		},
+		"update default set value = value - 5 where key = counter": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.Merge,
+				TableName: []byte("default"),
+			},
+			Key:   []byte("counter"),
+			Value: []byte("-5"),
+		},
+		"update default set value = value-5 where key = 'order-1'": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.Merge,
+				TableName: []byte("default"),
+			},
+			Key:   []byte("order-1"),
+			Value: []byte("-5"),
+		},
+		"update default set value = value - 5 where key = order-1": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.Merge,
+				TableName: []byte("default"),
+			},
+			Key:   []byte("order-1"),
+			Value: []byte("-5"),
+		},
+		"select * from default where key = user-1": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.GetValue,
+				TableName: []byte("default"),
+			},
+			Key: []byte("user-1"),
+		},
+		"select * from default where key = 0b6f3c2e-93a1-4c5d-8e2f-7a1d9c4b5e60": {
+			Header: gdb.QueryHeader{
+				Inst:      gdb.GetValue,
+				TableName: []byte("default"),
+			},
+			Key: []byte("0b6f3c2e-93a1-4c5d-8e2f-7a1d9c4b5e60"),
+		},
+	}
+	for test, expected := range tests {
+		t.Run(test, func(t *testing.T) {
+			query, err := parse(strings.NewReader(test))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if query.String() != expected.String() {
+				t.Errorf("e %s g %s", expected, query)
+			}
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := map[string]string{
+		"selec * from default;":                            "syntax error at line 1, column 1: unknown statement 'selec'",
+		"select * form default;":                           "syntax error at line 1, column 10: expected from, found 'form'",
+		"select * from default\nwhere key = 'open;":        "syntax error at line 2, column 13: unterminated quoted literal",
+		"select * from default where key # 1;":             "syntax error at line 1, column 33: unexpected character '#'",
+		"select * from default limit 1 extra;":             "syntax error at line 1, column 31: unexpected 'extra' after the end of the statement",
+		"select * from default where key like 'a%b'":       "invalid query at line 1, column 38: unsupported key pattern a%b",
+		"select * from default where value = 1 or key = a": "invalid query at line 1, column 42: key conditions cannot be combined with or and not",
+		"select key, count(*) from default":                "invalid query at line 1, column 8: key must be an aggregate function",
+		"insert into b select value, key from a":           "invalid query at line 1, column 22: insert select needs key as its first column",
+		"select value from a join b on a.key = b.key":      "invalid query at line 1, column 8: column value is ambiguous; name its table",
+		"select * from a join b on a.key = b.value":        "invalid query at line 1, column 17: tables can only be joined on their keys",
+	}
+	for test, expected := range tests {
+		t.Run(test, func(t *testing.T) {
+			_, err := parse(strings.NewReader(test))
+			if err == nil || err.Error() != expected {
+				t.Errorf("e %s g %v", expected, err)
+			}
+			if !errors.Is(err, gdb.ErrInvalidQuery) {
+				t.Errorf("expected an invalid query g %v", err)
+			}
+		})
+	}
+}
+
+func TestStmt_Placeholders(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	get := func(query string, args ...interface{}) []byte {
+		var key, value []byte
+		if err := db.QueryRow(query, args...).Scan(&key, &value); err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	// given
+	insert, err := db.Prepare("insert into default set key = ?, value = ?;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, v := range []interface{}{"a", []byte("b"), 42, at} {
+		if _, err = insert.Exec(fmt.Sprintf("stmt:%d", i), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// when
+	named := get("select * from default where key = :key", gosql.Named("key", "stmt:2"))
+	ordinal := get("select * from default where key = $1", "stmt:3")
+	_, unsupported := db.Exec("insert into default set key = ?, value = ?", "stmt:4", 1.5)
+	_, missing := db.Exec("insert into default set key = :key, value = :value", gosql.Named("key", "stmt:5"))
+
+	// then
+	if string(named) != "42" {
+		t.Errorf("w 42 g %s", named)
+	}
+	if string(ordinal) != "2024-01-02T03:04:05Z" {
+		t.Errorf("w 2024-01-02T03:04:05Z g %s", ordinal)
+	}
+	if !errors.Is(unsupported, ErrInvalidQuery) {
+		t.Errorf("expected an unsupported argument error g %v", unsupported)
+	}
+	if missing == nil || !strings.Contains(missing.Error(), "missing argument for :value") {
+		t.Errorf("expected a missing argument error g %v", missing)
+	}
+}
+
+func TestStatementCache(t *testing.T) {
+	cache := newStatementCache()
+	arg := func(ordinal int, name, value string) driver.NamedValue {
+		return driver.NamedValue{Ordinal: ordinal, Name: name, Value: []byte(value)}
+	}
+	tests := map[string][]driver.NamedValue{
+		"select * from default where key = ?":                                {arg(1, "", "a")},
+		"select key from default where key between $1 and $2 and value > $3": {arg(1, "", "a"), arg(2, "", "c"), arg(3, "", "5")},
+		"select * from default where key in (?, ?) and value->'$.n' = ?":     {arg(1, "", "a"), arg(2, "", "b"), arg(3, "", "1")},
+		"insert into default values (:k, :v), (b, :v)":                       {arg(0, "k", "a"), arg(0, "v", "x")},
+		"update default set value = value + ? where key = ?":                 {arg(1, "", "2"), arg(2, "", "n")},
+		"delete from default where key >= ?":                                 {arg(1, "", "m")},
+		"select a.key from a join b on a.key = b.key where b.value = ?":      {arg(1, "", "x")},
+	}
+	for test, args := range tests {
+		t.Run(test, func(t *testing.T) {
+			s, err := cache.get(test)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.template == nil {
+				t.Fatal("expected the statement to be planned once")
+			}
+			bound, err := s.plan(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			planned, err := plan(s.ast, args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bound.query.String() != planned.query.String() {
+				t.Errorf("e %s g %s", planned.query, bound.query)
+			}
+		})
+	}
+	for _, test := range []string{
+		"select * from default where key > a limit ?",
+		"select * from default where key like ?",
+		"update default set value = value - ? where key = n",
+	} {
+		s, err := cache.get(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.template != nil {
+			t.Errorf("%s: expected a plan that depends on its arguments to be planned each run", test)
+		}
+	}
+	if _, err := cache.get("select * from default where key = ?"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxCachedStatements; i++ {
+		if _, err := cache.get(fmt.Sprintf("select * from default where key = k%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%8 == 0 {
+			// keep the first statement in use
+			if _, err := cache.get("select * from default where key = ?"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, ok := cache.stmts["select * from default where key = ?"]; !ok {
+		t.Error("expected the recently used statement to stay cached")
+	}
+	if _, ok := cache.stmts["delete from default where key >= ?"]; ok {
+		t.Error("expected the least recently used statement to be evicted")
+	}
+}
+
+func TestConn_Exec(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	exec := func(query string, args ...interface{}) int64 {
+		res, err := db.Exec(query, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// when
+	created := exec("create table exec;")
+	var inserted int64
+	for _, key := range []string{"a", "b", "c", "d"} {
+		inserted += exec("insert into exec set key = ?, value = 1", key)
+	}
+	updated := exec("update exec set value = value + 1 where key = a")
+	deleted := exec("delete from exec where key between b and c")
+	truncated := exec("truncate table exec")
+	dropped := exec("drop table exec")
+
+	// then
+	for _, tc := range []struct {
+		name      string
+		want, got int64
+	}{
+		{"create", 0, created},
+		{"insert", 4, inserted},
+		{"update", 1, updated},
+		{"delete", 2, deleted},
+		{"truncate", 2, truncated},
+		{"drop", 0, dropped},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: w %d rows affected g %d", tc.name, tc.want, tc.got)
+		}
+	}
+}
+
+func TestRows_Scan(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, query := range []string{
+		"create table scan;",
+		"insert into scan set key = a, value = 1;",
+		"insert into scan set key = b, value = 2;",
+		"insert into scan set key = c, value = 3;",
+	} {
+		if _, err = db.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	// when
+	rows, err := db.Query("select * from scan where key >= b;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, key+"="+value)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	_ = rows.Close()
+	var value string
+	projected := db.QueryRow("select value from scan where key = a;").Scan(&value)
+	var count int64
+	counted := db.QueryRow("select count(*) from scan;").Scan(&count)
+	var missing string
+	noRows := db.QueryRow("select * from scan where key = z;").Scan(&missing, &missing)
+
+	// then
+	if strings.Join(got, ",") != "b=2,c=3" {
+		t.Errorf("w b=2,c=3 g %s", strings.Join(got, ","))
+	}
+	if len(types) != 2 || types[0].Name() != "key" || types[1].DatabaseTypeName() != "BYTES" {
+		t.Errorf("unexpected column types %v", types)
+	}
+	if projected != nil || value != "1" {
+		t.Errorf("w 1 g %s %v", value, projected)
+	}
+	if counted != nil || count != 3 {
+		t.Errorf("w 3 g %d %v", count, counted)
+	}
+	if !errors.Is(noRows, gosql.ErrNoRows) {
+		t.Errorf("expected no rows g %v", noRows)
+	}
+}
+
+func TestParseDSN(t *testing.T) {
+	tests := map[string]Config{
+		":memory:": {Mode: Memory},
+		"file:/var/lib/gache?wal=true&sync=always": {
+			Mode: File, DataDir: "/var/lib/gache", WAL: true, Sync: true},
+		"file:data": {Mode: File, DataDir: "data"},
+		"gache://localhost:9090?timeout=2s": {
+			Mode: Remote, Addr: "localhost:9090", Timeout: 2 * time.Second},
+		"gache://cache.internal": {
+			Mode: Remote, Addr: "cache.internal:8080", Timeout: gdb.DefaultTimeout},
+	}
+	for dsn, expected := range tests {
+		t.Run(dsn, func(t *testing.T) {
+			cfg, err := ParseDSN(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *cfg != expected {
+				t.Errorf("w %+v g %+v", expected, *cfg)
+			}
+		})
+	}
+	for _, invalid := range []string{
+		"memory",
+		"file:",
+		"file:/tmp?sync=always",
+		"file:/tmp?wal=maybe",
+		"gache://localhost?timeout=soon",
+		"gache://localhost?colour=blue",
+	} {
+		if _, err := ParseDSN(invalid); !errors.Is(err, ErrInvalidDSN) {
+			t.Errorf("expected %s to be rejected g %v", invalid, err)
+		}
+	}
+}
+
+func TestDriver_FileDSN(t *testing.T) {
+	dir := t.TempDir()
+	db, err := gosql.Open("gache", "file:"+dir+"?wal=true&sync=always")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// when
+	_, err = db.Exec("insert into default set key = a, value = 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := gdb.LoadTableOpts([]byte(dir), []byte("default"))
+
+	// then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.WalMode || !opts.SyncWAL {
+		t.Errorf("unexpected options %+v", opts)
+	}
+}
+
+func TestDriver_RemoteDSN(t *testing.T) {
+	proxy, err := gproxy.NewQueryProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gproxy.StartProxy(context.Background(), proxy)
+	t.Cleanup(func() { gproxy.StopProxy(context.Background(), proxy) })
+	srv := rpc.NewServer()
+	if err = srv.Register(&gserver.QueryService{Proxy: proxy}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() { _ = http.Serve(l, srv) }()
+	db, err := gosql.Open("gache", "gache://"+l.Addr().String()+"?timeout=2s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	// when
+	_, created := db.Exec("create table events with (ttl = '1h', merge_operator = max);")
+	for _, key := range []string{"remote:a", "remote:b"} {
+		if _, err = db.Exec("insert into default set key = ?, value = ?;", key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	rows, err := db.Query("select key from default where key like 'remote:%';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, key)
+	}
+	_ = rows.Close()
+	paged, cursor := pageReader(t)(db.Query("select * from default where key like 'remote:%' limit 1;"))
+	_, missing := db.Exec("insert into missing set key = a, value = 1;")
+	query, _ := gdb.NewGetValueQuery(context.Background(), []byte("default"), []byte("remote:a"))
+	service := &gserver.QueryService{Proxy: proxy}
+	expired := service.OnQuery(&gserver.QueryRequest{
+		Query:    query,
+		Deadline: time.Now().Add(-time.Second),
+	}, new(gserver.QueryResponse))
+
+	// then
+	if created != nil {
+		t.Errorf("expected the table options to reach the server g %v", created)
+	}
+	if strings.Join(got, ",") != "remote:a,remote:b" {
+		t.Errorf("w remote:a,remote:b g %s", strings.Join(got, ","))
+	}
+	if paged != "remote:a" || cursor == "" {
+		t.Errorf("expected the cursor to reach the client w remote:a g %s %q", paged, cursor)
+	}
+	if !errors.Is(missing, ErrTableNotFound) {
+		t.Errorf("expected a table not found error g %v", missing)
+	}
+	if !errors.Is(expired, context.DeadlineExceeded) {
+		t.Errorf("expected the client's deadline to reach the server g %v", expired)
+	}
+}
+
+// pageReader returns a func reading the keys of a paged range and the
+// cursor that follows them
+func pageReader(t *testing.T) func(*gosql.Rows, error) (string, string) {
+	return func(rows *gosql.Rows, err error) (string, string) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = rows.Close() }()
+		var keys []string
+		for rows.Next() {
+			var key, value []byte
+			if err = rows.Scan(&key, &value); err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, string(key))
+		}
+		if !rows.NextResultSet() {
+			t.Fatalf("expected a cursor to follow the page %v", rows.Err())
+		}
+		var cursor string
+		for rows.Next() {
+			if err = rows.Scan(&cursor); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ""), cursor
+	}
+}
+
+func TestRows_Cursor(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if _, err = db.Exec("insert into default set key = ?, value = ?;", "page:"+key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := db.Prepare("select * from default where key like 'page:%' limit 2 after ?;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = page.Close() })
+
+	readPage := pageReader(t)
+
+	// when
+	var pages []string
+	keys, cursor := readPage(db.Query("select * from default where key like 'page:%' limit 2;"))
+	pages = append(pages, keys)
+	if _, err = db.Exec("insert into default set key = 'page:bb', value = bb;"); err != nil {
+		t.Fatal(err)
+	}
+	for cursor != "" {
+		keys, cursor = readPage(page.Query(cursor))
+		pages = append(pages, keys)
+	}
+
+	// then
+	if strings.Join(pages, ",") != "page:apage:b,page:bbpage:c,page:dpage:e" {
+		t.Errorf("w page:apage:b,page:bbpage:c,page:dpage:e g %s", strings.Join(pages, ","))
+	}
+}
+
+func TestRows_Aggregate(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for k, v := range map[string]string{
+		"agg:eu:1": `{"n": 1}`,
+		"agg:eu:2": `{"n": 4}`,
+		"agg:us:1": `{"n": 10}`,
+		"agg:us:2": `{"m": 2}`,
+		"other":    `{"n": 100}`,
+	} {
+		if _, err = db.Exec("insert into default set key = ?, value = ?;", k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// when
+	rows, err := db.Query(
+		"select count(*), sum(value->'$.n'), avg(value->'$.n') from default " +
+			"where key like 'agg:%' group by prefix(key, ':', 2);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var group string
+		var count int64
+		var sum, avg float64
+		if err = rows.Scan(&group, &count, &sum, &avg); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s=%d/%g/%g", group, count, sum, avg))
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	_ = rows.Close()
+	var low, high gosql.NullFloat64
+	bounded := db.QueryRow(
+		"select min(value->'$.n'), max(value->'$.n') from default where key > agg:us:2;").Scan(&low, &high)
+
+	// then
+	if strings.Join(got, ",") != "agg:eu=2/5/2.5,agg:us=2/10/10" {
+		t.Errorf("w agg:eu=2/5/2.5,agg:us=2/10/10 g %s", strings.Join(got, ","))
+	}
+	if bounded != nil || low.Float64 != 100 || high.Float64 != 100 {
+		t.Errorf("w 100 100 g %v %v %v", low, high, bounded)
+	}
+}
+
+func TestRows_Explain(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, k := range []string{"e:1", "e:2", "e:3", "f:1"} {
+		if _, err = db.Exec("insert into default set key = ?, value = ?;", k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	explain := func(query string) map[string]string {
+		rows, err := db.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = rows.Close() }()
+		out := make(map[string]string)
+		for rows.Next() {
+			var name, value string
+			if err = rows.Scan(&name, &value); err != nil {
+				t.Fatal(err)
+			}
+			out[name] = value
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	// when
+	planned := explain("explain select * from default where key like 'e:%' and value <> 'e:2';")
+	analyzed := explain("explain analyze select key from default where key like 'e:%' and value <> 'e:2';")
+	point := explain("explain delete from default where key = e:1;")
+	_, notSelect := db.Query("explain analyze delete from default where key = e:1;")
+	var value string
+	kept := db.QueryRow("select value from default where key = e:1;").Scan(&value)
+
+	// then
+	if planned["access"] != "range scan" || planned["prefix"] != "e:" || planned["filter"] != "value <> 'e:2'" {
+		t.Errorf("unexpected plan %v", planned)
+	}
+	if _, ok := planned["rows"]; ok {
+		t.Errorf("expected explain not to run the query g %v", planned)
+	}
+	if analyzed["rows"] != "2" || analyzed["rows_scanned"] != "3" || analyzed["sstables"] != "0" {
+		t.Errorf("unexpected analysis %v", analyzed)
+	}
+	for _, stage := range []string{"stage.plan", "stage.execute", "stage.fetch"} {
+		if _, err := time.ParseDuration(analyzed[stage]); err != nil {
+			t.Errorf("expected %s to be a duration g %v", stage, analyzed)
+		}
+	}
+	if point["access"] != "range delete" || point["bounds"] != "[e:1, e:1]" {
+		t.Errorf("unexpected plan %v", point)
+	}
+	if !errors.Is(notSelect, gdb.ErrInvalidQuery) {
+		t.Errorf("expected an invalid query g %v", notSelect)
+	}
+	if kept != nil || value != "e:1" {
+		t.Errorf("expected explain not to delete e:1 g %s %v", value, kept)
+	}
+}
+
+func TestConn_InsertMany(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if _, err = db.Exec("create table copied;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// when
+	inserted, err := db.Exec(
+		"insert into default (key, value) values ('m:1', '1'), ('m:2', ?), ('m:3', '3'), ('n:1', '4');", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := db.Exec(
+		"insert into copied select * from default where key between m:2 and m:9 and value <> '3';")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("select * from copied;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, key+"="+value)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	_ = rows.Close()
+	_, missing := db.Exec("insert into missing select * from default;")
+
+	// then
+	if n, err := inserted.RowsAffected(); err != nil || n != 4 {
+		t.Errorf("w 4 inserted g %d %v", n, err)
+	}
+	if n, err := copied.RowsAffected(); err != nil || n != 1 {
+		t.Errorf("w 1 copied g %d %v", n, err)
+	}
+	if strings.Join(got, ",") != "m:2=2" {
+		t.Errorf("w m:2=2 g %s", strings.Join(got, ","))
+	}
+	if !errors.Is(missing, ErrTableNotFound) {
+		t.Errorf("expected a missing table g %v", missing)
+	}
+}
+
+func TestConn_Join(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, stmt := range []string{
+		"create table users;",
+		"create table orders;",
+		"insert into users (key, value) values ('u:1', 'ann'), ('u:2', 'bob'), ('u:3', 'cy'), ('u:4', 'di');",
+		`insert into orders (key, value) values ('u:1', '{"total": 5}'), ('u:3', '{"total": 7}'), ('u:9', '{"total": 1}');`,
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(rows *gosql.Rows, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = rows.Close() }()
+		var got []string
+		for rows.Next() {
+			var key, name string
+			var total gosql.NullString
+			if err = rows.Scan(&key, &name, &total); err != nil {
+				t.Fatal(err)
+			}
+			if !total.Valid {
+				total.String = "NULL"
+			}
+			got = append(got, key+"="+name+":"+total.String)
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(got, ",")
+	}
+	query := func(q string) string { return read(db.Query(q)) }
+	prepared, err := db.Prepare(
+		"select key, users.value, orders.value->>'$.total' from users join orders on users.key = orders.key where orders.value->>'$.total' > ?;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = prepared.Close() })
+
+	// when
+	inner := query(
+		"select key, users.value, orders.value->>'$.total' from users join orders on users.key = orders.key;")
+	left := query(
+		"select key, users.value, orders.value->>'$.total' from users left join orders on users.key = orders.key where key > u:1 order by key desc;")
+	filtered := query(
+		"select key, users.value, orders.value->>'$.total' from users left join orders on users.key = orders.key where orders.value->>'$.total' > 6;")
+	above6 := read(prepared.Query(6))
+	above4 := read(prepared.Query(4))
+
+	// then
+	if inner != "u:1=ann:5,u:3=cy:7" {
+		t.Errorf("w u:1=ann:5,u:3=cy:7 g %s", inner)
+	}
+	if left != "u:4=di:NULL,u:3=cy:7,u:2=bob:NULL" {
+		t.Errorf("w u:4=di:NULL,u:3=cy:7,u:2=bob:NULL g %s", left)
+	}
+	if filtered != "u:3=cy:7" {
+		t.Errorf("w u:3=cy:7 g %s", filtered)
+	}
+	if above6 != "u:3=cy:7" {
+		t.Errorf("w u:3=cy:7 g %s", above6)
+	}
+	if above4 != "u:1=ann:5,u:3=cy:7" {
+		t.Errorf("w u:1=ann:5,u:3=cy:7 g %s", above4)
+	}
+}
+
+func TestRows_JSONPath(t *testing.T) {
+	db, err := gosql.Open("gache", MEMORY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	docs := map[string]string{
+		"a": `{"user": {"name": "ada"}, "age": 36}`,
+		"b": `{"user": {"name": "bob"}, "age": 25}`,
+		"c": `{"age": 41}`,
+		"d": `plain text`,
+	}
+	for k, v := range docs {
+		if _, err = db.Exec("insert into default set key = ?, value = ?;", "json:"+k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// when
+	rows, err := db.Query(
+		"select key, value->>'$.user.name' from default " +
+			"where key like 'json:%' and (value->'$.age' > 30 or not value->'$.age' > 30);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var key string
+		var name gosql.NullString
+		if err = rows.Scan(&key, &name); err != nil {
+			t.Fatal(err)
+		}
+		if !name.Valid {
+			name.String = "NULL"
+		}
+		got = append(got, key+"="+name.String)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	_ = rows.Close()
+
+	// then
+	if strings.Join(got, ",") != "json:a=ada,json:b=bob,json:c=NULL" {
+		t.Errorf("w json:a=ada,json:b=bob,json:c=NULL g %s", strings.Join(got, ","))
+	}
+	if types[1].Name() != "value->>'$.user.name'" || types[1].DatabaseTypeName() != "TEXT" {
+		t.Errorf("unexpected column %s %s", types[1].Name(), types[1].DatabaseTypeName())
+	}
+}
@@ -0,0 +1,192 @@
+package sql
+
+import (
+	"container/list"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	gdb "github.com/blong14/gache/internal/db"
+)
+
+// stmt is a prepared statement. It is parsed and planned once, and
+// its arguments are bound to the plan each time it runs.
+type stmt struct {
+	conn     *conn
+	ast      Statement
+	numInput int
+	// template is nil when the plan depends on the arguments, which
+	// then plan the statement each time it runs
+	template *planTemplate
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+// NumInput returns the number of positional arguments the statement
+// takes, or -1 when it has named placeholders
+func (s *stmt) NumInput() int {
+	return s.numInput
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	named, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.ExecContext(context.Background(), named)
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	q, err := s.plan(args)
+	if err != nil {
+		return nil, err
+	}
+	if q.explain {
+		// explaining writes nothing, though analyze still runs the query
+		rows, err := s.conn.query(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		return result{}, rows.Close()
+	}
+	return s.conn.exec(ctx, q.query)
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	named, err := namedValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.QueryContext(context.Background(), named)
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	q, err := s.plan(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.conn.query(ctx, q)
+}
+
+// plan returns the statement's plan with args bound to it
+func (s *stmt) plan(args []driver.NamedValue) (*queryPlan, error) {
+	if s.template != nil {
+		return s.template.bind(args)
+	}
+	return plan(s.ast, args)
+}
+
+func (s *stmt) CheckNamedValue(nv *driver.NamedValue) error {
+	return checkNamedValue(nv)
+}
+
+// namedValues converts the arguments of the legacy Stmt methods
+func namedValues(args []driver.Value) ([]driver.NamedValue, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+		if err := checkNamedValue(&named[i]); err != nil {
+			return nil, err
+		}
+	}
+	return named, nil
+}
+
+// checkNamedValue converts an argument to the bytes a placeholder binds
+func checkNamedValue(nv *driver.NamedValue) error {
+	if valuer, ok := nv.Value.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return err
+		}
+		nv.Value = v
+	}
+	switch v := nv.Value.(type) {
+	case []byte:
+	case string:
+		nv.Value = []byte(v)
+	case int:
+		nv.Value = []byte(strconv.FormatInt(int64(v), 10))
+	case int8:
+		nv.Value = []byte(strconv.FormatInt(int64(v), 10))
+	case int16:
+		nv.Value = []byte(strconv.FormatInt(int64(v), 10))
+	case int32:
+		nv.Value = []byte(strconv.FormatInt(int64(v), 10))
+	case int64:
+		nv.Value = []byte(strconv.FormatInt(v, 10))
+	case uint:
+		nv.Value = []byte(strconv.FormatUint(uint64(v), 10))
+	case uint8:
+		nv.Value = []byte(strconv.FormatUint(uint64(v), 10))
+	case uint16:
+		nv.Value = []byte(strconv.FormatUint(uint64(v), 10))
+	case uint32:
+		nv.Value = []byte(strconv.FormatUint(uint64(v), 10))
+	case uint64:
+		nv.Value = []byte(strconv.FormatUint(v, 10))
+	case time.Time:
+		nv.Value = []byte(v.Format(time.RFC3339Nano))
+	default:
+		return fmt.Errorf("%w: unsupported argument type %T", gdb.ErrInvalidQuery, v)
+	}
+	return nil
+}
+
+// maxCachedStatements bounds how many planned statements are kept
+const maxCachedStatements = 256
+
+// statementCache keeps planned statements by their text so a statement
+// run again is neither parsed nor planned again. The least recently
+// used statement is evicted once it is full.
+type statementCache struct {
+	mtx   sync.Mutex
+	stmts map[string]*list.Element
+	// lru orders the cached statements from most to least recently used
+	lru *list.List
+}
+
+// cachedStatement is the value of an lru element
+type cachedStatement struct {
+	query string
+	stmt  *stmt
+}
+
+func newStatementCache() *statementCache {
+	return &statementCache{stmts: make(map[string]*list.Element), lru: list.New()}
+}
+
+// get returns the planned statement for query, parsing and planning it on a miss
+func (c *statementCache) get(query string) (*stmt, error) {
+	c.mtx.Lock()
+	if e, ok := c.stmts[query]; ok {
+		c.lru.MoveToFront(e)
+		c.mtx.Unlock()
+		return e.Value.(*cachedStatement).stmt, nil
+	}
+	c.mtx.Unlock()
+	ast, numInput, err := parseStatement(query)
+	if err != nil {
+		return nil, err
+	}
+	cached := &stmt{ast: ast, numInput: numInput, template: newTemplate(ast)}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.stmts[query]; ok {
+		// planned meanwhile by another caller
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedStatement).stmt, nil
+	}
+	if c.lru.Len() >= maxCachedStatements {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.stmts, oldest.Value.(*cachedStatement).query)
+	}
+	c.stmts[query] = c.lru.PushFront(&cachedStatement{query: query, stmt: cached})
+	return cached, nil
+}